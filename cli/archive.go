@@ -0,0 +1,106 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/signal"
+	"syscall"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/lock"
+	"go.ntppool.org/archiver/source"
+	"go.ntppool.org/archiver/storage"
+)
+
+func runArchive(table string, cfg *config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	lk, ctx, err := setupArchive(ctx, table, false, cfg)
+	if err != nil {
+		return err
+	}
+	defer lk.Release()
+
+	err = archiveTable(ctx, table, cfg)
+	if lerr := lk.Err(); lerr != nil {
+		return lerr
+	}
+	return err
+}
+
+// setupArchive validates the table, connects to the database and
+// takes the archiver lock for the table, with wait as a standby until
+// it's available. The returned context is cancelled if the lock is
+// lost.
+func setupArchive(ctx context.Context, table string, wait bool, cfg *config.Config) (lock.Lock, context.Context, error) {
+	if err := setupDB(ctx, table, cfg); err != nil {
+		return nil, nil, err
+	}
+	return getLock(ctx, cfg, cfg.GetLockName(table), wait)
+}
+
+// setupDB validates the table and connects to the database
+func setupDB(ctx context.Context, table string, cfg *config.Config) error {
+	// Validate table name
+	if !cfg.IsValidTable(table) {
+		return fmt.Errorf("invalid table name '%s', must be one of: %v", table, cfg.App.ValidTables)
+	}
+
+	err := db.Setup()
+	if err != nil {
+		return fmt.Errorf("database connection: %s", err)
+	}
+
+	if err = db.Ping(ctx); err != nil {
+		log.Fatalf("Could not connect to database: %s", err)
+	}
+
+	return nil
+}
+
+// archiveTable runs each archiver (and the cleanup) once
+func archiveTable(ctx context.Context, table string, cfg *config.Config) error {
+	status, err := storage.GetArchiveStatus(ctx, table)
+	if err != nil {
+		return fmt.Errorf("archive status: %s", err)
+	}
+	if len(status) == 0 {
+		log.Printf("no archivers configured for %s in log_scores_archive_status", table)
+		return nil
+	}
+
+	source, err := source.New(table, cfg.RetentionDaysFor(table))
+	if err != nil {
+		return fmt.Errorf("error creating source: %s", err)
+	}
+	source.BatchTimeout = cfg.App.BatchTimeout
+	source.Config = cfg
+
+	archivers := []storage.ArchiveStatus{}
+
+	for _, s := range status {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if s.Archiver == "cleanup" {
+			err = source.Cleanup(ctx, s)
+			if err != nil {
+				log.Printf("error running cleanup: %s", err)
+			}
+			continue
+		}
+
+		archivers = append(archivers, s)
+	}
+
+	err = source.Process(ctx, archivers)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	// register the built-in backends
+	_ "go.ntppool.org/archiver"
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/storage"
+)
+
+// runListBackends writes the registered storage backends, if they
+// are configured and their settings. Named instances found in the
+// environment are listed after the backend.
+func runListBackends(w io.Writer, cfg *config.Config) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	configured := func(b storage.Backend, instance string) string {
+		if b.Configured(cfg, instance) {
+			return "yes"
+		}
+		return "no"
+	}
+
+	fmt.Fprintln(tw, "NAME\tCONFIGURED\tDESCRIPTION")
+	for _, b := range storage.Backends() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", b.Name, configured(b, ""), b.Description)
+		for _, p := range b.Params {
+			help := []string{p.Help}
+			if p.Required {
+				help = append(help, "(required)")
+			}
+			fmt.Fprintf(tw, "  %s\t\t%s\n", p.Env, strings.Join(help, " "))
+		}
+		for _, instance := range b.Instances() {
+			fmt.Fprintf(tw, "%s:%s\t%s\t\n", b.Name, instance, configured(b, instance))
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"go.ntppool.org/archiver"
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/source"
+	"go.ntppool.org/archiver/storage"
+)
+
+// runBackfill stores the log scores from the files of the from
+// archiver with the to archiver
+func runBackfill(from, to string, filter storage.Filter, checkpoint string, cfg *config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if from == to {
+		return fmt.Errorf("can't backfill %s from itself", to)
+	}
+
+	fromArch, err := archiver.SetupArchiver(ctx, from, cfg)
+	if err != nil {
+		return fmt.Errorf("archiver %s: %w", from, err)
+	}
+	defer fromArch.Close()
+
+	reader, ok := fromArch.(storage.Reader)
+	if !ok {
+		return fmt.Errorf("can't backfill from %s, the backend can't read its files", from)
+	}
+
+	toArch, err := archiver.SetupArchiver(ctx, to, cfg)
+	if err != nil {
+		return fmt.Errorf("archiver %s: %w", to, err)
+	}
+	defer toArch.Close()
+
+	if len(checkpoint) == 0 {
+		checkpoint = fmt.Sprintf("backfill-%s.jsonl", strings.ReplaceAll(to, ":", "-"))
+	}
+
+	b := &source.Backfill{
+		From:       reader,
+		To:         toArch,
+		Filter:     filter,
+		Checkpoint: checkpoint,
+	}
+
+	result, err := b.Run(ctx)
+	fmt.Printf("Stored %d rows from %d files in %s (%d files done earlier), last id %d.\n",
+		result.Stored, result.Files, to, result.Skipped, result.LastID)
+	if err != nil {
+		return fmt.Errorf("%w (run again to continue from %s)", err, checkpoint)
+	}
+	return nil
+}
+
+// parseRange parses a --range time range, "since..until" with either
+// end optional
+func parseRange(s string) (storage.Filter, error) {
+	filter := storage.Filter{}
+	if len(s) == 0 {
+		return filter, nil
+	}
+
+	since, until, found := strings.Cut(s, "..")
+	if !found {
+		return filter, fmt.Errorf("range %q must be since..until", s)
+	}
+
+	var err error
+	if filter.Since, err = parseRestoreTime(since); err != nil {
+		return filter, fmt.Errorf("range: %s", err)
+	}
+	if filter.Until, err = parseRestoreTime(until); err != nil {
+		return filter, fmt.Errorf("range: %s", err)
+	}
+	if !filter.Since.IsZero() && !filter.Until.IsZero() && !filter.Since.Before(filter.Until) {
+		return filter, fmt.Errorf("range %q must start before it ends", s)
+	}
+	return filter, nil
+}
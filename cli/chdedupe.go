@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/storage"
+	"go.ntppool.org/archiver/storage/clickhouse"
+)
+
+// runCHDedupeCheck reports the log_scores partitions in the ClickHouse
+// archiver with duplicate ids
+func runCHDedupeCheck(name string, since time.Time, cfg *config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	arch, err := storage.Connect(ctx, name, cfg)
+	if err != nil {
+		return fmt.Errorf("archiver %s: %w", name, err)
+	}
+	defer arch.Close()
+
+	ch, ok := arch.(*clickhouse.CHArchiver)
+	if !ok {
+		return fmt.Errorf("%s isn't a clickhouse archiver", name)
+	}
+
+	engine, err := ch.Engine(ctx)
+	if err != nil {
+		return err
+	}
+
+	dups, err := ch.Duplicates(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	return writeDedupeReport(os.Stdout, engine, dups)
+}
+
+// writeDedupeReport writes a table with the duplicates in each
+// partition
+func writeDedupeReport(w io.Writer, engine string, dups []clickhouse.Duplicates) error {
+	if len(dups) == 0 {
+		_, err := fmt.Fprintf(w, "No duplicate ids in log_scores (%s).\n", engine)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	var total uint64
+	fmt.Fprintln(tw, "DATE\tROWS\tDUPLICATES")
+	for _, d := range dups {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", d.Date.Format(time.DateOnly), d.Rows, d.Duplicates)
+		total += d.Duplicates
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%d duplicate rows in %d partitions of log_scores (%s).\n", total, len(dups), engine)
+	return err
+}
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/source"
+)
+
+// cleanupResult is the cleanup plan for a table and how many rows
+// were deleted
+type cleanupResult struct {
+	source.CleanupPlan
+	Deleted int64
+}
+
+// runCleanup deletes archived rows from the tables now, regardless of
+// the cleanup interval, or with dryRun only reports what would be
+// deleted.
+func runCleanup(tables []string, dryRun bool, maxRows int, cfg *config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	for _, table := range tables {
+		if !cfg.IsValidTable(table) {
+			return fmt.Errorf("invalid table name '%s', must be one of: %v", table, cfg.App.ValidTables)
+		}
+	}
+
+	err := db.Setup()
+	if err != nil {
+		return fmt.Errorf("database connection: %s", err)
+	}
+	defer db.Pool.Close()
+
+	if err = db.Ping(ctx); err != nil {
+		return fmt.Errorf("could not connect to database: %s", err)
+	}
+
+	results := []cleanupResult{}
+
+	for _, table := range tables {
+		src, err := source.New(table, cfg.RetentionDaysFor(table))
+		if err != nil {
+			return fmt.Errorf("error creating source: %s", err)
+		}
+		src.Config = cfg
+
+		c := source.NewCleanup(cfg.RetentionDaysFor(table), cfg)
+
+		plan, err := c.Plan(ctx, src, maxRows)
+		if err != nil {
+			return fmt.Errorf("cleanup plan for %s: %s", table, err)
+		}
+		result := cleanupResult{CleanupPlan: plan}
+
+		if !dryRun && plan.Count > 0 {
+			lk, lockCtx, err := getLock(ctx, cfg, cfg.GetLockName(table), false)
+			if err != nil {
+				return err
+			}
+
+			rows := maxRows
+			if rows <= 0 {
+				rows = int(plan.Count)
+			}
+			result.Deleted, err = c.Clean(lockCtx, src, rows)
+			if lerr := lk.Err(); lerr != nil {
+				err = lerr
+			}
+			lk.Release()
+			if err != nil {
+				writeCleanupReport(os.Stdout, append(results, result), dryRun)
+				return fmt.Errorf("cleanup of %s: %s", table, err)
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return writeCleanupReport(os.Stdout, results, dryRun)
+}
+
+// writeCleanupReport writes a table with the rows to be deleted (and
+// deleted unless dryRun) for each table
+func writeCleanupReport(w io.Writer, results []cleanupResult, dryRun bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	formatTs := func(ts sql.NullTime) string {
+		if !ts.Valid {
+			return "-"
+		}
+		return ts.Time.UTC().Format(time.RFC3339)
+	}
+
+	var total int64
+	fmt.Fprintln(tw, "TABLE\tROWS\tFIRST ID\tLAST ID\tFIRST TS\tLAST TS\tDELETED")
+	for _, r := range results {
+		deleted := fmt.Sprint(r.Deleted)
+		if dryRun {
+			deleted = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%s\n",
+			r.Table, r.Count, r.FirstID, r.LastID,
+			formatTs(r.FirstTs), formatTs(r.LastTs), deleted,
+		)
+		total += r.Deleted
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if dryRun {
+		_, err := fmt.Fprintln(w, "Dry run, nothing was deleted.")
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Deleted %d rows.\n", total)
+	return err
+}
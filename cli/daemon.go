@@ -0,0 +1,228 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.ntppool.org/common/logger"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/server"
+	"go.ntppool.org/archiver/source"
+	"go.ntppool.org/archiver/storage"
+)
+
+// vaultSecretsDir is where the vault agent writes the *.env files
+const vaultSecretsDir = "/vault/secrets/"
+
+// runDaemon archives the table continuously, sleeping between runs
+// until the next archiver is due. SIGHUP reloads the environment and
+// database configuration; SIGINT or SIGTERM cancels the batch in
+// progress, which is archived again by the next run. With standby it
+// waits for the lock held by another archiver instead of exiting. With
+// listen set the status API and the metrics of this process are served
+// on it, also while waiting for the lock.
+func runDaemon(table string, minWait, maxWait time.Duration, standby bool, listen string, cfg *config.Config) error {
+	log := logger.Setup()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	if err := setupDB(ctx, table, cfg); err != nil {
+		return err
+	}
+	defer db.Pool.Close()
+
+	srvErr := make(chan error, 1)
+	if len(listen) > 0 {
+		stopServer, err := serveStatus(ctx, table, listen, cfg, srvErr)
+		if err != nil {
+			return err
+		}
+		// stopped before the pool is closed
+		defer stopServer()
+	}
+
+	lk, ctx, err := getLock(ctx, cfg, cfg.GetLockName(table), standby)
+	if err != nil {
+		return err
+	}
+	// released before the pool is closed
+	defer lk.Release()
+
+	sched := newScheduler(minWait, maxWait, cfg)
+
+	for {
+		err := archiveTable(ctx, table, cfg)
+		if lerr := lk.Err(); lerr != nil {
+			return lerr
+		}
+		if ctx.Err() != nil {
+			log.Info("shutting down")
+			return nil
+		}
+		if err != nil {
+			log.Error("archive run failed", "table", table, "err", err)
+		}
+
+		wait := sched.next(ctx, table)
+		log.Debug("waiting for next run", "wait", wait)
+
+		select {
+		case <-ctx.Done():
+			if lerr := lk.Err(); lerr != nil {
+				return lerr
+			}
+			log.Info("shutting down")
+			return nil
+
+		case err := <-srvErr:
+			return fmt.Errorf("status API: %w", err)
+
+		case <-hup:
+			log.Info("reloading configuration")
+			newCfg, err := reloadConfig()
+			if err != nil {
+				log.Error("could not reload configuration, keeping the old one", "err", err)
+				continue
+			}
+			cfg = newCfg
+			sched.reset(cfg)
+
+		case <-time.After(wait):
+		}
+	}
+}
+
+// serveStatus runs the status API with the metrics on listen in the
+// background. An error from the server is sent on errCh; the returned
+// function stops the server and waits for it.
+func serveStatus(ctx context.Context, table, listen string, cfg *config.Config, errCh chan<- error) (func(), error) {
+	src, err := source.New(table, cfg.RetentionDaysFor(table))
+	if err != nil {
+		return nil, fmt.Errorf("error creating source: %s", err)
+	}
+	src.Config = cfg
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		if err := server.New(src, db.Ping).ListenAndServe(ctx, listen); err != nil {
+			errCh <- err
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// reloadConfig re-reads the vault environment files, the configuration
+// and the database configuration
+func reloadConfig() (*config.Config, error) {
+	err := config.LoadEnvFiles(vaultSecretsDir)
+	if err != nil {
+		return nil, fmt.Errorf("loading environment files: %w", err)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Pool.UpdateConfig()
+	if err != nil {
+		return nil, fmt.Errorf("database configuration: %w", err)
+	}
+
+	globalConfig = cfg
+
+	return cfg, nil
+}
+
+// scheduler figures out how long to wait until an archiver is due
+type scheduler struct {
+	minWait   time.Duration
+	maxWait   time.Duration
+	intervals map[string]time.Duration
+	cfg       *config.Config
+}
+
+func newScheduler(minWait, maxWait time.Duration, cfg *config.Config) *scheduler {
+	return &scheduler{
+		minWait:   minWait,
+		maxWait:   maxWait,
+		intervals: map[string]time.Duration{},
+		cfg:       cfg,
+	}
+}
+
+// reset forgets the cached archiver intervals and uses the new
+// configuration going forward
+func (s *scheduler) reset(cfg *config.Config) {
+	s.intervals = map[string]time.Duration{}
+	s.cfg = cfg
+}
+
+// interval returns the batch interval for the named archiver, from
+// the configuration without setting up the archiver
+func (s *scheduler) interval(name string) (time.Duration, error) {
+	if interval, ok := s.intervals[name]; ok {
+		return interval, nil
+	}
+
+	var interval time.Duration
+
+	if name == "cleanup" {
+		interval = source.NewCleanup(0, s.cfg).Interval()
+	} else {
+		bs, _, ok := storage.BatchSize(name, s.cfg)
+		if !ok {
+			return 0, fmt.Errorf("unknown archiver '%s'", name)
+		}
+		interval = bs.Interval
+	}
+
+	s.intervals[name] = interval
+	return interval, nil
+}
+
+// next returns how long to wait until the next archiver for the
+// table is due, limited to the range minWait to maxWait.
+func (s *scheduler) next(ctx context.Context, table string) time.Duration {
+	log := logger.Setup()
+
+	status, err := storage.GetArchiveStatus(ctx, table)
+	if err != nil {
+		log.Error("archive status", "err", err)
+		return s.maxWait
+	}
+
+	now := time.Now()
+	wait := s.maxWait
+
+	for _, st := range status {
+		interval, err := s.interval(st.Archiver)
+		if err != nil {
+			log.Error("archiver interval", "archiver", st.Archiver, "err", err)
+			continue
+		}
+		if due := st.ModifiedOn.Add(interval).Sub(now); due < wait {
+			wait = due
+		}
+	}
+
+	return min(max(wait, s.minWait), s.maxWait)
+}
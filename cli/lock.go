@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/lock"
+	"go.ntppool.org/common/logger"
+)
+
+// heldLock closes the Locker when the lock is released
+type heldLock struct {
+	lock.Lock
+	locker lock.Locker
+}
+
+func (l heldLock) Release() error {
+	err := l.Lock.Release()
+	if cerr := l.locker.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// getLock takes the lock for name with the configured lock backend,
+// with wait as a standby until it's available. The returned context
+// is cancelled if the lock is lost; the lock must be released with
+// Release when done.
+func getLock(ctx context.Context, cfg *config.Config, name string, wait bool) (lock.Lock, context.Context, error) {
+	locker, err := lock.New(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var l lock.Lock
+	var lockCtx context.Context
+	if wait {
+		logger.Setup().Info("waiting for lock", "name", name, "backend", cfg.Lock.Backend)
+		l, lockCtx, err = locker.Wait(ctx, name)
+	} else {
+		l, lockCtx, err = locker.Acquire(ctx, name)
+	}
+	if err != nil {
+		locker.Close()
+		if errors.Is(err, lock.ErrNotAcquired) {
+			return nil, nil, fmt.Errorf("did not get lock %s, exiting", name)
+		}
+		return nil, nil, err
+	}
+
+	return heldLock{Lock: l, locker: locker}, lockCtx, nil
+}
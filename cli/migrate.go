@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/storage"
+)
+
+// runMigrate applies the pending schema migrations for the archiver,
+// or with status only lists them. The migrations are applied with the
+// archiver lock for the table held, waiting for it if needed, so no
+// rows are stored while the rollup tables are created and filled.
+func runMigrate(name, table string, status bool, cfg *config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if !status {
+		if err := setupDB(ctx, table, cfg); err != nil {
+			return err
+		}
+		defer db.Pool.Close()
+
+		lk, lockCtx, err := getLock(ctx, cfg, cfg.GetLockName(table), true)
+		if err != nil {
+			return err
+		}
+		// released before the pool is closed
+		defer lk.Release()
+		ctx = lockCtx
+	}
+
+	// connect without the migrations New applies on startup
+	arch, err := storage.Connect(ctx, name, cfg)
+	if err != nil {
+		return fmt.Errorf("archiver %s: %w", name, err)
+	}
+	defer arch.Close()
+
+	m, ok := arch.(storage.Migrator)
+	if !ok {
+		return fmt.Errorf("%s doesn't have schema migrations", name)
+	}
+
+	if !status {
+		applied, err := m.Migrate(ctx)
+		for _, migration := range applied {
+			fmt.Printf("Applied migration %d: %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("No pending migrations.")
+		}
+		return nil
+	}
+
+	migrations, err := m.Migrations(ctx)
+	if err != nil {
+		return err
+	}
+	return writeMigrations(os.Stdout, migrations)
+}
+
+// writeMigrations writes a table with the migrations and when they
+// were applied
+func writeMigrations(w io.Writer, migrations []storage.Migration) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+	for _, m := range migrations {
+		applied := "pending"
+		if m.Applied() {
+			applied = m.AppliedAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.ntppool.org/archiver"
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/source"
+	"go.ntppool.org/archiver/storage"
+)
+
+// runRestore reads the log scores matching the filter from the files
+// stored by the archiver and inserts them into the table
+func runRestore(from, table string, filter storage.Filter, dryRun bool, cfg *config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if !cfg.IsValidTable(table) {
+		return fmt.Errorf("invalid table name '%s', must be one of: %v", table, cfg.App.ValidTables)
+	}
+
+	arch, err := archiver.SetupArchiver(ctx, from, cfg)
+	if err != nil {
+		return fmt.Errorf("archiver %s: %w", from, err)
+	}
+	defer arch.Close()
+
+	reader, ok := arch.(storage.Reader)
+	if !ok {
+		return fmt.Errorf("can't restore from %s, the backend can't read its files", from)
+	}
+
+	err = db.Setup()
+	if err != nil {
+		return fmt.Errorf("database connection: %s", err)
+	}
+	defer db.Pool.Close()
+
+	if err = db.Ping(ctx); err != nil {
+		return fmt.Errorf("could not connect to database: %s", err)
+	}
+
+	src, err := source.New(table, cfg.RetentionDaysFor(table))
+	if err != nil {
+		return fmt.Errorf("error creating source: %s", err)
+	}
+	src.Config = cfg
+
+	result, err := src.Restore(ctx, reader, filter, dryRun)
+	if dryRun {
+		fmt.Printf("Read %d rows from %d files, %d would be restored into %s.\n",
+			result.Read, result.Files, result.Matched, table)
+	} else {
+		fmt.Printf("Read %d rows from %d files, inserted %d of %d matching rows into %s.\n",
+			result.Read, result.Files, result.Inserted, result.Matched, table)
+	}
+	return err
+}
+
+// parseRestoreTime parses a --since or --until time, either RFC3339
+// or a UTC date
+func parseRestoreTime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q must be a date (2006-01-02) or RFC3339 time", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,245 @@
+// Package cli implements the archiver command line interface.
+//
+// To add storage backends from another module, build a program that
+// imports the backend packages (so they call storage.Register) and
+// runs Execute.
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/storage"
+)
+
+var globalConfig *config.Config
+
+// CLI represents the command line interface
+type CLI struct {
+	Archive  ArchiveCmd  `cmd:"archive" help:"Archive log scores"`
+	Run      RunCmd      `cmd:"run" help:"Archive log scores, optionally as a daemon"`
+	Serve    ServeCmd    `cmd:"serve" help:"Run the HTTP status API"`
+	Cleanup  CleanupCmd  `cmd:"cleanup" help:"Delete archived log scores now, or report what would be deleted"`
+	Restore  RestoreCmd  `cmd:"restore" help:"Load log scores from the archive files back into a table"`
+	Backfill BackfillCmd `cmd:"backfill" help:"Store the log scores from the archive files with another archiver"`
+	Migrate  MigrateCmd  `cmd:"migrate" help:"Apply the pending schema migrations for an archiver"`
+
+	CHDedupeCheck CHDedupeCheckCmd `cmd:"ch-dedupe-check" help:"Report duplicate ids in the ClickHouse log_scores table"`
+
+	ListBackends ListBackendsCmd `cmd:"list-backends" help:"List the compiled in storage backends"`
+}
+
+// ArchiveCmd represents the archive command
+type ArchiveCmd struct {
+	Table string `short:"t" default:"log_scores" help:"Table to pull data from"`
+}
+
+// Run executes the archive command
+func (cmd *ArchiveCmd) Run() error {
+	return runArchive(cmd.Table, globalConfig)
+}
+
+// RunCmd represents the run command
+type RunCmd struct {
+	Table   string        `short:"t" default:"log_scores" help:"Table to pull data from"`
+	Daemon  bool          `short:"d" help:"Keep running, archiving as each archiver is due"`
+	MinWait time.Duration `default:"1m" help:"Minimum wait between runs in daemon mode"`
+	MaxWait time.Duration `default:"10m" help:"Maximum wait between runs in daemon mode"`
+	Standby bool          `help:"In daemon mode, wait for the lock when another archiver has it"`
+	Listen  string        `short:"l" help:"In daemon mode, serve the status API and metrics on this address (e.g. :5000)"`
+}
+
+// Run executes the run command
+func (cmd *RunCmd) Run() error {
+	if cmd.Standby && !cmd.Daemon {
+		return fmt.Errorf("standby requires daemon mode")
+	}
+	if len(cmd.Listen) > 0 && !cmd.Daemon {
+		return fmt.Errorf("listen requires daemon mode")
+	}
+	if !cmd.Daemon {
+		return runArchive(cmd.Table, globalConfig)
+	}
+	if cmd.MinWait > cmd.MaxWait {
+		return fmt.Errorf("min-wait (%s) can't be longer than max-wait (%s)", cmd.MinWait, cmd.MaxWait)
+	}
+	return runDaemon(cmd.Table, cmd.MinWait, cmd.MaxWait, cmd.Standby, cmd.Listen, globalConfig)
+}
+
+// ServeCmd represents the serve command
+type ServeCmd struct {
+	Listen string `short:"l" default:":5000" help:"Address to listen on"`
+	Table  string `short:"t" default:"log_scores" help:"Table to report the archive lag for"`
+}
+
+// Run executes the serve command
+func (cmd *ServeCmd) Run() error {
+	return runServe(cmd.Listen, cmd.Table, globalConfig)
+}
+
+// CleanupCmd represents the cleanup command
+type CleanupCmd struct {
+	Tables  []string `short:"t" name:"table" default:"log_scores" help:"Tables to clean up (comma-separated)"`
+	DryRun  bool     `short:"n" help:"Report what would be deleted without deleting anything"`
+	MaxRows int      `help:"Maximum rows to delete per table (default is one cleanup batch)"`
+}
+
+// Run executes the cleanup command
+func (cmd *CleanupCmd) Run() error {
+	if cmd.MaxRows < 0 {
+		return fmt.Errorf("max-rows can't be negative")
+	}
+	return runCleanup(cmd.Tables, cmd.DryRun, cmd.MaxRows, globalConfig)
+}
+
+// RestoreCmd represents the restore command
+type RestoreCmd struct {
+	From     string `required:"" help:"Archiver to read the files from (fileavro, gcsavro or a named instance)"`
+	ServerID int64  `help:"Only restore log scores for this server"`
+	Since    string `help:"Restore log scores from this time (2006-01-02 or RFC3339)"`
+	Until    string `help:"Restore log scores before this time (2006-01-02 or RFC3339)"`
+	Into     string `default:"log_scores_archive" help:"Table to insert the log scores into"`
+	DryRun   bool   `short:"n" help:"Count the log scores that would be restored without inserting them"`
+}
+
+// Run executes the restore command
+func (cmd *RestoreCmd) Run() error {
+	filter := storage.Filter{ServerID: cmd.ServerID}
+
+	var err error
+	if filter.Since, err = parseRestoreTime(cmd.Since); err != nil {
+		return fmt.Errorf("since: %s", err)
+	}
+	if filter.Until, err = parseRestoreTime(cmd.Until); err != nil {
+		return fmt.Errorf("until: %s", err)
+	}
+	if !filter.Since.IsZero() && !filter.Until.IsZero() && !filter.Since.Before(filter.Until) {
+		return fmt.Errorf("since (%s) must be before until (%s)", cmd.Since, cmd.Until)
+	}
+
+	return runRestore(cmd.From, cmd.Into, filter, cmd.DryRun, globalConfig)
+}
+
+// BackfillCmd represents the backfill command
+type BackfillCmd struct {
+	From       string `required:"" help:"Archiver to read the files from (fileavro, gcsavro or a named instance)"`
+	To         string `required:"" help:"Archiver to store the log scores with, for example clickhouse:new"`
+	Range      string `help:"Time range to backfill, since..until (2006-01-02 or RFC3339, either can be left out)"`
+	BeforeID   int64  `help:"Only backfill log scores before this id, where the archiver's status starts"`
+	Checkpoint string `help:"File recording the progress (default backfill-ARCHIVER.jsonl)"`
+}
+
+// Run executes the backfill command
+func (cmd *BackfillCmd) Run() error {
+	filter, err := parseRange(cmd.Range)
+	if err != nil {
+		return err
+	}
+	filter.BeforeID = cmd.BeforeID
+
+	return runBackfill(cmd.From, cmd.To, filter, cmd.Checkpoint, globalConfig)
+}
+
+// MigrateCmd represents the migrate command
+type MigrateCmd struct {
+	Archiver string `arg:"" optional:"" default:"clickhouse" help:"Archiver to migrate, for example clickhouse:analytics"`
+	Status   bool   `help:"List the migrations and when they were applied instead of applying them"`
+	Table    string `short:"t" default:"log_scores" help:"Table whose archiver lock is held while migrating"`
+}
+
+// Run executes the migrate command
+func (cmd *MigrateCmd) Run() error {
+	return runMigrate(cmd.Archiver, cmd.Table, cmd.Status, globalConfig)
+}
+
+// CHDedupeCheckCmd represents the ch-dedupe-check command
+type CHDedupeCheckCmd struct {
+	Archiver string `default:"clickhouse" help:"ClickHouse archiver to check, for example clickhouse:analytics"`
+	Since    string `help:"Only check the partitions from this date (2006-01-02)"`
+}
+
+// Run executes the ch-dedupe-check command
+func (cmd *CHDedupeCheckCmd) Run() error {
+	since, err := parseRestoreTime(cmd.Since)
+	if err != nil {
+		return fmt.Errorf("since: %s", err)
+	}
+	return runCHDedupeCheck(cmd.Archiver, since, globalConfig)
+}
+
+// ListBackendsCmd represents the list-backends command
+type ListBackendsCmd struct{}
+
+// Run executes the list-backends command
+func (cmd *ListBackendsCmd) Run() error {
+	return runListBackends(os.Stdout, globalConfig)
+}
+
+// Execute parses command line arguments and executes the appropriate command
+func Execute() {
+	// Load secrets written by the vault agent
+	if err := config.LoadEnvFiles(vaultSecretsDir); err != nil {
+		log.Printf("Failed to load environment files: %v", err)
+	}
+
+	// Load configuration
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	globalConfig = cfg
+
+	// Parse CLI
+	var cli CLI
+	ctx := kong.Parse(&cli,
+		kong.Name("archiver"),
+		kong.Description("Archive NTP Pool log scores"),
+		kong.UsageOnError(),
+		kong.ConfigureHelp(kong.HelpOptions{
+			Compact: true,
+		}),
+		kong.Vars{
+			"version": cfg.App.Version,
+		},
+	)
+
+	// Execute the command
+	err = ctx.Run()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// loadConfig loads and validates the configuration
+func loadConfig() (*config.Config, error) {
+	var cfg config.Config
+
+	// Parse with Kong to get environment variables
+	parser, err := kong.New(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating parser: %w", err)
+	}
+
+	// Parse empty args to load from environment
+	_, err = parser.Parse([]string{})
+	if err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+
+	// Post-process and validate
+	if err := cfg.PostProcess(); err != nil {
+		return nil, fmt.Errorf("validating config: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// getGlobalConfig returns the global configuration
+func getGlobalConfig() *config.Config {
+	return globalConfig
+}
@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/server"
+	"go.ntppool.org/archiver/source"
+)
+
+func runServe(listen, table string, cfg *config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if !cfg.IsValidTable(table) {
+		return fmt.Errorf("invalid table name '%s', must be one of: %v", table, cfg.App.ValidTables)
+	}
+
+	err := db.Setup()
+	if err != nil {
+		return fmt.Errorf("database connection: %s", err)
+	}
+	defer db.Pool.Close()
+
+	if err = db.Ping(ctx); err != nil {
+		return fmt.Errorf("could not connect to database: %s", err)
+	}
+
+	source, err := source.New(table, cfg.RetentionDaysFor(table))
+	if err != nil {
+		return fmt.Errorf("error creating source: %s", err)
+	}
+	source.Config = cfg
+
+	srv := server.New(source, db.Ping)
+
+	return srv.ListenAndServe(ctx, listen)
+}
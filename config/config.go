@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,8 +22,10 @@ type Config struct {
 
 	// Cleanup configuration
 	Cleanup Cleanup `embed:"" group:"Cleanup Configuration:"`
-}
 
+	// Lock configuration
+	Lock Lock `embed:"" group:"Lock Configuration:"`
+}
 
 // Storage configuration for all backends
 type Storage struct {
@@ -42,17 +45,30 @@ type Storage struct {
 	// Local Avro
 	AvroPath string `env:"avro_path" help:"Local directory path for Avro files"`
 
+	// Avro file compression for fileavro, gcsavro, s3avro and bigquery
+	AvroCompression string `env:"avro_compression" default:"null" help:"Avro file compression (null, deflate or snappy)"`
+
+	// Local Parquet
+	ParquetPath string `env:"parquet_path" help:"Local directory path for Parquet files"`
+
+	// S3 compatible object storage
+	S3Bucket string `env:"s3_bucket" help:"S3 bucket name for Avro files"`
+
 	// Google Application Credentials
 	GoogleApplicationCredentials string `env:"GOOGLE_APPLICATION_CREDENTIALS" help:"Path to Google service account credentials"`
 }
 
 // App configuration
 type App struct {
-	Version              string   `env:"app_version" default:"1.3" help:"Application version"`
-	DefaultTable         string   `env:"app_default_table" default:"log_scores" help:"Default table name"`
-	ValidTables          []string `env:"app_valid_tables" default:"log_scores,log_scores_archive,log_scores_test" help:"Valid table names (comma-separated)"`
-	RetentionDays        int      `env:"retention_days" default:"15" help:"Data retention period in days"`
-	RetentionDaysDefault int      `env:"retention_days_default" default:"14" help:"Default retention days fallback"`
+	Version              string        `env:"app_version" default:"1.3" help:"Application version"`
+	DefaultTable         string        `env:"app_default_table" default:"log_scores" help:"Default table name"`
+	ValidTables          []string      `env:"app_valid_tables" default:"log_scores,log_scores_archive,log_scores_test" help:"Valid table names (comma-separated)"`
+	RetentionDays        int           `env:"retention_days" default:"15" help:"Data retention period in days"`
+	RetentionDaysDefault int           `env:"retention_days_default" default:"14" help:"Default retention days fallback"`
+	TableRetentionDays   string        `env:"retention_days_tables" help:"Retention days for specific tables (table=days, comma-separated)"`
+	BatchTimeout         time.Duration `env:"batch_timeout" default:"0s" help:"Maximum time to read and store a batch (0 for no limit)"`
+
+	tableRetentionDays map[string]int
 }
 
 // Batch configuration for different storage backends
@@ -72,6 +88,96 @@ type Batch struct {
 	FileAvroMaxSize    int           `env:"batch_avro_max_size" default:"10000000" help:"File Avro maximum batch size"`
 	FileAvroInterval   time.Duration `env:"batch_avro_interval" default:"24h" help:"File Avro batch processing interval"`
 	FileAvroAppendSize int           `env:"batch_avro_append_size" default:"50000" help:"File Avro append batch size"`
+
+	// Per archiver overrides, "name=min/max/interval;..."
+	Overrides string `env:"batch_overrides" help:"Per archiver batch sizes (name=min/max/interval, separated by semicolons)"`
+
+	overrides map[string]BatchSize
+}
+
+// BatchSize is the batch sizing for an archiver
+type BatchSize struct {
+	MinSize  int
+	MaxSize  int
+	Interval time.Duration
+}
+
+// Validate checks that the sizes are positive and min isn't larger than max
+func (bs BatchSize) Validate() error {
+	if bs.MinSize <= 0 || bs.MaxSize <= 0 {
+		return fmt.Errorf("batch sizes must be positive")
+	}
+	if bs.MinSize > bs.MaxSize {
+		return fmt.Errorf("minimum batch size (%d) is larger than the maximum (%d)", bs.MinSize, bs.MaxSize)
+	}
+	if bs.Interval < 0 {
+		return fmt.Errorf("batch interval can't be negative")
+	}
+	return nil
+}
+
+// BigQuery returns the BigQuery batch sizing
+func (b Batch) BigQuery() BatchSize {
+	return BatchSize{b.BigQueryMinSize, b.BigQueryMaxSize, b.BigQueryInterval}
+}
+
+// ClickHouse returns the ClickHouse batch sizing
+func (b Batch) ClickHouse() BatchSize {
+	return BatchSize{b.ClickHouseMinSize, b.ClickHouseMaxSize, b.ClickHouseInterval}
+}
+
+// FileAvro returns the batch sizing for the avro file backends
+func (b Batch) FileAvro() BatchSize {
+	return BatchSize{b.FileAvroMinSize, b.FileAvroMaxSize, b.FileAvroInterval}
+}
+
+// For returns the batch sizing for the named archiver. An override for
+// the full name ("clickhouse:primary") is used before an override for
+// the backend ("clickhouse"), otherwise def is returned. The second
+// return value is true if an override was used.
+func (b Batch) For(name string, def BatchSize) (BatchSize, bool) {
+	if bs, ok := b.overrides[name]; ok {
+		return bs, true
+	}
+	if backend, _, found := strings.Cut(name, ":"); found {
+		if bs, ok := b.overrides[backend]; ok {
+			return bs, true
+		}
+	}
+	return def, false
+}
+
+// parseOverrides parses the Overrides setting
+func (b *Batch) parseOverrides() error {
+	b.overrides = map[string]BatchSize{}
+
+	for _, o := range strings.Split(b.Overrides, ";") {
+		o = strings.TrimSpace(o)
+		if len(o) == 0 {
+			continue
+		}
+		name, sizes, found := strings.Cut(o, "=")
+		name = strings.TrimSpace(name)
+		parts := strings.Split(sizes, "/")
+		if !found || len(name) == 0 || len(parts) != 3 {
+			return fmt.Errorf("batch override %q must be name=min/max/interval", o)
+		}
+
+		var bs BatchSize
+		var err error
+		if bs.MinSize, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+			return fmt.Errorf("batch override %q: min size: %w", o, err)
+		}
+		if bs.MaxSize, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return fmt.Errorf("batch override %q: max size: %w", o, err)
+		}
+		if bs.Interval, err = time.ParseDuration(strings.TrimSpace(parts[2])); err != nil {
+			return fmt.Errorf("batch override %q: interval: %w", o, err)
+		}
+		b.overrides[name] = bs
+	}
+
+	return nil
 }
 
 // Cleanup configuration
@@ -80,6 +186,20 @@ type Cleanup struct {
 	BatchSize       int           `env:"cleanup_batch_size" default:"200000" help:"Cleanup batch size"`
 	ReducedInterval time.Duration `env:"cleanup_reduced_interval" default:"1m" help:"Reduced cleanup interval when batch is full"`
 	FakeInterval    time.Duration `env:"cleanup_fake_interval" default:"10m" help:"Fake cleanup archiver interval"`
+	Verify          bool          `env:"cleanup_verify" default:"false" help:"Check that the archivers have the rows before deleting them"`
+	ChunkSize       int           `env:"cleanup_chunk_size" default:"10000" help:"Rows deleted per statement"`
+	TimeBudget      time.Duration `env:"cleanup_time_budget" default:"1m" help:"Maximum time a cleanup run keeps deleting"`
+	MaxReplicaLag   time.Duration `env:"cleanup_max_replica_lag" default:"0s" help:"Pause the cleanup while replica lag is higher (0 to disable)"`
+	LagQuery        string        `env:"cleanup_lag_query" help:"Query returning the replica lag in seconds (default SHOW REPLICA STATUS)"`
+	LagPause        time.Duration `env:"cleanup_lag_pause" default:"5s" help:"Time to wait before checking the replica lag again"`
+}
+
+// Lock configuration
+type Lock struct {
+	Backend       string        `env:"lock_backend" default:"mysql" help:"Lock backend (mysql or etcd)"`
+	EtcdEndpoints []string      `env:"etcd_endpoints" help:"etcd endpoints (comma-separated)"`
+	EtcdPrefix    string        `env:"etcd_lock_prefix" default:"/ntppool/archiver/lock" help:"etcd key prefix for the locks"`
+	TTL           time.Duration `env:"etcd_lock_ttl" default:"10s" help:"etcd lease TTL, how long until a standby takes over a lost lock"`
 }
 
 // Validate validates the configuration
@@ -98,9 +218,19 @@ func (c *Config) Validate() error {
 	if c.Storage.AvroPath != "" {
 		hasStorage = true
 	}
+	if c.Storage.ParquetPath != "" {
+		hasStorage = true
+	}
+	if c.Storage.S3Bucket != "" {
+		hasStorage = true
+	}
+	if !hasStorage && len(Instances("ch_dsn", "bq_dataset", "gc_bucket", "avro_path", "parquet_path", "s3_bucket")) > 0 {
+		// only named instances (ch_dsn_primary etc) are configured
+		hasStorage = true
+	}
 
 	if !hasStorage {
-		return fmt.Errorf("at least one storage backend must be configured (ch_dsn, bq_dataset, gc_bucket, or avro_path)")
+		return fmt.Errorf("at least one storage backend must be configured (ch_dsn, bq_dataset, gc_bucket, avro_path, parquet_path or s3_bucket)")
 	}
 
 	// Validate app configuration
@@ -113,16 +243,56 @@ func (c *Config) Validate() error {
 	if c.App.RetentionDays <= 0 {
 		return fmt.Errorf("retention days must be positive")
 	}
+	for table, days := range c.App.tableRetentionDays {
+		if !c.IsValidTable(table) {
+			return fmt.Errorf("retention days set for invalid table '%s'", table)
+		}
+		if days <= 0 {
+			return fmt.Errorf("retention days for %s must be positive", table)
+		}
+	}
 
 	// Validate batch configuration
-	if c.Batch.BigQueryMinSize <= 0 || c.Batch.BigQueryMaxSize <= 0 {
-		return fmt.Errorf("BigQuery batch sizes must be positive")
+	if err := c.Batch.BigQuery().Validate(); err != nil {
+		return fmt.Errorf("BigQuery %w", err)
 	}
-	if c.Batch.ClickHouseMinSize <= 0 || c.Batch.ClickHouseMaxSize <= 0 {
-		return fmt.Errorf("ClickHouse batch sizes must be positive")
+	if err := c.Batch.ClickHouse().Validate(); err != nil {
+		return fmt.Errorf("ClickHouse %w", err)
 	}
-	if c.Batch.FileAvroMinSize <= 0 || c.Batch.FileAvroMaxSize <= 0 {
-		return fmt.Errorf("File Avro batch sizes must be positive")
+	if err := c.Batch.FileAvro().Validate(); err != nil {
+		return fmt.Errorf("File Avro %w", err)
+	}
+	if c.Batch.FileAvroAppendSize < 0 {
+		return fmt.Errorf("File Avro append size can't be negative")
+	}
+	// Validate cleanup configuration
+	if c.Cleanup.BatchSize < 0 {
+		return fmt.Errorf("cleanup batch size can't be negative")
+	}
+	switch c.Lock.Backend {
+	case "", "mysql", "etcd":
+	default:
+		return fmt.Errorf("unknown lock backend %q, must be mysql or etcd", c.Lock.Backend)
+	}
+	if c.Lock.Backend == "etcd" && len(c.Lock.EtcdEndpoints) == 0 {
+		return fmt.Errorf("the etcd lock backend needs etcd_endpoints")
+	}
+	if c.Lock.TTL < 0 {
+		return fmt.Errorf("etcd lock TTL can't be negative")
+	}
+
+	if c.Cleanup.ChunkSize < 0 || c.Cleanup.TimeBudget < 0 || c.Cleanup.MaxReplicaLag < 0 || c.Cleanup.LagPause < 0 {
+		return fmt.Errorf("cleanup chunk size, time budget, replica lag and lag pause can't be negative")
+	}
+	if c.Cleanup.ReducedInterval > c.Cleanup.DefaultInterval {
+		return fmt.Errorf("cleanup reduced interval (%s) is longer than the default interval (%s)",
+			c.Cleanup.ReducedInterval, c.Cleanup.DefaultInterval)
+	}
+
+	for name, bs := range c.Batch.overrides {
+		if err := bs.Validate(); err != nil {
+			return fmt.Errorf("batch override for %s: %w", name, err)
+		}
 	}
 
 	return nil
@@ -138,9 +308,55 @@ func (c *Config) PostProcess() error {
 		}
 	}
 
+	if err := c.App.parseTableRetentionDays(); err != nil {
+		return err
+	}
+
+	if err := c.Batch.parseOverrides(); err != nil {
+		return err
+	}
+
+	if len(c.Lock.EtcdEndpoints) == 1 && strings.Contains(c.Lock.EtcdEndpoints[0], ",") {
+		c.Lock.EtcdEndpoints = strings.Split(c.Lock.EtcdEndpoints[0], ",")
+		for i, endpoint := range c.Lock.EtcdEndpoints {
+			c.Lock.EtcdEndpoints[i] = strings.TrimSpace(endpoint)
+		}
+	}
+
 	return c.Validate()
 }
 
+// parseTableRetentionDays parses the TableRetentionDays setting
+func (a *App) parseTableRetentionDays() error {
+	a.tableRetentionDays = map[string]int{}
+
+	for _, tr := range strings.Split(a.TableRetentionDays, ",") {
+		tr = strings.TrimSpace(tr)
+		if len(tr) == 0 {
+			continue
+		}
+		table, days, found := strings.Cut(tr, "=")
+		if !found {
+			return fmt.Errorf("table retention %q must be table=days", tr)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(days))
+		if err != nil {
+			return fmt.Errorf("table retention %q: %w", tr, err)
+		}
+		a.tableRetentionDays[strings.TrimSpace(table)] = n
+	}
+
+	return nil
+}
+
+// RetentionDaysFor returns the retention days for the table, either
+// from retention_days_tables or the general retention_days setting
+func (c *Config) RetentionDaysFor(table string) int {
+	if days, ok := c.App.tableRetentionDays[table]; ok {
+		return days
+	}
+	return c.App.RetentionDays
+}
 
 // IsValidTable checks if a table name is in the valid tables list
 func (c *Config) IsValidTable(table string) bool {
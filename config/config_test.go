@@ -39,6 +39,7 @@ func TestKongConfig(t *testing.T) {
 	assert.Equal(t, "ntppool", cfg.Storage.GCSProject)
 	assert.Equal(t, "avro/binary", cfg.Storage.GCSContentType)
 	assert.Equal(t, "public, max-age=157248000", cfg.Storage.GCSCacheControl)
+	assert.Equal(t, "null", cfg.Storage.AvroCompression)
 
 	// Test app configuration
 	assert.Equal(t, "1.3", cfg.App.Version)
@@ -177,6 +178,26 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestValidateNamedInstance(t *testing.T) {
+	cfg := &Config{
+		App: App{
+			DefaultTable:  "log_scores",
+			ValidTables:   []string{"log_scores"},
+			RetentionDays: 15,
+		},
+		Batch: Batch{
+			BigQueryMinSize:   200,
+			BigQueryMaxSize:   10000000,
+			ClickHouseMinSize: 50,
+			ClickHouseMaxSize: 500000,
+			FileAvroMinSize:   500000,
+			FileAvroMaxSize:   10000000,
+		},
+	}
+
+	t.Setenv("ch_dsn_primary", "tcp://localhost:9000/test")
+	assert.NoError(t, cfg.Validate())
+}
 
 func TestIsValidTable(t *testing.T) {
 	cfg := &Config{
@@ -226,6 +247,129 @@ func TestPostProcess(t *testing.T) {
 	assert.Equal(t, []string{"log_scores", "log_scores_archive", "log_scores_test"}, cfg.App.ValidTables)
 }
 
+func TestBatchOverrides(t *testing.T) {
+	newConfig := func(overrides string) *Config {
+		return &Config{
+			Storage: Storage{
+				AvroPath: "/tmp/test",
+			},
+			App: App{
+				DefaultTable:  "log_scores",
+				ValidTables:   []string{"log_scores"},
+				RetentionDays: 15,
+			},
+			Batch: Batch{
+				BigQueryMinSize:   200,
+				BigQueryMaxSize:   10000000,
+				ClickHouseMinSize: 50,
+				ClickHouseMaxSize: 500000,
+				FileAvroMinSize:   500000,
+				FileAvroMaxSize:   10000000,
+				Overrides:         overrides,
+			},
+		}
+	}
+
+	cfg := newConfig("clickhouse=100/1000/1m; clickhouse:analytics = 10/20/0s")
+	require.NoError(t, cfg.PostProcess())
+
+	bs, ok := cfg.Batch.For("clickhouse:analytics", cfg.Batch.ClickHouse())
+	assert.True(t, ok)
+	assert.Equal(t, BatchSize{10, 20, 0}, bs)
+
+	bs, ok = cfg.Batch.For("clickhouse:primary", cfg.Batch.ClickHouse())
+	assert.True(t, ok)
+	assert.Equal(t, BatchSize{100, 1000, time.Minute}, bs)
+
+	bs, ok = cfg.Batch.For("bigquery", cfg.Batch.BigQuery())
+	assert.False(t, ok)
+	assert.Equal(t, BatchSize{200, 10000000, 0}, bs)
+
+	for _, overrides := range []string{
+		"clickhouse=100/1000",
+		"clickhouse=a/1000/1m",
+		"clickhouse=100/1000/soon",
+		"=100/1000/1m",
+		"clickhouse=1000/100/1m",
+	} {
+		t.Run(overrides, func(t *testing.T) {
+			assert.Error(t, newConfig(overrides).PostProcess())
+		})
+	}
+
+	cfg = newConfig("")
+	cfg.Batch.ClickHouseMinSize = 1000000
+	err := cfg.PostProcess()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "larger than the maximum")
+}
+
+func TestRetentionDaysFor(t *testing.T) {
+	cfg := &Config{
+		Storage: Storage{
+			AvroPath: "/tmp/test",
+		},
+		App: App{
+			DefaultTable:       "log_scores",
+			ValidTables:        []string{"log_scores", "log_scores_test"},
+			RetentionDays:      15,
+			TableRetentionDays: "log_scores_test=2",
+		},
+		Batch: Batch{
+			BigQueryMinSize:   200,
+			BigQueryMaxSize:   10000000,
+			ClickHouseMinSize: 50,
+			ClickHouseMaxSize: 500000,
+			FileAvroMinSize:   500000,
+			FileAvroMaxSize:   10000000,
+		},
+	}
+	require.NoError(t, cfg.PostProcess())
+
+	assert.Equal(t, 15, cfg.RetentionDaysFor("log_scores"))
+	assert.Equal(t, 2, cfg.RetentionDaysFor("log_scores_test"))
+
+	cfg.App.TableRetentionDays = "log_scores_other=2"
+	assert.Error(t, cfg.PostProcess())
+
+	cfg.App.TableRetentionDays = "log_scores_test=0"
+	assert.Error(t, cfg.PostProcess())
+}
+
+func TestLockConfig(t *testing.T) {
+	cfg := &Config{
+		Storage: Storage{
+			AvroPath: "/tmp/test",
+		},
+		App: App{
+			DefaultTable:  "log_scores",
+			ValidTables:   []string{"log_scores"},
+			RetentionDays: 15,
+		},
+		Batch: Batch{
+			BigQueryMinSize:   200,
+			BigQueryMaxSize:   10000000,
+			ClickHouseMinSize: 50,
+			ClickHouseMaxSize: 500000,
+			FileAvroMinSize:   500000,
+			FileAvroMaxSize:   10000000,
+		},
+		Lock: Lock{
+			Backend:       "etcd",
+			EtcdEndpoints: []string{"etcd-0:2379, etcd-1:2379"},
+			TTL:           10 * time.Second,
+		},
+	}
+	require.NoError(t, cfg.PostProcess())
+	assert.Equal(t, []string{"etcd-0:2379", "etcd-1:2379"}, cfg.Lock.EtcdEndpoints)
+
+	cfg.Lock.EtcdEndpoints = nil
+	assert.ErrorContains(t, cfg.PostProcess(), "etcd_endpoints")
+
+	cfg.Lock.Backend = "zookeeper"
+	assert.ErrorContains(t, cfg.PostProcess(), "unknown lock backend")
+}
+
 func TestSpecialEnvironmentVariables(t *testing.T) {
 	// Test GOOGLE_APPLICATION_CREDENTIALS
 	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/path/to/creds.json")
@@ -261,3 +405,32 @@ func TestSpecialEnvironmentVariables(t *testing.T) {
 	assert.Equal(t, "/path/to/creds.json", cfg.Storage.GoogleApplicationCredentials)
 	assert.Equal(t, 30, cfg.App.RetentionDays)
 }
+
+func TestInstances(t *testing.T) {
+	t.Setenv("ch_dsn_primary", "tcp://localhost:9000/primary")
+	t.Setenv("ch_block_size_analytics", "1000")
+	t.Setenv("ch_dsn_empty", "")
+	t.Setenv("ch_dsn_bad-name", "x")
+
+	assert.Equal(t, []string{"analytics", "primary"}, Instances("ch_dsn", "ch_block_size"))
+	assert.Empty(t, Instances("bq_dataset"))
+
+	assert.NoError(t, ValidInstanceName("primary_2"))
+	assert.Error(t, ValidInstanceName(""))
+	assert.Error(t, ValidInstanceName("bad-name"))
+}
+
+func TestStorageSetting(t *testing.T) {
+	t.Setenv("ch_dsn", "from the environment")
+	t.Setenv("ch_dsn_primary", "tcp://localhost:9000/primary")
+	t.Setenv("ch_block_size", "1000")
+
+	s := Storage{ClickHouseDSN: "tcp://localhost:9000/parsed"}
+
+	// the default instance uses the parsed configuration
+	assert.Equal(t, "tcp://localhost:9000/parsed", s.Setting("ch_dsn", ""))
+	assert.Equal(t, "tcp://localhost:9000/primary", s.Setting("ch_dsn", "primary"))
+	// settings that aren't in Storage come from the environment
+	assert.Equal(t, "1000", s.Setting("ch_block_size", ""))
+	assert.Equal(t, "ch_block_size_analytics", InstanceEnv("ch_block_size", "analytics"))
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(dir, "storage.env"), []byte(`
+# ClickHouse
+export ch_dsn="tcp://localhost:9000/test"
+bq_dataset=ntpdev
+gc_bucket='archive-bucket'
+`), 0o600)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "ignored.txt"), []byte("avro_path=/nope\n"), 0o600)
+	require.NoError(t, err)
+
+	for _, k := range []string{"ch_dsn", "bq_dataset", "gc_bucket", "avro_path"} {
+		t.Setenv(k, "")
+	}
+
+	require.NoError(t, LoadEnvFiles(dir))
+
+	assert.Equal(t, "tcp://localhost:9000/test", os.Getenv("ch_dsn"))
+	assert.Equal(t, "ntpdev", os.Getenv("bq_dataset"))
+	assert.Equal(t, "archive-bucket", os.Getenv("gc_bucket"))
+	assert.Equal(t, "", os.Getenv("avro_path"))
+}
+
+func TestLoadEnvFilesMissingDir(t *testing.T) {
+	err := LoadEnvFiles(filepath.Join(t.TempDir(), "nonexistent"))
+	assert.NoError(t, err)
+}
+
+func TestLoadEnvFilesInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(dir, "bad.env"), []byte("not a variable\n"), 0o600)
+	require.NoError(t, err)
+
+	err = LoadEnvFiles(dir)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "line 1")
+}
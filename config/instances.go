@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ValidInstanceName returns an error if the name can't be used for a
+// named instance of a storage backend, as in "clickhouse:primary"
+func ValidInstanceName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("instance name is empty")
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return fmt.Errorf("instance name can only contain letters, digits and underscores")
+		}
+	}
+	return nil
+}
+
+// InstanceEnv returns the environment variable for the setting of a
+// named instance, for example ch_dsn_primary for ch_dsn. For the
+// default instance (a blank name) it's the variable itself.
+func InstanceEnv(env, instance string) string {
+	if len(instance) == 0 {
+		return env
+	}
+	return env + "_" + instance
+}
+
+// Instances returns the names of the instances that have at least one
+// of the settings set in the environment, sorted
+func Instances(envs ...string) []string {
+	seen := map[string]bool{}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if len(value) == 0 {
+			continue
+		}
+		for _, env := range envs {
+			instance, ok := strings.CutPrefix(key, env+"_")
+			if !ok {
+				continue
+			}
+			if ValidInstanceName(instance) == nil {
+				seen[instance] = true
+			}
+		}
+	}
+
+	instances := make([]string, 0, len(seen))
+	for instance := range seen {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	return instances
+}
+
+// Setting returns the value of a storage setting for the named
+// instance. Settings of the default instance that are in Storage come
+// from the parsed configuration; the others are read from the
+// environment.
+func (s Storage) Setting(env, instance string) string {
+	if len(instance) == 0 {
+		v := reflect.ValueOf(s)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).Tag.Get("env") == env && t.Field(i).Type.Kind() == reflect.String {
+				return v.Field(i).String()
+			}
+		}
+	}
+	return os.Getenv(InstanceEnv(env, instance))
+}
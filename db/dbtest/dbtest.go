@@ -0,0 +1,31 @@
+// Package dbtest has helpers for tests using the db package.
+package dbtest
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+
+	"go.ntppool.org/archiver/db"
+)
+
+// MockPool sets db.Pool to a sqlmock connection for the duration of
+// the test and returns the mock
+func MockPool(t testing.TB) sqlmock.Sqlmock {
+	t.Helper()
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %s", err)
+	}
+
+	originalPool := db.Pool
+	db.Pool = db.NewPoolFromDB(sqlx.NewDb(mockDB, "mysql"))
+	t.Cleanup(func() {
+		db.Pool = originalPool
+		mockDB.Close()
+	})
+
+	return mock
+}
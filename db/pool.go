@@ -21,6 +21,7 @@ type ConnectionPool interface {
 	Query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
 	Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 	Begin(ctx context.Context) (*sql.Tx, error)
+	Conn(ctx context.Context) (*sql.Conn, error)
 	Ping(ctx context.Context) error
 	Close() error
 	UpdateConfig() error
@@ -46,6 +47,15 @@ func NewPool() (*DatabasePool, error) {
 	return p, nil
 }
 
+// NewPoolFromDB returns a pool using an existing database handle,
+// for example a sqlmock connection in tests.
+func NewPoolFromDB(db *sqlx.DB) *DatabasePool {
+	return &DatabasePool{
+		db:     db,
+		logger: logger.Setup(),
+	}
+}
+
 // connect establishes the database connection using common/database
 func (p *DatabasePool) connect() error {
 	// Configure connection options optimized for archiver
@@ -115,6 +125,16 @@ func (p *DatabasePool) Begin(ctx context.Context) (*sql.Tx, error) {
 	return db.BeginTx(ctx, nil)
 }
 
+// Conn returns a dedicated connection from the pool, for session
+// state like advisory locks. It must be closed to return it.
+func (p *DatabasePool) Conn(ctx context.Context) (*sql.Conn, error) {
+	p.mu.RLock()
+	db := p.db
+	p.mu.RUnlock()
+
+	return db.Conn(ctx)
+}
+
 // Ping verifies the database connection is alive
 func (p *DatabasePool) Ping(ctx context.Context) error {
 	p.mu.RLock()
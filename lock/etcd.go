@@ -0,0 +1,169 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.ntppool.org/common/logger"
+)
+
+// Etcd is a Locker using an etcd lease. The lock is kept alive as
+// long as the lease is; if the process stops without releasing it,
+// a standby gets it when the lease expires after the TTL.
+type Etcd struct {
+	client *clientv3.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// NewEtcd connects to the etcd endpoints. Lock keys are the name with
+// prefix prepended.
+func NewEtcd(endpoints []string, prefix string, ttl time.Duration) (*Etcd, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoints configured")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("etcd: %w", err)
+	}
+
+	return NewEtcdFromClient(client, prefix, ttl), nil
+}
+
+// NewEtcdFromClient returns a Locker using an existing etcd client,
+// which is closed by Close
+func NewEtcdFromClient(client *clientv3.Client, prefix string, ttl time.Duration) *Etcd {
+	if ttl < time.Second {
+		ttl = 10 * time.Second
+	}
+	return &Etcd{client: client, prefix: prefix, ttl: ttl}
+}
+
+// etcdLock is a lock held with an etcd lease
+type etcdLock struct {
+	name    string
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Acquire implements Locker
+func (e *Etcd) Acquire(ctx context.Context, name string) (Lock, context.Context, error) {
+	return e.acquire(ctx, name, false)
+}
+
+// Wait implements Locker
+func (e *Etcd) Wait(ctx context.Context, name string) (Lock, context.Context, error) {
+	return e.acquire(ctx, name, true)
+}
+
+// Close implements Locker
+func (e *Etcd) Close() error {
+	return e.client.Close()
+}
+
+func (e *Etcd) key(name string) string {
+	return strings.TrimSuffix(e.prefix, "/") + "/" + name
+}
+
+func (e *Etcd) acquire(ctx context.Context, name string, wait bool) (Lock, context.Context, error) {
+	// the lease is kept alive until the lock is released, not
+	// just while ctx is
+	session, err := concurrency.NewSession(e.client,
+		concurrency.WithTTL(int(e.ttl.Seconds())),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("lock %s: etcd session: %w", name, err)
+	}
+
+	mutex := concurrency.NewMutex(session, e.key(name))
+
+	if wait {
+		err = mutex.Lock(ctx)
+	} else {
+		err = mutex.TryLock(ctx)
+		if errors.Is(err, concurrency.ErrLocked) {
+			err = ErrNotAcquired
+		}
+	}
+	if err != nil {
+		session.Close()
+		return nil, nil, fmt.Errorf("lock %s: %w", name, err)
+	}
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+
+	l := &etcdLock{
+		name:    name,
+		session: session,
+		mutex:   mutex,
+		ctx:     lockCtx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go l.watch()
+
+	return l, lockCtx, nil
+}
+
+// watch cancels the lock context if the lease expires or can't be
+// kept alive
+func (l *etcdLock) watch() {
+	defer close(l.done)
+
+	select {
+	case <-l.ctx.Done():
+	case <-l.session.Done():
+		logger.Setup().Error("lost etcd lock", "name", l.name, "lease", l.session.Lease())
+		l.cancel(fmt.Errorf("%w: %s: etcd lease expired", ErrLost, l.name))
+	}
+}
+
+// Err implements Lock
+func (l *etcdLock) Err() error {
+	if err := context.Cause(l.ctx); errors.Is(err, ErrLost) {
+		return err
+	}
+	return nil
+}
+
+// Release implements Lock, it deletes the lock key and revokes the
+// lease so a standby can take over right away
+func (l *etcdLock) Release() error {
+	var err error
+
+	l.once.Do(func() {
+		l.cancel(context.Canceled)
+		<-l.done
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if l.Err() == nil {
+			if uerr := l.mutex.Unlock(ctx); uerr != nil {
+				err = fmt.Errorf("release lock %s: %w", l.name, uerr)
+			}
+		}
+
+		// Close revokes the lease
+		if cerr := l.session.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	})
+
+	return err
+}
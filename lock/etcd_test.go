@@ -0,0 +1,128 @@
+package lock
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// freeAddr returns a local address that's free to listen on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startEtcd runs an embedded etcd server for the test and returns a
+// client for it
+func startEtcd(t *testing.T) *clientv3.Client {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+
+	clientURL := url.URL{Scheme: "http", Host: freeAddr(t)}
+	peerURL := url.URL{Scheme: "http", Host: freeAddr(t)}
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = cfg.Name + "=" + peerURL.String()
+
+	e, err := embed.StartEtcd(cfg)
+	require.NoError(t, err)
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd didn't start")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientURL.String()},
+		DialTimeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+
+	return client
+}
+
+func TestEtcdLock(t *testing.T) {
+	client := startEtcd(t)
+
+	primary := NewEtcdFromClient(client, "/archiver-test/", time.Second)
+	defer primary.Close()
+
+	standbyClient, err := clientv3.New(clientv3.Config{
+		Endpoints: client.Endpoints(),
+	})
+	require.NoError(t, err)
+	standby := NewEtcdFromClient(standbyClient, "/archiver-test/", time.Second)
+	defer standby.Close()
+
+	ctx := context.Background()
+
+	l, lockCtx, err := primary.Acquire(ctx, "archiver-log_scores")
+	require.NoError(t, err)
+
+	_, _, err = standby.Acquire(ctx, "archiver-log_scores")
+	assert.ErrorIs(t, err, ErrNotAcquired)
+
+	// another name is a different lock
+	other, _, err := standby.Acquire(ctx, "archiver-log_scores_test")
+	require.NoError(t, err)
+	require.NoError(t, other.Release())
+
+	// the standby takes over as soon as the lock is released
+	waiting := make(chan Lock)
+	go func() {
+		sl, _, err := standby.Wait(ctx, "archiver-log_scores")
+		assert.NoError(t, err)
+		waiting <- sl
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, l.Release())
+	assert.Error(t, lockCtx.Err())
+	assert.NoError(t, l.Err())
+
+	select {
+	case sl := <-waiting:
+		require.NotNil(t, sl)
+		require.NoError(t, sl.Release())
+	case <-time.After(5 * time.Second):
+		t.Fatal("standby didn't get the lock")
+	}
+}
+
+func TestEtcdLockLost(t *testing.T) {
+	client := startEtcd(t)
+
+	locker := NewEtcdFromClient(client, "/archiver-test", time.Second)
+	defer locker.Close()
+
+	l, lockCtx, err := locker.Acquire(context.Background(), "archiver-log_scores")
+	require.NoError(t, err)
+
+	// revoking the lease is what happens when it expires
+	_, err = client.Revoke(context.Background(), l.(*etcdLock).session.Lease())
+	require.NoError(t, err)
+
+	select {
+	case <-lockCtx.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("lock context wasn't cancelled")
+	}
+	assert.ErrorIs(t, l.Err(), ErrLost)
+	assert.ErrorIs(t, context.Cause(lockCtx), ErrLost)
+
+	l.Release()
+}
@@ -0,0 +1,61 @@
+// Package lock implements the lock that keeps more than one archiver
+// from working on the same table, with MySQL advisory locks or with
+// an etcd lease so standby archivers can take over quickly.
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.ntppool.org/archiver/config"
+)
+
+var (
+	// ErrNotAcquired is returned when another process has the lock
+	ErrNotAcquired = errors.New("lock is held by another process")
+
+	// ErrLost is the cause of the lock context being cancelled when
+	// the lock is gone, for example because its connection or lease
+	// was lost
+	ErrLost = errors.New("lock lost")
+)
+
+// Locker takes named locks
+type Locker interface {
+	// Acquire takes the named lock without waiting for it, or
+	// returns ErrNotAcquired. The returned context is cancelled
+	// when the lock is lost or released; work that requires the
+	// lock should use it.
+	Acquire(ctx context.Context, name string) (Lock, context.Context, error)
+
+	// Wait is like Acquire, but waits until the lock is available
+	// or ctx is cancelled
+	Wait(ctx context.Context, name string) (Lock, context.Context, error)
+
+	// Close releases the resources used by the Locker, after the
+	// locks have been released
+	Close() error
+}
+
+// Lock is a lock taken by a Locker
+type Lock interface {
+	// Err returns why the lock was lost, or nil if it's held or
+	// was released
+	Err() error
+
+	// Release releases the lock. It's safe to call more than once.
+	Release() error
+}
+
+// New returns the Locker for the configured lock backend
+func New(cfg *config.Config) (Locker, error) {
+	switch cfg.Lock.Backend {
+	case "", "mysql":
+		return MySQL{}, nil
+	case "etcd":
+		return NewEtcd(cfg.Lock.EtcdEndpoints, cfg.Lock.EtcdPrefix, cfg.Lock.TTL)
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q", cfg.Lock.Backend)
+	}
+}
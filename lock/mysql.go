@@ -0,0 +1,176 @@
+package lock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/common/logger"
+)
+
+// heartbeatInterval is how often the lock connection is checked
+var heartbeatInterval = 30 * time.Second
+
+// lockWait is how long GET_LOCK waits for the lock at a time
+const lockWait = 5
+
+// MySQL is a Locker using MySQL advisory locks (GET_LOCK). The lock
+// belongs to the database session, so it's taken on a dedicated
+// connection that isn't used for anything else and isn't recycled by
+// the connection pool while the lock is held.
+type MySQL struct{}
+
+// mysqlLock is an advisory lock held on a dedicated database connection
+type mysqlLock struct {
+	name   string
+	conn   *sql.Conn
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Acquire implements Locker
+func (MySQL) Acquire(ctx context.Context, name string) (Lock, context.Context, error) {
+	return mysqlAcquire(ctx, name, false)
+}
+
+// Wait implements Locker
+func (MySQL) Wait(ctx context.Context, name string) (Lock, context.Context, error) {
+	return mysqlAcquire(ctx, name, true)
+}
+
+// Close implements Locker, the connections are closed with each lock
+func (MySQL) Close() error {
+	return nil
+}
+
+func mysqlAcquire(ctx context.Context, name string, wait bool) (Lock, context.Context, error) {
+	conn, err := db.Pool.Conn(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("lock connection: %w", err)
+	}
+
+	timeout := 0
+	if wait {
+		timeout = lockWait
+	}
+
+	for {
+		var got sql.NullInt64
+		err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, name, timeout).Scan(&got)
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("lock %s: %w", name, err)
+		}
+		if got.Int64 == 1 {
+			break
+		}
+		if !wait {
+			conn.Close()
+			return nil, nil, fmt.Errorf("lock %s: %w", name, ErrNotAcquired)
+		}
+	}
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+
+	l := &mysqlLock{
+		name:   name,
+		conn:   conn,
+		ctx:    lockCtx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go l.heartbeat()
+
+	return l, lockCtx, nil
+}
+
+// heartbeat checks that the connection still holds the lock until
+// the lock is released, and cancels the lock context if it doesn't
+func (l *mysqlLock) heartbeat() {
+	log := logger.Setup()
+
+	defer close(l.done)
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(l.ctx, heartbeatInterval)
+		held, err := l.held(ctx)
+		cancel()
+		if l.ctx.Err() != nil {
+			return
+		}
+		if err == nil && !held {
+			err = fmt.Errorf("lock is no longer held by this connection")
+		}
+		if err != nil {
+			log.Error("lost advisory lock", "name", l.name, "err", err)
+			l.cancel(fmt.Errorf("%w: %s: %s", ErrLost, l.name, err))
+			return
+		}
+	}
+}
+
+// held returns true if the lock connection holds the lock
+func (l *mysqlLock) held(ctx context.Context) (bool, error) {
+	var held sql.NullBool
+	err := l.conn.QueryRowContext(ctx,
+		`SELECT IS_USED_LOCK(?) = CONNECTION_ID()`, l.name,
+	).Scan(&held)
+	if err != nil {
+		return false, err
+	}
+	return held.Valid && held.Bool, nil
+}
+
+// Err implements Lock
+func (l *mysqlLock) Err() error {
+	if err := context.Cause(l.ctx); errors.Is(err, ErrLost) {
+		return err
+	}
+	return nil
+}
+
+// Release implements Lock, it releases the lock and returns the
+// connection to the pool
+func (l *mysqlLock) Release() error {
+	var err error
+
+	l.once.Do(func() {
+		l.cancel(context.Canceled)
+		<-l.done
+
+		// a lost lock can't be released, just close the connection
+		if l.Err() == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, err = l.conn.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, l.name)
+			if err != nil {
+				err = fmt.Errorf("release lock %s: %w", l.name, err)
+			}
+		}
+
+		if cerr := l.conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,132 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/db/dbtest"
+)
+
+func expectGetLock(mock sqlmock.Sqlmock, result any) {
+	mock.ExpectQuery("SELECT GET_LOCK\\(\\?, \\?\\)").WithArgs("archiver-log_scores", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(result))
+}
+
+func TestAcquireRelease(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	expectGetLock(mock, 1)
+	mock.ExpectExec("SELECT RELEASE_LOCK\\(\\?\\)").WithArgs("archiver-log_scores").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	l, ctx, err := MySQL{}.Acquire(context.Background(), "archiver-log_scores")
+	require.NoError(t, err)
+	assert.NoError(t, ctx.Err())
+
+	require.NoError(t, l.Release())
+	assert.Error(t, ctx.Err())
+	assert.NoError(t, l.Err())
+
+	// releasing again doesn't do anything
+	require.NoError(t, l.Release())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAcquireNotAcquired(t *testing.T) {
+	for _, result := range []any{0, nil} {
+		mock := dbtest.MockPool(t)
+
+		expectGetLock(mock, result)
+
+		_, _, err := MySQL{}.Acquire(context.Background(), "archiver-log_scores")
+		assert.ErrorIs(t, err, ErrNotAcquired)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	}
+}
+
+func TestLockHeartbeat(t *testing.T) {
+	defer func(d time.Duration) { heartbeatInterval = d }(heartbeatInterval)
+	heartbeatInterval = 10 * time.Millisecond
+
+	t.Run("held", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		mock.MatchExpectationsInOrder(false)
+
+		expectGetLock(mock, 1)
+		for range 100 {
+			mock.ExpectQuery("SELECT IS_USED_LOCK\\(\\?\\) = CONNECTION_ID\\(\\)").
+				WithArgs("archiver-log_scores").
+				WillReturnRows(sqlmock.NewRows([]string{"held"}).AddRow(1))
+		}
+		mock.ExpectExec("SELECT RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		l, ctx, err := MySQL{}.Acquire(context.Background(), "archiver-log_scores")
+		require.NoError(t, err)
+
+		// a few heartbeats
+		time.Sleep(5 * heartbeatInterval)
+		assert.NoError(t, ctx.Err())
+
+		require.NoError(t, l.Release())
+		assert.NoError(t, l.Err())
+	})
+
+	t.Run("connection lost", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+
+		expectGetLock(mock, 1)
+		mock.ExpectQuery("SELECT IS_USED_LOCK").WillReturnError(errors.New("invalid connection"))
+
+		l, ctx, err := MySQL{}.Acquire(context.Background(), "archiver-log_scores")
+		require.NoError(t, err)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("lock context wasn't cancelled")
+		}
+		assert.ErrorIs(t, context.Cause(ctx), ErrLost)
+		assert.ErrorIs(t, l.Err(), ErrLost)
+
+		// a lost lock is only closed, not released
+		require.NoError(t, l.Release())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("lock taken over", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+
+		expectGetLock(mock, 1)
+		mock.ExpectQuery("SELECT IS_USED_LOCK").
+			WillReturnRows(sqlmock.NewRows([]string{"held"}).AddRow(nil))
+
+		l, ctx, err := MySQL{}.Acquire(context.Background(), "archiver-log_scores")
+		require.NoError(t, err)
+
+		<-ctx.Done()
+		assert.ErrorContains(t, l.Err(), "no longer held")
+		require.NoError(t, l.Release())
+	})
+}
+
+func TestMySQLWait(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	// another process has the lock at first
+	mock.ExpectQuery("SELECT GET_LOCK").WithArgs("archiver-log_scores", lockWait).
+		WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(0))
+	mock.ExpectQuery("SELECT GET_LOCK").WithArgs("archiver-log_scores", lockWait).
+		WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+	mock.ExpectExec("SELECT RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	l, _, err := MySQL{}.Wait(context.Background(), "archiver-log_scores")
+	require.NoError(t, err)
+	require.NoError(t, l.Release())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,127 @@
+// Package server implements the HTTP status API used for
+// monitoring the archivers.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.ntppool.org/common/logger"
+
+	"go.ntppool.org/archiver/source"
+)
+
+// StatusProvider returns the current archiver status
+type StatusProvider interface {
+	Lag(ctx context.Context) (*source.LagReport, error)
+}
+
+// Server serves the status API
+type Server struct {
+	status StatusProvider
+	ping   func(context.Context) error
+}
+
+// New returns a Server reporting the status from the provider. The
+// ping function is used for the health check.
+func New(status StatusProvider, ping func(context.Context) error) *Server {
+	return &Server{status: status, ping: ping}
+}
+
+// Handler returns the http.Handler for the status API
+func (srv *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", srv.statusHandler)
+	mux.HandleFunc("GET /status/{archiver}", srv.archiverHandler)
+	mux.HandleFunc("GET /healthz", srv.healthHandler)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	return mux
+}
+
+// ListenAndServe runs the status API on addr until the context is done
+func (srv *Server) ListenAndServe(ctx context.Context, addr string) error {
+	log := logger.Setup()
+
+	hs := &http.Server{
+		Addr:              addr,
+		Handler:           srv.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Info("starting status API", "addr", addr)
+		errCh <- hs.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	err := hs.Shutdown(shutdownCtx)
+	if err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (srv *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := srv.status.Lag(r.Context())
+	if err != nil {
+		srv.error(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (srv *Server) archiverHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("archiver")
+
+	report, err := srv.status.Lag(r.Context())
+	if err != nil {
+		srv.error(w, r, err)
+		return
+	}
+
+	for _, a := range report.Archivers {
+		if a.Archiver == name {
+			writeJSON(w, http.StatusOK, a)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown archiver"})
+}
+
+func (srv *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if err := srv.ping(r.Context()); err != nil {
+		srv.error(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (srv *Server) error(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Setup().Error("status api", "path", r.URL.Path, "err", err)
+	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
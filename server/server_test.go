@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/source"
+)
+
+type mockStatus struct {
+	report *source.LagReport
+	err    error
+}
+
+func (m *mockStatus) Lag(ctx context.Context) (*source.LagReport, error) {
+	return m.report, m.err
+}
+
+func testReport() *source.LagReport {
+	lastID := int64(900)
+	rowLag := int64(100)
+	timeLag := int64(60)
+
+	return &source.LagReport{
+		Table: "log_scores",
+		MaxID: 1000,
+		Time:  time.Unix(1640995200, 0),
+		Archivers: []source.ArchiverLag{
+			{
+				Archiver:   "clickhouse",
+				LogScoreID: &lastID,
+				ModifiedOn: time.Unix(1640995100, 0),
+				RowLag:     &rowLag,
+				TimeLag:    &timeLag,
+				Batch: &source.BatchSize{
+					MinSize:  50,
+					MaxSize:  500000,
+					Interval: "0s",
+					Override: true,
+				},
+			},
+			{
+				Archiver:   "cleanup",
+				ModifiedOn: time.Unix(1640995000, 0),
+			},
+		},
+	}
+}
+
+func TestStatus(t *testing.T) {
+	srv := New(&mockStatus{report: testReport()}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var report source.LagReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, "log_scores", report.Table)
+	assert.Equal(t, int64(1000), report.MaxID)
+	require.Len(t, report.Archivers, 2)
+	assert.Equal(t, int64(100), *report.Archivers[0].RowLag)
+	assert.Equal(t, int64(60), *report.Archivers[0].TimeLag)
+	require.NotNil(t, report.Archivers[0].Batch)
+	assert.True(t, report.Archivers[0].Batch.Override)
+	assert.Nil(t, report.Archivers[1].Batch)
+	assert.Nil(t, report.Archivers[1].LogScoreID)
+	assert.Nil(t, report.Archivers[1].RowLag)
+}
+
+func TestStatusArchiver(t *testing.T) {
+	srv := New(&mockStatus{report: testReport()}, nil)
+
+	t.Run("known archiver", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/status/clickhouse", nil)
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var al source.ArchiverLag
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &al))
+		assert.Equal(t, "clickhouse", al.Archiver)
+		assert.Equal(t, int64(900), *al.LogScoreID)
+	})
+
+	t.Run("unknown archiver", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/status/influxdb", nil)
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestStatusError(t *testing.T) {
+	srv := New(&mockStatus{err: errors.New("connection refused")}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), "connection refused")
+}
+
+func TestHealth(t *testing.T) {
+	t.Run("healthy", func(t *testing.T) {
+		srv := New(&mockStatus{}, func(context.Context) error { return nil })
+
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("database down", func(t *testing.T) {
+		srv := New(&mockStatus{}, func(context.Context) error { return errors.New("ping failed") })
+
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	})
+}
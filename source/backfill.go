@@ -0,0 +1,203 @@
+package source
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"go.ntppool.org/archiver/logscore"
+	"go.ntppool.org/archiver/storage"
+	"go.ntppool.org/common/logger"
+)
+
+// backfillBatchSize is used when the archiver doesn't have a maximum
+// batch size
+var backfillBatchSize = 500000
+
+// Backfill copies the log scores in the archive files of one archiver
+// to another, to seed a new archiver with the history that has been
+// deleted from the database.
+type Backfill struct {
+	From   storage.Reader
+	To     storage.Archiver
+	Filter storage.Filter
+
+	// Checkpoint is the file where the progress is recorded; a
+	// backfill with the same checkpoint file continues where the last
+	// one stopped.
+	Checkpoint string
+}
+
+// BackfillResult counts the files and rows processed by a backfill
+type BackfillResult struct {
+	Files   int
+	Skipped int
+	Stored  int64
+	LastID  int64
+}
+
+// BackfillCheckpoint records how far a file has been backfilled
+type BackfillCheckpoint struct {
+	File   string `json:"file"`
+	LastID int64  `json:"last_id"`
+	Count  int64  `json:"count"`
+	Done   bool   `json:"done"`
+}
+
+// Run copies the log scores selected by the filter, a batch at a time.
+// After each batch is stored the checkpoint is updated, so if the
+// backfill is interrupted at most the batch in progress is stored
+// again.
+func (b *Backfill) Run(ctx context.Context) (BackfillResult, error) {
+	log := logger.Setup()
+
+	result := BackfillResult{}
+
+	checkpoints, err := ReadBackfillCheckpoints(b.Checkpoint)
+	if err != nil {
+		return result, err
+	}
+
+	files, err := b.From.Files(ctx)
+	if err != nil {
+		return result, fmt.Errorf("archive files: %w", err)
+	}
+	files = storage.SelectFiles(files, b.Filter)
+
+	_, maxSize, _ := b.To.BatchSizeMinMaxTime()
+	if maxSize <= 0 {
+		maxSize = backfillBatchSize
+	}
+
+	for _, file := range files {
+		cp := checkpoints[file]
+		cp.File = file
+		if cp.LastID > result.LastID {
+			result.LastID = cp.LastID
+		}
+		if cp.Done {
+			result.Skipped++
+			continue
+		}
+
+		log.Info("backfilling", "file", file, "after_id", cp.LastID)
+
+		var current batch
+
+		flush := func() error {
+			bt := current
+			current = nil
+			if bt == nil || bt.size() == 0 {
+				return nil
+			}
+			n, err := bt.store()
+			if err != nil {
+				return err
+			}
+			cp.LastID = bt.lastID()
+			cp.Count += int64(n)
+			result.Stored += int64(n)
+			result.LastID = max(result.LastID, cp.LastID)
+			return b.checkpoint(cp)
+		}
+
+		err := b.From.ReadFile(ctx, file, func(ls *logscore.LogScore) error {
+			if ls.ID <= cp.LastID || !b.Filter.Match(ls) {
+				return nil
+			}
+			if current == nil {
+				current = newBatch(ctx, b.To, 0)
+			}
+			current.add(ls)
+			if current.size() >= maxSize {
+				return flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			if current != nil {
+				current.abort()
+			}
+			return result, fmt.Errorf("backfill %s: %w", file, err)
+		}
+		if err := flush(); err != nil {
+			return result, fmt.Errorf("backfill %s: %w", file, err)
+		}
+
+		cp.Done = true
+		if err := b.checkpoint(cp); err != nil {
+			return result, err
+		}
+		result.Files++
+
+		log.Info("backfilled file", "file", file, "count", cp.Count, "last_id", cp.LastID)
+	}
+
+	return result, nil
+}
+
+// checkpoint records the progress for a file
+func (b *Backfill) checkpoint(cp BackfillCheckpoint) error {
+	if len(b.Checkpoint) == 0 {
+		return nil
+	}
+
+	js, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.OpenFile(b.Checkpoint, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return fmt.Errorf("open checkpoint: %s", err)
+	}
+	if _, err := fh.Write(append(js, '\n')); err != nil {
+		fh.Close()
+		return fmt.Errorf("write checkpoint: %s", err)
+	}
+	return fh.Close()
+}
+
+// ReadBackfillCheckpoints returns the progress recorded in the
+// checkpoint file for each archive file; the last line for a file is
+// the current one. A missing file has no progress.
+func ReadBackfillCheckpoints(name string) (map[string]BackfillCheckpoint, error) {
+	checkpoints := map[string]BackfillCheckpoint{}
+
+	if len(name) == 0 {
+		return checkpoints, nil
+	}
+
+	fh, err := os.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return checkpoints, nil
+		}
+		return nil, fmt.Errorf("open checkpoint: %s", err)
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var cp BackfillCheckpoint
+		if err := json.Unmarshal(scanner.Bytes(), &cp); err != nil {
+			return nil, fmt.Errorf("checkpoint %s: %s", name, err)
+		}
+		checkpoints[cp.File] = cp
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read checkpoint: %s", err)
+	}
+
+	return checkpoints, nil
+}
@@ -0,0 +1,109 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/storage"
+)
+
+func TestBackfill(t *testing.T) {
+	checkpoint := filepath.Join(t.TempDir(), "backfill.jsonl")
+
+	// 3 files with ids 1-4, 5-8 and 9-12
+	reader := newFakeReader(3, 20, 21, 22, 23)
+	to := &fakeStreamArchiver{fakeArchiver{minSize: 1, maxSize: 3}}
+
+	b := &Backfill{From: reader, To: to, Checkpoint: checkpoint}
+
+	result, err := b.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, BackfillResult{Files: 3, Stored: 12, LastID: 12}, result)
+	assert.Equal(t, [][]int64{{1, 2, 3}, {4}, {5, 6, 7}, {8}, {9, 10, 11}, {12}}, to.stored)
+
+	checkpoints, err := ReadBackfillCheckpoints(checkpoint)
+	require.NoError(t, err)
+	assert.Len(t, checkpoints, 3)
+	for _, cp := range checkpoints {
+		assert.True(t, cp.Done, cp.File)
+		assert.Equal(t, int64(4), cp.Count, cp.File)
+	}
+
+	// running again doesn't store anything
+	to.stored = nil
+	result, err = b.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, BackfillResult{Skipped: 3, LastID: 12}, result)
+	assert.Nil(t, to.stored)
+}
+
+func TestBackfillResume(t *testing.T) {
+	checkpoint := filepath.Join(t.TempDir(), "backfill.jsonl")
+
+	reader := newFakeReader(3, 20, 21, 22, 23)
+	files := storage.SelectFiles(mapKeys(reader.files), storage.Filter{})
+
+	// the first file is done and the second was interrupted
+	b := &Backfill{Checkpoint: checkpoint}
+	require.NoError(t, b.checkpoint(BackfillCheckpoint{File: files[0], LastID: 3, Count: 3}))
+	require.NoError(t, b.checkpoint(BackfillCheckpoint{File: files[0], LastID: 4, Count: 4, Done: true}))
+	require.NoError(t, b.checkpoint(BackfillCheckpoint{File: files[1], LastID: 6, Count: 2}))
+
+	to := &fakeArchiver{minSize: 1, maxSize: 10}
+	b = &Backfill{From: reader, To: to, Checkpoint: checkpoint}
+
+	result, err := b.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, BackfillResult{Files: 2, Skipped: 1, Stored: 6, LastID: 12}, result)
+	assert.Equal(t, [][]int64{{7, 8}, {9, 10, 11, 12}}, to.stored)
+	assert.Equal(t, []string{files[1], files[2]}, reader.read)
+
+	checkpoints, err := ReadBackfillCheckpoints(checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillCheckpoint{File: files[1], LastID: 8, Count: 4, Done: true}, checkpoints[files[1]])
+}
+
+func TestBackfillFilter(t *testing.T) {
+	reader := newFakeReader(10, 20, 21)
+	to := &fakeArchiver{minSize: 1, maxSize: 100}
+
+	b := &Backfill{From: reader, To: to, Filter: storage.Filter{
+		Since:    time.Date(2022, 1, 5, 0, 0, 0, 0, time.UTC),
+		BeforeID: 14,
+	}}
+
+	result, err := b.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), result.Stored)
+	assert.Equal(t, [][]int64{{9, 10}, {11, 12}, {13}}, to.stored)
+}
+
+func TestBackfillStoreError(t *testing.T) {
+	checkpoint := filepath.Join(t.TempDir(), "backfill.jsonl")
+
+	reader := newFakeReader(2, 20, 21)
+	to := &fakeArchiver{minSize: 1, maxSize: 10, storeErr: errors.New("storage is down")}
+
+	b := &Backfill{From: reader, To: to, Checkpoint: checkpoint}
+	_, err := b.Run(context.Background())
+	assert.ErrorContains(t, err, "storage is down")
+
+	// nothing was recorded
+	_, err = os.Stat(checkpoint)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
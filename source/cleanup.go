@@ -2,9 +2,11 @@ package source
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"time"
 
+	"go.ntppool.org/archiver/config"
 	"go.ntppool.org/archiver/db"
 	"go.ntppool.org/archiver/storage"
 	"go.ntppool.org/common/logger"
@@ -15,21 +17,118 @@ type Cleaner interface {
 	Run(context.Context, *Source, storage.ArchiveStatus) error
 }
 
+// Cleanup deletes rows that have been archived by all archivers and
+// are older than the retention period from the source table.
 type Cleanup struct {
 	RetentionDays int
-	interval      time.Duration
+
+	// DefaultInterval is the time between cleanup runs
+	DefaultInterval time.Duration
+
+	// ReducedInterval is used instead after a run deleted a full
+	// batch, so a backlog is cleaned up faster
+	ReducedInterval time.Duration
+
+	// BatchSize is the maximum number of rows deleted per run
+	BatchSize int
+
+	// ChunkSize is the number of rows deleted per statement
+	ChunkSize int
+
+	// TimeBudget is how long a run can keep deleting chunks
+	TimeBudget time.Duration
+
+	// MaxReplicaLag pauses the cleanup while the replicas are
+	// further behind; 0 disables the check
+	MaxReplicaLag time.Duration
+
+	// LagQuery returns the replica lag in seconds, instead of
+	// SHOW REPLICA STATUS
+	LagQuery string
+
+	// LagPause is how long to wait before checking the lag again
+	LagPause time.Duration
+
+	// Verify makes the cleanup check with the archivers that they
+	// have the rows before deleting them
+	Verify bool
 }
 
 var (
 	defaultInterval  = 4 * time.Minute
+	reducedInterval  = 1 * time.Minute
 	cleanupBatchSize = 200000
+	cleanupChunkSize = 10000
+	cleanupBudget    = 1 * time.Minute
+	cleanupLagPause  = 5 * time.Second
 )
 
+// NewCleanup returns a Cleanup with the settings from the configuration,
+// or the defaults if cfg is nil
+func NewCleanup(retentionDays int, cfg *config.Config) *Cleanup {
+	c := &Cleanup{RetentionDays: retentionDays}
+	if cfg != nil {
+		c.DefaultInterval = cfg.Cleanup.DefaultInterval
+		c.ReducedInterval = cfg.Cleanup.ReducedInterval
+		c.BatchSize = cfg.Cleanup.BatchSize
+		c.Verify = cfg.Cleanup.Verify
+		c.ChunkSize = cfg.Cleanup.ChunkSize
+		c.TimeBudget = cfg.Cleanup.TimeBudget
+		c.MaxReplicaLag = cfg.Cleanup.MaxReplicaLag
+		c.LagQuery = cfg.Cleanup.LagQuery
+		c.LagPause = cfg.Cleanup.LagPause
+	}
+	return c
+}
+
 func (c *Cleanup) Interval() time.Duration {
-	if c.interval == 0 {
+	if c.DefaultInterval == 0 {
 		return defaultInterval
 	}
-	return c.interval
+	return c.DefaultInterval
+}
+
+func (c *Cleanup) reducedInterval() time.Duration {
+	if c.ReducedInterval == 0 {
+		return reducedInterval
+	}
+	return c.ReducedInterval
+}
+
+func (c *Cleanup) retentionDays() int {
+	if c.RetentionDays < 1 {
+		logger.Setup().Warn("retention days set too low, resetting to 1", "setting", c.RetentionDays)
+		return 1
+	}
+	return c.RetentionDays
+}
+
+func (c *Cleanup) batchSize() int {
+	if c.BatchSize <= 0 {
+		return cleanupBatchSize
+	}
+	return c.BatchSize
+}
+
+func (c *Cleanup) chunkSize() int {
+	if c.ChunkSize <= 0 {
+		return cleanupChunkSize
+	}
+	return c.ChunkSize
+}
+
+func (c *Cleanup) timeBudget() time.Duration {
+	if c.TimeBudget <= 0 {
+		return cleanupBudget
+	}
+	return c.TimeBudget
+}
+
+func (c *Cleanup) lagPause() time.Duration {
+	if c.LagPause <= 0 {
+		return cleanupLagPause
+	}
+	return c.LagPause
 }
 
 func (c *Cleanup) Run(ctx context.Context, source *Source, status storage.ArchiveStatus) error {
@@ -42,42 +141,137 @@ func (c *Cleanup) Run(ctx context.Context, source *Source, status storage.Archiv
 
 	log.Info("running cleaner")
 
-	maxDays := c.RetentionDays
-	if maxDays < 1 {
-		log.Warn("retention days set too low, resetting to 1", "setting", maxDays)
-		maxDays = 1
-	}
-
-	r, err := db.Pool.Exec(ctx,
-		`delete
-		from log_scores
-		where
-		  ts < date_sub(now(), interval ? day)
-		  and id < (select min(log_score_id) from log_scores_archive_status)
-		order by id
-		limit ?`,
-		maxDays, cleanupBatchSize,
-	)
+	batchSize := c.batchSize()
+
+	rowCount, stopped, err := c.clean(ctx, source, batchSize, c.timeBudget())
 	if err != nil {
-		return fmt.Errorf("cleanup error: %s", err)
+		return err
 	}
-
-	rowCount, err := r.RowsAffected()
 	log.Info("cleaned rows", "count", rowCount)
+
+	// After a full batch (or when the time ran out) there's probably
+	// more to clean up, so record the run as if it happened earlier,
+	// making the next run due after the reduced interval.
+	if (rowCount == int64(batchSize) || stopped) && c.reducedInterval() < interval {
+		log.Info("cleaned a full batch, running again sooner", "next", c.reducedInterval())
+		err = status.SetStatusBackdated(context.WithoutCancel(ctx), 0, interval-c.reducedInterval())
+	} else {
+		err = status.SetStatus(context.WithoutCancel(ctx), 0)
+	}
 	if err != nil {
-		return fmt.Errorf("could not get row count: %s", err)
+		return fmt.Errorf("could not update archiver status for %q : %s", status.Archiver, err)
 	}
 
-	// todo: this doesn't do anything because state isn't
-	// kept from run to run, so the interval is always reset
-	if rowCount == int64(cleanupBatchSize) {
-		c.interval = 1 * time.Minute
+	return nil
+}
+
+// deleteChunk removes up to limit rows older than maxDays that all
+// archivers for the table have stored. With a verified range only
+// rows in that range are deleted.
+func (c *Cleanup) deleteChunk(ctx context.Context, source *Source, maxDays, limit int, verified *CleanupPlan) (int64, error) {
+	var r sql.Result
+	var err error
+
+	if verified != nil {
+		r, err = db.Pool.Exec(ctx,
+			fmt.Sprintf(`delete
+			from %s
+			where
+			  id between ? and ?
+			  and ts < date_sub(now(), interval ? day)
+			order by id
+			limit ?`, source.Table),
+			verified.FirstID, verified.LastID, maxDays, limit,
+		)
+	} else {
+		// only the archivers for this table count
+		scope, scopeArgs, serr := storage.StatusScope(ctx, source.Table)
+		if serr != nil {
+			return 0, fmt.Errorf("cleanup error: %s", serr)
+		}
+
+		args := append([]any{maxDays}, scopeArgs...)
+		args = append(args, limit)
+
+		r, err = db.Pool.Exec(ctx,
+			fmt.Sprintf(`delete
+			from %s
+			where
+			  ts < date_sub(now(), interval ? day)
+			  and id < (select min(log_score_id) from log_scores_archive_status%s)
+			order by id
+			limit ?`, source.Table, scope),
+			args...,
+		)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cleanup error: %s", err)
 	}
 
-	err = status.SetStatus(ctx, 0)
+	rowCount, err := r.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("could not update archiver status for %q : %s", status.Archiver, err)
+		return 0, fmt.Errorf("could not get row count: %s", err)
 	}
 
-	return nil
+	return rowCount, nil
+}
+
+// CleanupPlan describes the rows a cleanup deletes from a table
+type CleanupPlan struct {
+	Table   string
+	Count   int64        `db:"count"`
+	FirstID int64        `db:"first_id"`
+	LastID  int64        `db:"last_id"`
+	FirstTs sql.NullTime `db:"first_ts"`
+	LastTs  sql.NullTime `db:"last_ts"`
+}
+
+// deleteRange returns the rows the cleanup would delete, up to batchSize
+func (c *Cleanup) deleteRange(ctx context.Context, source *Source, maxDays, batchSize int) (CleanupPlan, error) {
+	r := CleanupPlan{Table: source.Table}
+
+	scope, scopeArgs, err := storage.StatusScope(ctx, source.Table)
+	if err != nil {
+		return r, err
+	}
+
+	args := append([]any{maxDays}, scopeArgs...)
+	args = append(args, batchSize)
+
+	err = db.Pool.Get(ctx, &r,
+		fmt.Sprintf(`select count(*) as count,
+		  coalesce(min(id), 0) as first_id, coalesce(max(id), 0) as last_id,
+		  min(ts) as first_ts, max(ts) as last_ts
+		from (
+		  select id, ts from %s
+		  where
+		    ts < date_sub(now(), interval ? day)
+		    and id < (select min(log_score_id) from log_scores_archive_status%s)
+		  order by id
+		  limit ?
+		) c`, source.Table, scope),
+		args...,
+	)
+	return r, err
+}
+
+// Plan returns what the cleanup would delete from the source table
+// without deleting anything. With maxRows 0 it's what a single run
+// deletes, otherwise up to maxRows rows.
+func (c *Cleanup) Plan(ctx context.Context, source *Source, maxRows int) (CleanupPlan, error) {
+	if maxRows <= 0 {
+		maxRows = c.batchSize()
+	}
+	return c.deleteRange(ctx, source, c.retentionDays(), maxRows)
+}
+
+// Clean deletes up to maxRows rows from the source table without
+// checking the interval or updating the cleanup status. Like the
+// scheduled cleanup it deletes in chunks and waits for the replicas
+// to catch up, but without a time limit. It returns the number of
+// rows deleted, which can be less than maxRows if there are no more
+// rows to delete.
+func (c *Cleanup) Clean(ctx context.Context, source *Source, maxRows int) (int64, error) {
+	deleted, _, err := c.clean(ctx, source, maxRows, 0)
+	return deleted, err
 }
@@ -0,0 +1,172 @@
+package source
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/db/dbtest"
+	"go.ntppool.org/archiver/storage"
+)
+
+func TestNewCleanup(t *testing.T) {
+	c := NewCleanup(14, nil)
+	assert.Equal(t, defaultInterval, c.Interval())
+	assert.Equal(t, cleanupBatchSize, c.batchSize())
+
+	c = NewCleanup(14, &config.Config{Cleanup: config.Cleanup{
+		DefaultInterval: 10 * time.Minute,
+		ReducedInterval: 2 * time.Minute,
+		BatchSize:       1000,
+		ChunkSize:       500,
+		MaxReplicaLag:   10 * time.Second,
+	}})
+	assert.Equal(t, 10*time.Minute, c.Interval())
+	assert.Equal(t, 2*time.Minute, c.reducedInterval())
+	assert.Equal(t, 1000, c.batchSize())
+	assert.Equal(t, 500, c.chunkSize())
+	assert.Equal(t, 10*time.Second, c.MaxReplicaLag)
+	assert.Equal(t, cleanupLagPause, c.lagPause())
+}
+
+func expectStatusScope(mock sqlmock.Sqlmock, scoped bool) {
+	count := 0
+	if scoped {
+		count = 1
+	}
+	mock.ExpectQuery("select count\\(\\*\\) from information_schema.columns").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func TestCleanupRun(t *testing.T) {
+	source := &Source{Table: "log_scores", retentionDays: 14}
+	status := storage.ArchiveStatus{ID: 5, Archiver: "cleanup"}
+	c := &Cleanup{
+		RetentionDays:   14,
+		DefaultInterval: 10 * time.Minute,
+		ReducedInterval: 2 * time.Minute,
+		BatchSize:       100,
+	}
+
+	t.Run("partial batch", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+
+		expectStatusScope(mock, false)
+		mock.ExpectExec("(?s)delete\\s+from log_scores\\s+where.*from log_scores_archive_status\\)").
+			WithArgs(14, 100).WillReturnResult(sqlmock.NewResult(0, 40))
+		mock.ExpectExec("update log_scores_archive_status\\s+set log_score_id=\\?, modified_on=NOW\\(\\) where id=\\?").
+			WithArgs(nil, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		err := c.Run(context.Background(), source, status)
+		require.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("full batch", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+
+		expectStatusScope(mock, false)
+		mock.ExpectExec("delete\\s+from log_scores").
+			WithArgs(14, 100).WillReturnResult(sqlmock.NewResult(0, 100))
+		// the next run is due after the reduced interval
+		mock.ExpectExec("modified_on=NOW\\(\\) - INTERVAL \\? SECOND").
+			WithArgs(nil, int64(480), 5).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		err := c.Run(context.Background(), source, status)
+		require.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("scoped to table", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+
+		source := &Source{Table: "log_scores_test", retentionDays: 2}
+		c := &Cleanup{RetentionDays: 2, BatchSize: 100}
+
+		expectStatusScope(mock, true)
+		mock.ExpectExec("(?s)delete\\s+from log_scores_test\\s+where.*where coalesce\\(table_name, \\?\\) = \\?\\)").
+			WithArgs(2, "log_scores", "log_scores_test", 100).WillReturnResult(sqlmock.NewResult(0, 10))
+		mock.ExpectExec("update log_scores_archive_status").
+			WithArgs(nil, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		err := c.Run(context.Background(), source, status)
+		require.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("too soon", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+
+		status := storage.ArchiveStatus{
+			ID:         5,
+			Archiver:   "cleanup",
+			ModifiedOn: time.Now().Add(-5 * time.Minute),
+		}
+		err := c.Run(context.Background(), source, status)
+		require.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCleanupPlan(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	source := &Source{Table: "log_scores", retentionDays: 14}
+	c := &Cleanup{RetentionDays: 14, BatchSize: 100}
+
+	first := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	last := first.Add(time.Hour)
+
+	expectStatusScope(mock, false)
+	mock.ExpectQuery("(?s)select count\\(\\*\\) as count.*min\\(ts\\) as first_ts.*from log_scores").
+		WithArgs(14, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "first_id", "last_id", "first_ts", "last_ts"}).
+			AddRow(100, 1, 120, first, last))
+
+	plan, err := c.Plan(context.Background(), source, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "log_scores", plan.Table)
+	assert.Equal(t, int64(100), plan.Count)
+	assert.Equal(t, int64(1), plan.FirstID)
+	assert.Equal(t, int64(120), plan.LastID)
+	assert.Equal(t, first, plan.FirstTs.Time)
+	assert.Equal(t, last, plan.LastTs.Time)
+
+	// with a row budget
+	expectStatusScope(mock, false)
+	mock.ExpectQuery("(?s)select count\\(\\*\\) as count.*from log_scores").
+		WithArgs(14, 5000).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "first_id", "last_id", "first_ts", "last_ts"}).
+			AddRow(0, 0, 0, nil, nil))
+
+	plan, err = c.Plan(context.Background(), source, 5000)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), plan.Count)
+	assert.False(t, plan.FirstTs.Valid)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCleanupClean(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	source := &Source{Table: "log_scores", retentionDays: 14}
+	c := &Cleanup{RetentionDays: 14, BatchSize: 1000, ChunkSize: 100}
+
+	// 250 rows in chunks of 100, the last chunk is short
+	for _, batch := range [][2]int{{100, 100}, {100, 100}, {50, 20}} {
+		expectStatusScope(mock, false)
+		mock.ExpectExec("(?s)delete\\s+from log_scores").
+			WithArgs(14, batch[0]).WillReturnResult(sqlmock.NewResult(0, int64(batch[1])))
+	}
+
+	deleted, err := c.Clean(context.Background(), source, 250)
+	require.NoError(t, err)
+	assert.Equal(t, int64(220), deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,243 @@
+package source
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/db/dbtest"
+	"go.ntppool.org/archiver/logscore"
+	"go.ntppool.org/archiver/storage"
+)
+
+type fakeArchiver struct {
+	minSize  int
+	maxSize  int
+	storeErr error
+	stored   [][]int64
+}
+
+func (f *fakeArchiver) BatchSizeMinMaxTime() (int, int, time.Duration) {
+	return f.minSize, f.maxSize, 0
+}
+
+func (f *fakeArchiver) Store(ctx context.Context, ls []*logscore.LogScore) (int, error) {
+	if f.storeErr != nil {
+		return 0, f.storeErr
+	}
+	ids := []int64{}
+	for _, l := range ls {
+		ids = append(ids, l.ID)
+	}
+	f.stored = append(f.stored, ids)
+	return len(ls), nil
+}
+
+func (f *fakeArchiver) Close() error {
+	return nil
+}
+
+func expectDescribe(mock sqlmock.Sqlmock) {
+	for range 2 {
+		mock.ExpectQuery("DESCRIBE log_scores").WillReturnRows(
+			sqlmock.NewRows([]string{"Field", "Type", "Null", "Key", "Default", "Extra"}).
+				AddRow("id", "bigint(20)", "NO", "PRI", nil, "auto_increment"),
+		)
+	}
+}
+
+func logScoreRows(ids ...int64) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{
+		"id", "monitor_id", "server_id", "UNIX_TIMESTAMP(ts)", "score", "step", "offset",
+	})
+	for _, id := range ids {
+		rows.AddRow(id, 10, 20, 1640995200+id, 19.5, 1, nil)
+	}
+	return rows
+}
+
+// testStatusIDs are the log_scores_archive_status ids for the test archivers
+var testStatusIDs = map[string]int{"a": 1, "b": 2}
+
+func testTarget(name string, lastID int64, arch storage.Archiver) *target {
+	return newTarget(storage.ArchiveStatus{
+		ID:         testStatusIDs[name],
+		Archiver:   name,
+		LogScoreID: sql.NullInt64{Int64: lastID, Valid: lastID > 0},
+	}, arch)
+}
+
+func TestFanOut(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	defer func(size int) { readBatchSize = size }(readBatchSize)
+	readBatchSize = 10
+
+	a := &fakeArchiver{minSize: 1, maxSize: 2}
+	b := &fakeArchiver{minSize: 1, maxSize: 10}
+
+	expectDescribe(mock)
+	mock.ExpectQuery(`select sum\(id > \?\),sum\(id > \?\) from log_scores where id > \?`).
+		WithArgs(int64(0), int64(2), int64(0)).
+		WillReturnRows(sqlmock.NewRows([]string{"a", "b"}).AddRow(4, 2))
+
+	// the rows are read once for both archivers
+	mock.ExpectQuery("select id,monitor_id,server_id").
+		WithArgs(int64(0), 10).
+		WillReturnRows(logScoreRows(1, 2, 3, 4))
+
+	mock.ExpectExec("update log_scores_archive_status").
+		WithArgs(int64(2), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update log_scores_archive_status").
+		WithArgs(int64(4), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update log_scores_archive_status").
+		WithArgs(int64(4), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	source := &Source{Table: "log_scores", retentionDays: 14}
+	err := source.fanOut(context.Background(), []*target{
+		testTarget("a", 0, a),
+		testTarget("b", 2, b),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, [][]int64{{1, 2}, {3, 4}}, a.stored)
+	assert.Equal(t, [][]int64{{3, 4}}, b.stored)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestFanOutTooFew(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	a := &fakeArchiver{minSize: 500, maxSize: 1000}
+
+	expectDescribe(mock)
+	mock.ExpectQuery(`select sum\(id > \?\) from log_scores where id > \?`).
+		WithArgs(int64(100), int64(100)).
+		WillReturnRows(sqlmock.NewRows([]string{"a"}).AddRow(nil))
+
+	source := &Source{Table: "log_scores", retentionDays: 14}
+	err := source.fanOut(context.Background(), []*target{testTarget("a", 100, a)})
+	require.NoError(t, err)
+
+	assert.Empty(t, a.stored)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestFanOutStoreError(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	defer func(size int) { readBatchSize = size }(readBatchSize)
+	readBatchSize = 10
+
+	a := &fakeArchiver{minSize: 1, maxSize: 10, storeErr: errors.New("disk full")}
+	b := &fakeArchiver{minSize: 1, maxSize: 10}
+
+	expectDescribe(mock)
+	mock.ExpectQuery(`select sum`).
+		WillReturnRows(sqlmock.NewRows([]string{"a", "b"}).AddRow(3, 3))
+	mock.ExpectQuery("select id,monitor_id,server_id").
+		WithArgs(int64(0), 10).
+		WillReturnRows(logScoreRows(1, 2, 3))
+	mock.ExpectExec("update log_scores_archive_status").
+		WithArgs(int64(3), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	source := &Source{Table: "log_scores", retentionDays: 14}
+	err := source.fanOut(context.Background(), []*target{
+		testTarget("a", 0, a),
+		testTarget("b", 0, b),
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error processing a: disk full")
+
+	// the other archiver still got its data
+	assert.Equal(t, [][]int64{{1, 2, 3}}, b.stored)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+type fakeStreamArchiver struct {
+	fakeArchiver
+}
+
+func (f *fakeStreamArchiver) StoreStream(ctx context.Context, ch <-chan *logscore.LogScore) (int, error) {
+	ls := []*logscore.LogScore{}
+	for l := range ch {
+		ls = append(ls, l)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return f.Store(ctx, ls)
+}
+
+func TestFanOutStream(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	defer func(size int) { readBatchSize = size }(readBatchSize)
+	readBatchSize = 2
+
+	a := &fakeStreamArchiver{fakeArchiver{minSize: 1, maxSize: 3}}
+	b := &fakeArchiver{minSize: 1, maxSize: 10}
+
+	expectDescribe(mock)
+	mock.ExpectQuery(`select sum`).
+		WillReturnRows(sqlmock.NewRows([]string{"a", "b"}).AddRow(5, 5))
+	mock.ExpectQuery("select id,monitor_id,server_id").
+		WithArgs(int64(0), 2).
+		WillReturnRows(logScoreRows(1, 2))
+	mock.ExpectQuery("select id,monitor_id,server_id").
+		WithArgs(int64(2), 2).
+		WillReturnRows(logScoreRows(3, 4))
+	mock.ExpectExec("update log_scores_archive_status").
+		WithArgs(int64(3), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("select id,monitor_id,server_id").
+		WithArgs(int64(4), 2).
+		WillReturnRows(logScoreRows(5))
+	mock.ExpectExec("update log_scores_archive_status").
+		WithArgs(int64(5), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update log_scores_archive_status").
+		WithArgs(int64(5), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	source := &Source{Table: "log_scores", retentionDays: 14}
+	err := source.fanOut(context.Background(), []*target{
+		testTarget("a", 0, a),
+		testTarget("b", 0, b),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, [][]int64{{1, 2, 3}, {4, 5}}, a.stored)
+	assert.Equal(t, [][]int64{{1, 2, 3, 4, 5}}, b.stored)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestFanOutStreamAbort(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	defer func(size int) { readBatchSize = size }(readBatchSize)
+	readBatchSize = 2
+
+	a := &fakeStreamArchiver{fakeArchiver{minSize: 1, maxSize: 10}}
+
+	expectDescribe(mock)
+	mock.ExpectQuery(`select sum`).
+		WillReturnRows(sqlmock.NewRows([]string{"a"}).AddRow(5))
+	mock.ExpectQuery("select id,monitor_id,server_id").
+		WithArgs(int64(0), 2).
+		WillReturnRows(logScoreRows(1, 2))
+	mock.ExpectQuery("select id,monitor_id,server_id").
+		WithArgs(int64(2), 2).
+		WillReturnError(sql.ErrConnDone)
+
+	source := &Source{Table: "log_scores", retentionDays: 14}
+	err := source.fanOut(context.Background(), []*target{testTarget("a", 0, a)})
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+
+	// the partial batch was discarded
+	assert.Empty(t, a.stored)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,126 @@
+package source
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/storage"
+)
+
+// ArchiverLag is the archive status of an archiver together with
+// how far it is behind the source table.
+type ArchiverLag struct {
+	Archiver   string    `json:"archiver"`
+	LogScoreID *int64    `json:"log_score_id"`
+	ModifiedOn time.Time `json:"modified_on"`
+
+	// RowLag is the difference between the newest id in the
+	// source table and the last archived id.
+	RowLag *int64 `json:"row_lag,omitempty"`
+
+	// TimeLag is the age in seconds of the oldest row that
+	// hasn't been archived yet (0 if the archiver is caught up).
+	TimeLag *int64 `json:"time_lag_seconds,omitempty"`
+
+	// Batch is the batch sizing used for the archiver
+	Batch *BatchSize `json:"batch,omitempty"`
+}
+
+// BatchSize is the batch sizing for an archiver, Override is true
+// if it's set for the archiver with batch_overrides
+type BatchSize struct {
+	MinSize  int    `json:"min_size"`
+	MaxSize  int    `json:"max_size"`
+	Interval string `json:"interval"`
+	Override bool   `json:"override"`
+}
+
+// LagReport is the status of all archivers for a source table
+type LagReport struct {
+	Table     string        `json:"table"`
+	MaxID     int64         `json:"max_id"`
+	Time      time.Time     `json:"time"`
+	Archivers []ArchiverLag `json:"archivers"`
+}
+
+// Lag returns the archive status for each archiver with the row and
+// time lag computed against the current state of the source table.
+func (source *Source) Lag(ctx context.Context) (*LagReport, error) {
+	status, err := storage.GetArchiveStatus(ctx, source.Table)
+	if err != nil {
+		return nil, fmt.Errorf("archive status: %w", err)
+	}
+
+	report := &LagReport{
+		Table:     source.Table,
+		Time:      time.Now(),
+		Archivers: []ArchiverLag{},
+	}
+
+	err = db.Pool.Get(ctx, &report.MaxID,
+		fmt.Sprintf(`select coalesce(max(id), 0) from %s`, source.Table),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("max id: %w", err)
+	}
+
+	for _, s := range status {
+		al := ArchiverLag{
+			Archiver:   s.Archiver,
+			ModifiedOn: s.ModifiedOn,
+		}
+
+		if s.LogScoreID.Valid {
+			lastID := s.LogScoreID.Int64
+			al.LogScoreID = &lastID
+
+			rowLag := max(report.MaxID-lastID, 0)
+			al.RowLag = &rowLag
+
+			timeLag, err := source.timeLag(ctx, lastID, report.Time)
+			if err != nil {
+				return nil, fmt.Errorf("time lag for %q: %w", s.Archiver, err)
+			}
+			al.TimeLag = &timeLag
+		}
+
+		if source.Config != nil {
+			if bs, override, ok := storage.BatchSize(s.Archiver, source.Config); ok {
+				al.Batch = &BatchSize{
+					MinSize:  bs.MinSize,
+					MaxSize:  bs.MaxSize,
+					Interval: bs.Interval.String(),
+					Override: override,
+				}
+			}
+		}
+
+		report.Archivers = append(report.Archivers, al)
+	}
+
+	return report, nil
+}
+
+// timeLag returns the age in seconds of the first row after lastID
+func (source *Source) timeLag(ctx context.Context, lastID int64, now time.Time) (int64, error) {
+	var ts int64
+	err := db.Pool.Get(ctx, &ts,
+		fmt.Sprintf(
+			`select UNIX_TIMESTAMP(ts) from %s where id > ? order by id limit 1`,
+			source.Table,
+		),
+		lastID,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return max(now.Unix()-ts, 0), nil
+}
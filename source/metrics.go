@@ -0,0 +1,31 @@
+package source
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var cleanupVerifyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "archiver_cleanup_verify_failures_total",
+	Help: "Cleanup runs that didn't delete rows because an archiver didn't have them",
+}, []string{"archiver"})
+
+var cleanupDeletedRows = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "archiver_cleanup_deleted_rows_total",
+	Help: "Rows deleted by the cleanup",
+}, []string{"table"})
+
+var cleanupRowsPerSecond = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "archiver_cleanup_rows_per_second",
+	Help: "Rows deleted per second in the last cleanup run",
+}, []string{"table"})
+
+var cleanupReplicaLag = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "archiver_cleanup_replica_lag_seconds",
+	Help: "Replica lag seen by the cleanup before its last delete",
+})
+
+var cleanupThrottled = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "archiver_cleanup_throttled_seconds_total",
+	Help: "Time the cleanup paused because of replica lag",
+})
@@ -0,0 +1,158 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/logscore"
+	"go.ntppool.org/archiver/storage"
+	"go.ntppool.org/common/logger"
+)
+
+// restoreBatchSize is how many rows are inserted per statement
+var restoreBatchSize = 1000
+
+// RestoreResult counts the files and rows processed by Restore
+type RestoreResult struct {
+	Files    int
+	Read     int64
+	Matched  int64
+	Inserted int64
+}
+
+// Restore reads the archive files that can have log scores selected
+// by the filter and inserts the matching rows into the table.
+// Rows that are already in the table are left alone, so a restore can
+// be run again after an error. With dryRun the matching rows are
+// only counted.
+func (source *Source) Restore(ctx context.Context, reader storage.Reader, filter storage.Filter, dryRun bool) (RestoreResult, error) {
+	log := logger.Setup()
+
+	result := RestoreResult{}
+
+	hasAttributes, err := source.checkField(ctx, "attributes")
+	if err != nil {
+		return result, err
+	}
+	hasRTT, err := source.checkField(ctx, "rtt")
+	if err != nil {
+		return result, err
+	}
+
+	files, err := reader.Files(ctx)
+	if err != nil {
+		return result, fmt.Errorf("archive files: %w", err)
+	}
+	files = storage.SelectFiles(files, filter)
+
+	batch := make([]*logscore.LogScore, 0, restoreBatchSize)
+
+	flush := func() error {
+		if len(batch) == 0 || dryRun {
+			batch = batch[:0]
+			return nil
+		}
+		n, err := source.insert(ctx, hasAttributes, hasRTT, batch)
+		if err != nil {
+			return err
+		}
+		result.Inserted += n
+		batch = batch[:0]
+		return nil
+	}
+
+	for _, file := range files {
+		log.Info("restoring", "file", file, "table", source.Table)
+
+		err := reader.ReadFile(ctx, file, func(ls *logscore.LogScore) error {
+			result.Read++
+			if !filter.Match(ls) {
+				return nil
+			}
+			result.Matched++
+			batch = append(batch, ls)
+			if len(batch) >= restoreBatchSize {
+				return flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return result, fmt.Errorf("restore %s: %w", file, err)
+		}
+		result.Files++
+	}
+
+	return result, nil
+}
+
+// insert adds the log scores to the table, skipping ids that are
+// already there. It returns the number of rows inserted.
+func (source *Source) insert(ctx context.Context, hasAttributes, hasRTT bool, logscores []*logscore.LogScore) (int64, error) {
+	fields := `id,monitor_id,server_id,ts,score,step,offset`
+	placeholders := `?,?,?,FROM_UNIXTIME(?),?,?,?`
+	if hasAttributes {
+		fields = fields + ",attributes"
+		placeholders = placeholders + ",?"
+	}
+	if hasRTT {
+		fields = fields + ",rtt"
+		placeholders = placeholders + ",?"
+	}
+
+	values := make([]string, 0, len(logscores))
+	args := []interface{}{}
+
+	for _, ls := range logscores {
+		values = append(values, "("+placeholders+")")
+
+		// monitor_id is read as 0 when it's NULL
+		var monitorID interface{}
+		if ls.MonitorID != 0 {
+			monitorID = ls.MonitorID
+		}
+		var offset interface{}
+		if ls.Offset != nil {
+			offset = *ls.Offset
+		}
+		args = append(args, ls.ID, monitorID, ls.ServerID, ls.Ts, ls.Score, ls.Step, offset)
+
+		if hasAttributes {
+			var attributes interface{}
+			if ls.Meta != (logscore.LogScoreMetadata{}) {
+				b, err := json.Marshal(ls.Meta)
+				if err != nil {
+					return 0, err
+				}
+				attributes = b
+			}
+			args = append(args, attributes)
+		}
+		if hasRTT {
+			var rtt interface{}
+			if ls.RTT != nil {
+				rtt = *ls.RTT
+			}
+			args = append(args, rtt)
+		}
+	}
+
+	r, err := db.Pool.Exec(ctx,
+		fmt.Sprintf(
+			`insert into %s (%s) values %s
+			on duplicate key update id = id`,
+			source.Table, fields, strings.Join(values, ","),
+		),
+		args...,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert: %s", err)
+	}
+
+	return r.RowsAffected()
+}
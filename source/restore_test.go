@@ -0,0 +1,168 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/db/dbtest"
+	"go.ntppool.org/archiver/logscore"
+	"go.ntppool.org/archiver/storage"
+)
+
+// fakeReader has the log scores for each file in memory
+type fakeReader struct {
+	files map[string][]*logscore.LogScore
+	read  []string
+}
+
+func (f *fakeReader) Files(ctx context.Context) ([]string, error) {
+	names := []string{}
+	for name := range f.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (f *fakeReader) ReadFile(ctx context.Context, name string, fn func(*logscore.LogScore) error) error {
+	f.read = append(f.read, name)
+	for _, ls := range f.files[name] {
+		if err := fn(ls); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newFakeReader returns a reader with a file per day from 2022-01-01,
+// each with a row per server from the id
+func newFakeReader(days int, servers ...int64) *fakeReader {
+	f := &fakeReader{files: map[string][]*logscore.LogScore{}}
+	id := int64(1)
+	for d := 0; d < days; d++ {
+		ts := time.Date(2022, 1, 1+d, 0, 0, 0, 0, time.UTC).Unix()
+		name := fmt.Sprintf("2022/%d-%d.avro", ts, id)
+		for _, sid := range servers {
+			f.files[name] = append(f.files[name], &logscore.LogScore{
+				ID: id, ServerID: sid, MonitorID: 10, Ts: ts + 60, Score: 19.5, Step: 1,
+			})
+			id++
+		}
+	}
+	return f
+}
+
+func expectRestoreDescribe(mock sqlmock.Sqlmock, table string) {
+	for range 2 {
+		mock.ExpectQuery("DESCRIBE " + table).WillReturnRows(
+			sqlmock.NewRows([]string{"Field", "Type", "Null", "Key", "Default", "Extra"}).
+				AddRow("id", "bigint(20)", "NO", "PRI", nil, "auto_increment").
+				AddRow("attributes", "json", "YES", "", nil, "").
+				AddRow("rtt", "mediumint(8)", "YES", "", nil, ""),
+		)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	source := &Source{Table: "log_scores_archive"}
+	filter := storage.Filter{
+		ServerID: 20,
+		Since:    time.Date(2022, 1, 3, 0, 0, 0, 0, time.UTC),
+		Until:    time.Date(2022, 1, 5, 0, 0, 0, 0, time.UTC),
+	}
+
+	t.Run("insert", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		reader := newFakeReader(10, 20, 21)
+
+		jan3 := time.Date(2022, 1, 3, 0, 1, 0, 0, time.UTC).Unix()
+		jan4 := time.Date(2022, 1, 4, 0, 1, 0, 0, time.UTC).Unix()
+
+		expectRestoreDescribe(mock, "log_scores_archive")
+		mock.ExpectExec("(?s)insert into log_scores_archive \\(id,monitor_id,server_id,ts,score,step,offset,attributes,rtt\\) values \\(\\?,\\?,\\?,FROM_UNIXTIME\\(\\?\\),\\?,\\?,\\?,\\?,\\?\\)\\s+on duplicate key update id = id").
+			WithArgs(int64(5), int64(10), int64(20), jan3, 19.5, 1.0, nil, nil, nil).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("insert into log_scores_archive").
+			WithArgs(int64(7), int64(10), int64(20), jan4, 19.5, 1.0, nil, nil, nil).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		// the files before and after the range are read in case they have rows in it
+		result, err := source.Restore(context.Background(), reader, filter, false)
+		require.NoError(t, err)
+		assert.Equal(t, RestoreResult{Files: 4, Read: 8, Matched: 2, Inserted: 1}, result)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		reader := newFakeReader(10, 20, 21)
+
+		expectRestoreDescribe(mock, "log_scores_archive")
+
+		result, err := source.Restore(context.Background(), reader, storage.Filter{ServerID: 21}, true)
+		require.NoError(t, err)
+		assert.Equal(t, RestoreResult{Files: 10, Read: 20, Matched: 10}, result)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("batches", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		reader := newFakeReader(1, 1, 2, 3, 4, 5)
+
+		defer func(size int) { restoreBatchSize = size }(restoreBatchSize)
+		restoreBatchSize = 2
+
+		expectRestoreDescribe(mock, "log_scores_archive")
+		for _, n := range []int64{2, 2, 1} {
+			mock.ExpectExec("insert into log_scores_archive").
+				WillReturnResult(sqlmock.NewResult(0, n))
+		}
+
+		result, err := source.Restore(context.Background(), reader, storage.Filter{}, false)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), result.Inserted)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("insert error", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		reader := newFakeReader(1, 20)
+
+		expectRestoreDescribe(mock, "log_scores_archive")
+		mock.ExpectExec("insert into log_scores_archive").
+			WillReturnError(fmt.Errorf("table is read only"))
+
+		_, err := source.Restore(context.Background(), reader, storage.Filter{}, false)
+		assert.ErrorContains(t, err, "table is read only")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRestoreInsertValues(t *testing.T) {
+	mock := dbtest.MockPool(t)
+	source := &Source{Table: "log_scores_archive"}
+
+	offset := 0.25
+	rtt := int64(15000)
+	ls := &logscore.LogScore{
+		ID: 1, ServerID: 20, Ts: 1640995200, Score: -1, Step: -1,
+		Offset: &offset, RTT: &rtt,
+		Meta: logscore.LogScoreMetadata{Error: "i/o timeout"},
+	}
+
+	// a NULL monitor_id is read as 0
+	mock.ExpectExec("insert into log_scores_archive").
+		WithArgs(int64(1), nil, int64(20), int64(1640995200), -1.0, -1.0, 0.25,
+			[]byte(`{"error":"i/o timeout"}`), int64(15000)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n, err := source.insert(context.Background(), true, true, []*logscore.LogScore{ls})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
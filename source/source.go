@@ -4,10 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"go.ntppool.org/archiver"
+	"go.ntppool.org/archiver/config"
 	"go.ntppool.org/archiver/db"
 	"go.ntppool.org/archiver/logscore"
 	"go.ntppool.org/archiver/storage"
@@ -21,9 +24,21 @@ var validTables = map[string]bool{
 	"log_scores_test":    true,
 }
 
+// readBatchSize is how many rows are read from the source table
+// at a time before being handed to the archivers
+var readBatchSize = 50000
+
 type Source struct {
 	Table         string
 	retentionDays int
+
+	// BatchTimeout limits how long a batch can take from the first
+	// row being read until it's stored; 0 means no limit.
+	BatchTimeout time.Duration
+
+	// Config is passed to the archivers when they are set up;
+	// if nil the configuration is loaded from the environment.
+	Config *config.Config
 }
 
 func New(table string, retentionDays int) (*Source, error) {
@@ -39,28 +54,270 @@ func New(table string, retentionDays int) (*Source, error) {
 	return &Source{Table: table, retentionDays: retentionDays}, nil
 }
 
-func (source *Source) Process(ctx context.Context, s storage.ArchiveStatus) error {
+// Process copies new log scores to the archivers in the status list.
+// Each range of rows is read from the source table once and passed
+// to every archiver that is due and hasn't stored it yet.
+func (source *Source) Process(ctx context.Context, status []storage.ArchiveStatus) error {
 	log := logger.Setup()
-	arch, err := archiver.SetupArchiver(s.Archiver, "")
-	if err != nil || arch == nil {
-		log.Error("setup archiver", "archiver", s.Archiver, "err", err)
-		return err
+
+	targets := []*target{}
+	defer func() {
+		for _, t := range targets {
+			t.arch.Close()
+		}
+	}()
+
+	for _, s := range status {
+		arch, err := archiver.SetupArchiver(ctx, s.Archiver, source.Config)
+		if err != nil || arch == nil {
+			log.Error("setup archiver", "archiver", s.Archiver, "err", err)
+			return err
+		}
+
+		t := newTarget(s, arch)
+		t.timeout = source.BatchTimeout
+
+		if next := tooSoon(s.ModifiedOn, t.interval); !next.IsZero() {
+			// log.Printf("Don't run until %s", next)
+			arch.Close()
+			continue
+		}
+
+		targets = append(targets, t)
+	}
+
+	if len(targets) == 0 {
+		return nil
 	}
-	defer arch.Close()
 
+	return source.fanOut(ctx, targets)
+}
+
+// streamBufferSize is the number of log scores buffered for each
+// streaming archiver
+var streamBufferSize = 1000
+
+// target is an archiver receiving log scores from the fan-out
+type target struct {
+	status   storage.ArchiveStatus
+	arch     storage.Archiver
+	minSize  int
+	maxSize  int
+	interval time.Duration
+	timeout  time.Duration
+
+	// lastID is the last id stored by the archiver
+	lastID int64
+
+	// count is the number of rows available after lastID
+	count int
+
+	batch batch
+	done  bool
+	err   error
+}
+
+func newTarget(s storage.ArchiveStatus, arch storage.Archiver) *target {
 	minSize, maxSize, interval := arch.BatchSizeMinMaxTime()
+	t := &target{
+		status:   s,
+		arch:     arch,
+		minSize:  minSize,
+		maxSize:  maxSize,
+		interval: interval,
+	}
+	if s.LogScoreID.Valid && s.LogScoreID.Int64 > 0 {
+		t.lastID = s.LogScoreID.Int64
+	}
+	return t
+}
 
-	// log.Printf("%s has rtt: %t", source.Table, hasRTT)
-	// log.Printf("ModifiedOn: %s", s.ModifiedOn)
+// add queues a log score for the archiver, storing the batch
+// when it reaches the maximum size
+func (t *target) add(ctx context.Context, ls *logscore.LogScore) {
+	if t.done || ls.ID <= t.lastID {
+		return
+	}
+	if t.batch == nil {
+		t.batch = newBatch(ctx, t.arch, t.timeout)
+	}
+	t.batch.add(ls)
+	if t.batch.size() >= t.maxSize {
+		t.flush(ctx)
+	}
+}
 
-	if next := tooSoon(s.ModifiedOn, interval); !next.IsZero() {
-		// log.Printf("Don't run until %s", next)
-		return nil
+// flush stores the current batch and updates the archive status
+func (t *target) flush(ctx context.Context) {
+	log := logger.Setup()
+
+	b := t.batch
+	t.batch = nil
+
+	if b == nil || b.size() == 0 {
+		t.done = true
+		return
+	}
+
+	// log.Printf("Storing %d log scores", b.size())
+
+	cnt, err := b.store()
+	log.Info("saved scores", "archiver", t.status.Archiver, "count", cnt)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+
+	newLastID := b.lastID()
+	// log.Printf("Setting new Last ID to %d (was %d)", newLastID, t.lastID)
+	// the data is stored, so record it even if we are shutting down
+	err = t.status.SetStatus(context.WithoutCancel(ctx), newLastID)
+	if err != nil {
+		t.fail(fmt.Errorf("could not update archiver status for %q to %d: %s",
+			t.status.Archiver, newLastID, err))
+		return
 	}
 
-	log.Debug("processing", "archiver", s.Archiver)
+	// do another batch if there's more data
+	t.lastID = newLastID
+	t.count = t.count - b.size()
+	if t.count <= t.minSize {
+		t.done = true
+	}
+}
+
+// abort discards a batch in progress
+func (t *target) abort() {
+	if t.batch != nil {
+		t.batch.abort()
+		t.batch = nil
+	}
+}
+
+func (t *target) fail(err error) {
+	t.err = fmt.Errorf("error processing %s: %w", t.status.Archiver, err)
+	t.done = true
+}
+
+// batch collects the log scores for one Store call
+type batch interface {
+	add(*logscore.LogScore)
+	size() int
+	lastID() int64
+	store() (int, error)
+	abort()
+}
+
+func newBatch(ctx context.Context, arch storage.Archiver, timeout time.Duration) batch {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	if sa, ok := arch.(storage.StreamArchiver); ok {
+		return newStreamBatch(ctx, cancel, sa)
+	}
+	return &sliceBatch{ctx: ctx, cancel: cancel, arch: arch}
+}
+
+// sliceBatch keeps the log scores in memory until they are stored
+type sliceBatch struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	arch      storage.Archiver
+	logScores []*logscore.LogScore
+}
+
+func (b *sliceBatch) add(ls *logscore.LogScore) {
+	b.logScores = append(b.logScores, ls)
+}
+
+func (b *sliceBatch) size() int {
+	return len(b.logScores)
+}
+
+func (b *sliceBatch) lastID() int64 {
+	return b.logScores[len(b.logScores)-1].ID
+}
+
+func (b *sliceBatch) store() (int, error) {
+	defer b.cancel()
+	return b.arch.Store(b.ctx, b.logScores)
+}
+
+func (b *sliceBatch) abort() {
+	b.cancel()
+	b.logScores = nil
+}
+
+// streamBatch passes the log scores to a StreamArchiver as they
+// are added, so only streamBufferSize of them are kept in memory
+type streamBatch struct {
+	ch     chan *logscore.LogScore
+	result chan streamResult
+	cancel context.CancelFunc
+	count  int
+	last   int64
+}
+
+type streamResult struct {
+	count int
+	err   error
+}
+
+func newStreamBatch(ctx context.Context, cancel context.CancelFunc, sa storage.StreamArchiver) *streamBatch {
+	b := &streamBatch{
+		ch:     make(chan *logscore.LogScore, streamBufferSize),
+		result: make(chan streamResult, 1),
+		cancel: cancel,
+	}
+
+	go func() {
+		n, err := sa.StoreStream(ctx, b.ch)
+		// drain the channel in case the archiver returned early
+		for range b.ch {
+		}
+		b.result <- streamResult{count: n, err: err}
+	}()
+
+	return b
+}
+
+func (b *streamBatch) add(ls *logscore.LogScore) {
+	b.ch <- ls
+	b.count++
+	b.last = ls.ID
+}
+
+func (b *streamBatch) size() int {
+	return b.count
+}
+
+func (b *streamBatch) lastID() int64 {
+	return b.last
+}
+
+func (b *streamBatch) store() (int, error) {
+	close(b.ch)
+	r := <-b.result
+	b.cancel()
+	return r.count, r.err
+}
+
+// abort cancels the archiver's context before closing the
+// channel, so it discards what it has received so far
+func (b *streamBatch) abort() {
+	b.cancel()
+	close(b.ch)
+	<-b.result
+}
 
-	lastID := int64(0)
+// fanOut reads the rows after the lowest lastID of the targets
+// and hands them to each target
+func (source *Source) fanOut(ctx context.Context, targets []*target) error {
+	log := logger.Setup()
 
 	hasAttributes, err := source.checkField(ctx, "attributes")
 	if err != nil {
@@ -73,165 +330,242 @@ func (source *Source) Process(ctx context.Context, s storage.ArchiveStatus) erro
 	}
 
 	// check that there are min entries to copy
-	var count int
-	if s.LogScoreID.Valid && s.LogScoreID.Int64 > 0 {
-		lastID = s.LogScoreID.Int64
-		// log.Printf("getting count after %d from %s", s.LogScoreID.Int64, source.Table)
-		err := db.Pool.Get(ctx, &count,
-			fmt.Sprintf(`select count(*) from %s where id > ?`,
-				source.Table),
-			s.LogScoreID)
-		if err != nil {
-			log.Error("db getting count", "id", s.LogScoreID, "table", source.Table, "err", err)
-			return err
+	err = source.counts(ctx, targets)
+	if err != nil {
+		return err
+	}
+
+	active := []*target{}
+	for _, t := range targets {
+		if t.count < t.minSize {
+			log.Debug("too few entries available",
+				"archiver", t.status.Archiver, "table", source.Table,
+				"count", t.count, "min-size", t.minSize,
+			)
+			continue
 		}
-	} else {
-		log.Debug("getting full count", "table", source.Table)
-		err := db.Pool.Get(ctx, &count,
-			fmt.Sprintf("select count(*) from %s", source.Table),
-		)
-		if err != nil {
-			log.Error("db getting full count", "err", err)
-			return err
+		if t.count > t.maxSize {
+			log.Info("has more than max rows", "archiver", t.status.Archiver, "count", t.count, "max", t.maxSize)
+		}
+		if t.count == t.minSize {
+			// matches the "more than minSize" requirement for each batch
+			continue
 		}
+		log.Debug("processing", "archiver", t.status.Archiver)
+		active = append(active, t)
 	}
-	if count < minSize {
-		log.Debug("too few entries available",
-			"archiver", s.Archiver, "table", source.Table,
-			"count", count, "min-size", minSize,
-		)
+
+	if len(active) == 0 {
 		return nil
 	}
 
-	if count > maxSize {
-		log.Info("has more than max rows", "count", count, "max", maxSize)
+	// discard incomplete batches if we return early
+	defer func() {
+		for _, t := range active {
+			t.abort()
+		}
+	}()
+
+	lastID := active[0].lastID
+	for _, t := range active[1:] {
+		lastID = min(lastID, t.lastID)
 	}
 
-	for count > minSize {
+	for {
+		// stop between batches when shutting down
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-		// log.Printf("Count: %d, minSize: %d", count, minSize)
+		running := false
+		for _, t := range active {
+			if !t.done {
+				running = true
+			}
+		}
+		if !running {
+			break
+		}
 
 		// log.Printf("Fetching up to %d LogScores from %s with id > %d",
-		// 	maxSize, source.Table, lastID,
+		// 	readBatchSize, source.Table, lastID,
 		// )
 
-		fields := `id,monitor_id,server_id,UNIX_TIMESTAMP(ts),score,step,offset`
-		if hasAttributes {
-			fields = fields + ",attributes"
+		logScores, err := source.read(ctx, hasAttributes, hasRTT, lastID, readBatchSize)
+		if err != nil {
+			return err
 		}
-		if hasRTT {
-			fields = fields + ",rtt"
+
+		for _, ls := range logScores {
+			for _, t := range active {
+				t.add(ctx, ls)
+			}
 		}
 
-		rows, err := db.Pool.Query(ctx,
-			fmt.Sprintf(
-				`select %s
-				from %s
-				where
-				  id > ?
-				order by id
-				limit ?`,
-				fields,
-				source.Table,
-			),
-			lastID,
-			maxSize,
-		)
-		if err != nil {
-			log.Error("select error", "err", err)
-			return err
+		if len(logScores) < readBatchSize {
+			// no more data, store what we have
+			for _, t := range active {
+				if !t.done {
+					t.flush(ctx)
+				}
+			}
+			break
 		}
-		defer rows.Close() // Ensure rows are closed even if error occurs
 
-		logScores := []*logscore.LogScore{}
+		lastID = logScores[len(logScores)-1].ID
+	}
 
-		for rows.Next() {
+	errs := []error{}
+	for _, t := range active {
+		if t.err != nil {
+			errs = append(errs, t.err)
+		}
+	}
 
-			var monitorID sql.NullInt64
-			var offset sql.NullFloat64
-			var rtt sql.NullInt64
-			var attributes sql.RawBytes
+	return errors.Join(errs...)
+}
 
-			ls := logscore.LogScore{}
+// counts sets the number of rows available after lastID for each
+// target, counting for all of them in one query.
+func (source *Source) counts(ctx context.Context, targets []*target) error {
+	log := logger.Setup()
 
-			// todo: add new meta data column
+	minID := targets[0].lastID
+	sums := []string{}
+	args := []interface{}{}
+	for _, t := range targets {
+		minID = min(minID, t.lastID)
+		sums = append(sums, "sum(id > ?)")
+		args = append(args, t.lastID)
+	}
+	args = append(args, minID)
 
-			fields := []interface{}{&ls.ID, &monitorID, &ls.ServerID, &ls.Ts, &ls.Score, &ls.Step, &offset}
-			if hasAttributes {
-				fields = append(fields, &attributes)
-			}
-			if hasRTT {
-				fields = append(fields, &rtt)
-			}
+	rows, err := db.Pool.Query(ctx,
+		fmt.Sprintf(`select %s from %s where id > ?`,
+			strings.Join(sums, ","), source.Table),
+		args...,
+	)
+	if err != nil {
+		log.Error("db getting counts", "id", minID, "table", source.Table, "err", err)
+		return err
+	}
+	defer rows.Close()
 
-			err := rows.Scan(fields...)
-			if err != nil {
-				return err
-			}
+	counts := make([]sql.NullInt64, len(targets))
+	dest := make([]interface{}, len(targets))
+	for i := range counts {
+		dest[i] = &counts[i]
+	}
 
-			// NULL as "0" here is what we want
-			ls.MonitorID = monitorID.Int64
+	if rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
-			if offset.Valid {
-				ls.Offset = &offset.Float64
-			} else {
-				ls.Offset = nil
-			}
+	// sum() returns NULL when there are no rows
+	for i, t := range targets {
+		t.count = int(counts[i].Int64)
+	}
 
-			if rtt.Valid {
-				ls.RTT = &rtt.Int64
-			} else {
-				ls.RTT = nil
-			}
+	return nil
+}
 
-			if len(attributes) > 0 {
-				err = json.Unmarshal(attributes, &ls.Meta)
-				if err != nil {
-					log.Error("error unmarshal'ing", "data", attributes, "err", err)
-					return err
-				}
-			}
+// read returns up to limit log scores with an id larger than lastID
+func (source *Source) read(ctx context.Context, hasAttributes, hasRTT bool, lastID int64, limit int) ([]*logscore.LogScore, error) {
+	log := logger.Setup()
 
-			logScores = append(logScores, &ls)
+	fields := `id,monitor_id,server_id,UNIX_TIMESTAMP(ts),score,step,offset`
+	if hasAttributes {
+		fields = fields + ",attributes"
+	}
+	if hasRTT {
+		fields = fields + ",rtt"
+	}
+
+	rows, err := db.Pool.Query(ctx,
+		fmt.Sprintf(
+			`select %s
+			from %s
+			where
+			  id > ?
+			order by id
+			limit ?`,
+			fields,
+			source.Table,
+		),
+		lastID,
+		limit,
+	)
+	if err != nil {
+		log.Error("select error", "err", err)
+		return nil, err
+	}
+	defer rows.Close() // Ensure rows are closed even if error occurs
+
+	logScores := []*logscore.LogScore{}
+
+	for rows.Next() {
+
+		var monitorID sql.NullInt64
+		var offset sql.NullFloat64
+		var rtt sql.NullInt64
+		var attributes sql.RawBytes
+
+		ls := logscore.LogScore{}
+
+		// todo: add new meta data column
+
+		fields := []interface{}{&ls.ID, &monitorID, &ls.ServerID, &ls.Ts, &ls.Score, &ls.Step, &offset}
+		if hasAttributes {
+			fields = append(fields, &attributes)
 		}
-		if err = rows.Err(); err != nil {
-			return err
+		if hasRTT {
+			fields = append(fields, &rtt)
 		}
 
-		if len(logScores) == 0 {
-			// this shouldn't happen, so just in case?
-			log.Warn("no log scores to process", "archiver", s.Archiver)
-			return nil
+		err := rows.Scan(fields...)
+		if err != nil {
+			return nil, err
 		}
 
-		// log.Printf("Storing %d log scores", len(logScores))
+		// NULL as "0" here is what we want
+		ls.MonitorID = monitorID.Int64
 
-		cnt, err := arch.Store(logScores)
-		log.Info("saved scores", "archiver", s.Archiver, "count", cnt)
-		if err != nil {
-			return err
+		if offset.Valid {
+			ls.Offset = &offset.Float64
+		} else {
+			ls.Offset = nil
 		}
 
-		newLastID := logScores[len(logScores)-1].ID
-		// log.Printf("Setting new Last ID to %d (was %d)", newLastID, lastID)
-		err = s.SetStatus(ctx, newLastID)
-		if err != nil {
-			return fmt.Errorf("could not update archiver status for %q to %d: %s",
-				s.Archiver, newLastID, err)
+		if rtt.Valid {
+			ls.RTT = &rtt.Int64
+		} else {
+			ls.RTT = nil
+		}
+
+		if len(attributes) > 0 {
+			err = json.Unmarshal(attributes, &ls.Meta)
+			if err != nil {
+				log.Error("error unmarshal'ing", "data", attributes, "err", err)
+				return nil, err
+			}
 		}
 
-		// do another batch if there's more data
-		lastID = newLastID
-		count = count - len(logScores)
+		logScores = append(logScores, &ls)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return logScores, nil
 }
 
 func (source *Source) Cleanup(ctx context.Context, status storage.ArchiveStatus) error {
-	c := &Cleanup{
-		RetentionDays: source.retentionDays,
-	}
+	c := NewCleanup(source.retentionDays, source.Config)
 	return c.Run(ctx, source, status)
 }
 
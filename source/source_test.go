@@ -1,16 +1,17 @@
 package source
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/db/dbtest"
 	"go.ntppool.org/archiver/logscore"
 	"go.ntppool.org/archiver/storage"
 )
@@ -30,7 +31,7 @@ func (m *mockArchiver) BatchSizeMinMaxTime() (int, int, time.Duration) {
 	return m.minSize, m.maxSize, m.interval
 }
 
-func (m *mockArchiver) Store(ls []*logscore.LogScore) (int, error) {
+func (m *mockArchiver) Store(ctx context.Context, ls []*logscore.LogScore) (int, error) {
 	if m.storeErr != nil {
 		return 0, m.storeErr
 	}
@@ -146,15 +147,7 @@ func TestTooSoon(t *testing.T) {
 }
 
 func TestCheckField(t *testing.T) {
-	// Create a mock database
-	mockDB, mock, err := sqlmock.New()
-	require.NoError(t, err)
-	defer mockDB.Close()
-
-	// Replace the global db with our mock
-	originalDB := db.DB
-	db.DB = sqlx.NewDb(mockDB, "mysql")
-	defer func() { db.DB = originalDB }()
+	mock := dbtest.MockPool(t)
 
 	source := &Source{Table: "log_scores", retentionDays: 14}
 
@@ -165,7 +158,7 @@ func TestCheckField(t *testing.T) {
 
 		mock.ExpectQuery("DESCRIBE log_scores").WillReturnRows(rows)
 
-		hasField, err := source.checkField("attributes")
+		hasField, err := source.checkField(context.Background(), "attributes")
 		assert.NoError(t, err)
 		assert.True(t, hasField)
 	})
@@ -177,7 +170,7 @@ func TestCheckField(t *testing.T) {
 
 		mock.ExpectQuery("DESCRIBE log_scores").WillReturnRows(rows)
 
-		hasField, err := source.checkField("nonexistent")
+		hasField, err := source.checkField(context.Background(), "nonexistent")
 		assert.NoError(t, err)
 		assert.False(t, hasField)
 	})
@@ -185,7 +178,7 @@ func TestCheckField(t *testing.T) {
 	t.Run("database error", func(t *testing.T) {
 		mock.ExpectQuery("DESCRIBE log_scores").WillReturnError(sql.ErrConnDone)
 
-		hasField, err := source.checkField("attributes")
+		hasField, err := source.checkField(context.Background(), "attributes")
 		assert.Error(t, err)
 		assert.False(t, hasField)
 	})
@@ -210,15 +203,7 @@ func TestProcessTooSoon(t *testing.T) {
 }
 
 func TestProcessCount(t *testing.T) {
-	// Create a mock database
-	mockDB, mock, err := sqlmock.New()
-	require.NoError(t, err)
-	defer mockDB.Close()
-
-	// Replace the global db with our mock
-	originalDB := db.DB
-	db.DB = sqlx.NewDb(mockDB, "mysql")
-	defer func() { db.DB = originalDB }()
+	mock := dbtest.MockPool(t)
 
 	t.Run("count with valid last ID", func(t *testing.T) {
 		// Mock count query
@@ -235,7 +220,7 @@ func TestProcessCount(t *testing.T) {
 
 		// Test the count logic in isolation
 		var count int
-		err := db.DB.Get(&count, "select count(*) from log_scores where id > ?", status.LogScoreID.Int64)
+		err := db.Pool.Get(context.Background(), &count, "select count(*) from log_scores where id > ?", status.LogScoreID.Int64)
 		assert.NoError(t, err)
 		assert.Equal(t, 5, count)
 	})
@@ -246,7 +231,7 @@ func TestProcessCount(t *testing.T) {
 		mock.ExpectQuery("select count\\(\\*\\) from log_scores").WillReturnRows(countRows)
 
 		var count int
-		err := db.DB.Get(&count, "select count(*) from log_scores")
+		err := db.Pool.Get(context.Background(), &count, "select count(*) from log_scores")
 		assert.NoError(t, err)
 		assert.Equal(t, 50, count)
 	})
@@ -255,15 +240,7 @@ func TestProcessCount(t *testing.T) {
 }
 
 func TestProcessDataFetching(t *testing.T) {
-	// Create a mock database
-	mockDB, mock, err := sqlmock.New()
-	require.NoError(t, err)
-	defer mockDB.Close()
-
-	// Replace the global db with our mock
-	originalDB := db.DB
-	db.DB = sqlx.NewDb(mockDB, "mysql")
-	defer func() { db.DB = originalDB }()
+	mock := dbtest.MockPool(t)
 
 	t.Run("fetch data with attributes and rtt", func(t *testing.T) {
 		// Mock the data query
@@ -280,7 +257,7 @@ func TestProcessDataFetching(t *testing.T) {
 			WithArgs(int64(0), 100).
 			WillReturnRows(dataRows)
 
-		rows, err := db.DB.Query(
+		rows, err := db.Pool.Query(context.Background(),
 			"select id,monitor_id,server_id,UNIX_TIMESTAMP(ts),score,step,offset,attributes,rtt from log_scores where id > ? order by id limit ?",
 			int64(0), 100,
 		)
@@ -347,21 +324,13 @@ func TestProcessDataFetching(t *testing.T) {
 }
 
 func TestProcessDatabaseErrors(t *testing.T) {
-	// Create a mock database
-	mockDB, mock, err := sqlmock.New()
-	require.NoError(t, err)
-	defer mockDB.Close()
-
-	// Replace the global db with our mock
-	originalDB := db.DB
-	db.DB = sqlx.NewDb(mockDB, "mysql")
-	defer func() { db.DB = originalDB }()
+	mock := dbtest.MockPool(t)
 
 	t.Run("describe error", func(t *testing.T) {
 		mock.ExpectQuery("DESCRIBE log_scores").WillReturnError(sql.ErrConnDone)
 
 		source := &Source{Table: "log_scores", retentionDays: 14}
-		hasField, err := source.checkField("attributes")
+		hasField, err := source.checkField(context.Background(), "attributes")
 		assert.Error(t, err)
 		assert.False(t, hasField)
 		assert.Contains(t, err.Error(), "describe error")
@@ -371,14 +340,14 @@ func TestProcessDatabaseErrors(t *testing.T) {
 		mock.ExpectQuery("select count\\(\\*\\) from log_scores").WillReturnError(sql.ErrConnDone)
 
 		var count int
-		err := db.DB.Get(&count, "select count(*) from log_scores")
+		err := db.Pool.Get(context.Background(), &count, "select count(*) from log_scores")
 		assert.Error(t, err)
 	})
 
 	t.Run("data query error", func(t *testing.T) {
 		mock.ExpectQuery("select id,monitor_id,server_id").WillReturnError(sql.ErrConnDone)
 
-		rows, err := db.DB.Query("select id,monitor_id,server_id from log_scores where id > ? order by id limit ?", int64(0), 100)
+		rows, err := db.Pool.Query(context.Background(), "select id,monitor_id,server_id from log_scores where id > ? order by id limit ?", int64(0), 100)
 		assert.Error(t, err)
 		assert.Nil(t, rows)
 	})
@@ -391,7 +360,7 @@ func TestProcessDatabaseErrors(t *testing.T) {
 		mock.ExpectQuery("select id,monitor_id,server_id").
 			WillReturnRows(dataRows)
 
-		rows, err := db.DB.Query("select id,monitor_id,server_id from log_scores where id > ? order by id limit ?", int64(0), 100)
+		rows, err := db.Pool.Query(context.Background(), "select id,monitor_id,server_id from log_scores where id > ? order by id limit ?", int64(0), 100)
 		require.NoError(t, err)
 		defer rows.Close()
 
@@ -406,15 +375,7 @@ func TestProcessDatabaseErrors(t *testing.T) {
 }
 
 func TestProcessJSONUnmarshalError(t *testing.T) {
-	// Create a mock database
-	mockDB, mock, err := sqlmock.New()
-	require.NoError(t, err)
-	defer mockDB.Close()
-
-	// Replace the global db with our mock
-	originalDB := db.DB
-	db.DB = sqlx.NewDb(mockDB, "mysql")
-	defer func() { db.DB = originalDB }()
+	mock := dbtest.MockPool(t)
 
 	t.Run("invalid json attributes", func(t *testing.T) {
 		// Mock data with invalid JSON
@@ -427,7 +388,7 @@ func TestProcessJSONUnmarshalError(t *testing.T) {
 			WithArgs(int64(0), 100).
 			WillReturnRows(dataRows)
 
-		rows, err := db.DB.Query(
+		rows, err := db.Pool.Query(context.Background(),
 			"select id,monitor_id,server_id,UNIX_TIMESTAMP(ts),score,step,offset,attributes from log_scores where id > ? order by id limit ?",
 			int64(0), 100,
 		)
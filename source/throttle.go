@@ -0,0 +1,192 @@
+package source
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/common/logger"
+)
+
+// clean deletes up to maxRows rows from the source table in chunks,
+// waiting for the replicas to catch up before each chunk. With a
+// budget it stops when the time is used up, stopped is then true.
+func (c *Cleanup) clean(ctx context.Context, source *Source, maxRows int, budget time.Duration) (deleted int64, stopped bool, err error) {
+	log := logger.Setup()
+
+	start := time.Now()
+	var deadline time.Time
+	if budget > 0 {
+		deadline = start.Add(budget)
+	}
+
+	maxDays := c.retentionDays()
+
+	// verify the whole range once, the chunks only delete rows in it
+	var verified *CleanupPlan
+	if c.Verify {
+		r, err := c.verifiedRange(ctx, source, maxDays, maxRows)
+		if err != nil {
+			return 0, false, err
+		}
+		if r.Count == 0 {
+			return 0, false, nil
+		}
+		verified = &r
+	}
+
+	defer func() {
+		if elapsed := time.Since(start).Seconds(); deleted > 0 && elapsed > 0 {
+			cleanupRowsPerSecond.WithLabelValues(source.Table).Set(float64(deleted) / elapsed)
+		}
+	}()
+
+	for deleted < int64(maxRows) {
+		if err := ctx.Err(); err != nil {
+			return deleted, false, err
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			log.Info("cleanup time budget used", "table", source.Table, "budget", budget, "deleted", deleted)
+			return deleted, true, nil
+		}
+
+		ok, err := c.waitForReplicas(ctx, deadline)
+		if err != nil {
+			return deleted, false, err
+		}
+		if !ok {
+			return deleted, true, nil
+		}
+
+		limit := int(min(int64(c.chunkSize()), int64(maxRows)-deleted))
+
+		count, err := c.deleteChunk(ctx, source, maxDays, limit, verified)
+		deleted += count
+		cleanupDeletedRows.WithLabelValues(source.Table).Add(float64(count))
+		if err != nil {
+			return deleted, false, err
+		}
+		log.Debug("cleaned chunk", "table", source.Table, "count", count, "total", deleted)
+
+		if count < int64(limit) {
+			break
+		}
+	}
+
+	return deleted, false, nil
+}
+
+// waitForReplicas returns when the replica lag is below MaxReplicaLag,
+// checking again every LagPause. It returns false if the lag is still
+// too high at the deadline.
+func (c *Cleanup) waitForReplicas(ctx context.Context, deadline time.Time) (bool, error) {
+	if c.MaxReplicaLag <= 0 {
+		return true, nil
+	}
+
+	log := logger.Setup()
+
+	for {
+		lag, err := c.replicaLag(ctx)
+		if err != nil {
+			return false, fmt.Errorf("replica lag: %s", err)
+		}
+		cleanupReplicaLag.Set(lag.Seconds())
+
+		if lag <= c.MaxReplicaLag {
+			return true, nil
+		}
+
+		pause := c.lagPause()
+		if !deadline.IsZero() && time.Now().Add(pause).After(deadline) {
+			log.Info("replica lag too high, stopping cleanup", "lag", lag, "max", c.MaxReplicaLag)
+			return false, nil
+		}
+
+		log.Info("replica lag too high, pausing cleanup", "lag", lag, "max", c.MaxReplicaLag, "pause", pause)
+		cleanupThrottled.Add(pause.Seconds())
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+}
+
+// replicaLag returns the highest lag reported by LagQuery, which
+// should return the lag in seconds in the first column, or by
+// SHOW REPLICA STATUS. No rows is an error: on the primary SHOW REPLICA
+// STATUS doesn't report anything, and the lag would never be checked.
+func (c *Cleanup) replicaLag(ctx context.Context) (time.Duration, error) {
+	query := c.LagQuery
+	if query == "" {
+		query = "SHOW REPLICA STATUS"
+	}
+
+	rows, err := db.Pool.Query(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	idx := 0
+	if c.LagQuery == "" {
+		idx = -1
+		for i, name := range columns {
+			// Seconds_Behind_Master before MySQL 8.0.22
+			if name == "Seconds_Behind_Source" || name == "Seconds_Behind_Master" {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return 0, fmt.Errorf("no Seconds_Behind_Source column in replica status")
+		}
+	}
+
+	var lag time.Duration
+	found := false
+
+	for rows.Next() {
+		found = true
+		values := make([]sql.NullString, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return 0, err
+		}
+
+		// NULL when replication isn't running
+		if !values[idx].Valid {
+			return 0, fmt.Errorf("replication isn't running")
+		}
+		seconds, err := strconv.ParseFloat(values[idx].String, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid lag %q: %s", values[idx].String, err)
+		}
+		lag = max(lag, time.Duration(seconds*float64(time.Second)))
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		if c.LagQuery == "" {
+			return 0, fmt.Errorf("SHOW REPLICA STATUS returned no rows (not a replica?), set cleanup_lag_query")
+		}
+		return 0, fmt.Errorf("cleanup_lag_query returned no rows")
+	}
+
+	return lag, nil
+}
@@ -0,0 +1,172 @@
+package source
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/db/dbtest"
+	"go.ntppool.org/archiver/storage"
+)
+
+func expectReplicaLag(mock sqlmock.Sqlmock, lag any) {
+	mock.ExpectQuery("SHOW REPLICA STATUS").
+		WillReturnRows(sqlmock.NewRows([]string{"Replica_IO_State", "Seconds_Behind_Source"}).
+			AddRow("Waiting for source to send event", lag))
+}
+
+func TestReplicaLag(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("replica status", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		c := &Cleanup{}
+
+		mock.ExpectQuery("SHOW REPLICA STATUS").
+			WillReturnRows(sqlmock.NewRows([]string{"Seconds_Behind_Source"}).AddRow(3).AddRow(12))
+
+		lag, err := c.replicaLag(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 12*time.Second, lag)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("older mysql", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		c := &Cleanup{}
+
+		mock.ExpectQuery("SHOW REPLICA STATUS").
+			WillReturnRows(sqlmock.NewRows([]string{"Seconds_Behind_Master"}).AddRow(2))
+
+		lag, err := c.replicaLag(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 2*time.Second, lag)
+	})
+
+	t.Run("not a replica", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		c := &Cleanup{}
+
+		mock.ExpectQuery("SHOW REPLICA STATUS").
+			WillReturnRows(sqlmock.NewRows([]string{"Seconds_Behind_Source"}))
+
+		_, err := c.replicaLag(ctx)
+		assert.ErrorContains(t, err, "set cleanup_lag_query")
+	})
+
+	t.Run("replication stopped", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		c := &Cleanup{}
+
+		expectReplicaLag(mock, nil)
+
+		_, err := c.replicaLag(ctx)
+		assert.ErrorContains(t, err, "replication isn't running")
+	})
+
+	t.Run("lag query", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		c := &Cleanup{LagQuery: "select max(lag) from replica_heartbeat"}
+
+		mock.ExpectQuery("select max\\(lag\\) from replica_heartbeat").
+			WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow("1.5"))
+
+		lag, err := c.replicaLag(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1500*time.Millisecond, lag)
+
+		mock.ExpectQuery("select max\\(lag\\) from replica_heartbeat").
+			WillReturnRows(sqlmock.NewRows([]string{"lag"}))
+
+		_, err = c.replicaLag(ctx)
+		assert.ErrorContains(t, err, "cleanup_lag_query returned no rows")
+	})
+}
+
+func TestCleanThrottled(t *testing.T) {
+	source := &Source{Table: "log_scores", retentionDays: 14}
+
+	t.Run("pauses for lag", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		c := &Cleanup{
+			RetentionDays: 14,
+			ChunkSize:     100,
+			MaxReplicaLag: 5 * time.Second,
+			LagPause:      time.Millisecond,
+		}
+
+		before := testutil.ToFloat64(cleanupDeletedRows.WithLabelValues("log_scores"))
+
+		expectReplicaLag(mock, 2)
+		expectStatusScope(mock, false)
+		mock.ExpectExec("delete\\s+from log_scores").
+			WithArgs(14, 100).WillReturnResult(sqlmock.NewResult(0, 100))
+
+		// the replicas fell behind, wait for them to catch up
+		expectReplicaLag(mock, 30)
+		expectReplicaLag(mock, 1)
+		expectStatusScope(mock, false)
+		mock.ExpectExec("delete\\s+from log_scores").
+			WithArgs(14, 50).WillReturnResult(sqlmock.NewResult(0, 50))
+
+		deleted, stopped, err := c.clean(context.Background(), source, 150, time.Minute)
+		require.NoError(t, err)
+		assert.False(t, stopped)
+		assert.Equal(t, int64(150), deleted)
+		assert.Equal(t, before+150, testutil.ToFloat64(cleanupDeletedRows.WithLabelValues("log_scores")))
+		assert.Equal(t, float64(1), testutil.ToFloat64(cleanupReplicaLag))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("stops at the time budget", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		c := &Cleanup{
+			RetentionDays: 14,
+			ChunkSize:     100,
+			MaxReplicaLag: 5 * time.Second,
+			LagPause:      time.Hour,
+		}
+
+		expectReplicaLag(mock, 2)
+		expectStatusScope(mock, false)
+		mock.ExpectExec("delete\\s+from log_scores").
+			WithArgs(14, 100).WillReturnResult(sqlmock.NewResult(0, 100))
+		// waiting for the lag would take longer than the budget
+		expectReplicaLag(mock, 30)
+
+		deleted, stopped, err := c.clean(context.Background(), source, 1000, time.Minute)
+		require.NoError(t, err)
+		assert.True(t, stopped)
+		assert.Equal(t, int64(100), deleted)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCleanupRunStopped(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	source := &Source{Table: "log_scores", retentionDays: 14}
+	c := &Cleanup{
+		RetentionDays:   14,
+		DefaultInterval: 10 * time.Minute,
+		ReducedInterval: 2 * time.Minute,
+		BatchSize:       1000,
+		ChunkSize:       100,
+		MaxReplicaLag:   5 * time.Second,
+		LagPause:        time.Hour,
+	}
+
+	expectReplicaLag(mock, 30)
+	// there's more to do, so the next run is after the reduced interval
+	mock.ExpectExec("modified_on=NOW\\(\\) - INTERVAL \\? SECOND").
+		WithArgs(nil, int64(480), 5).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := c.Run(context.Background(), source, storage.ArchiveStatus{ID: 5, Archiver: "cleanup"})
+	require.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
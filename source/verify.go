@@ -0,0 +1,95 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.ntppool.org/archiver"
+	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/storage"
+	"go.ntppool.org/common/logger"
+)
+
+// verifiedRange returns the rows the cleanup would delete, up to
+// batchSize, after checking with each archiver for the table that can
+// verify what it has stored that it has all the rows in the id range.
+// If any archiver is missing rows an error is returned.
+func (c *Cleanup) verifiedRange(ctx context.Context, source *Source, maxDays, batchSize int) (CleanupPlan, error) {
+	log := logger.Setup()
+
+	r, err := c.deleteRange(ctx, source, maxDays, batchSize)
+	if err != nil {
+		return r, fmt.Errorf("cleanup range: %s", err)
+	}
+	if r.Count == 0 {
+		return r, nil
+	}
+
+	// every row in the range must be archived, including any
+	// that are too new to be deleted
+	var expected int64
+	err = db.Pool.Get(ctx, &expected,
+		fmt.Sprintf(`select count(*) from %s where id between ? and ?`, source.Table),
+		r.FirstID, r.LastID,
+	)
+	if err != nil {
+		return r, fmt.Errorf("cleanup range count: %s", err)
+	}
+
+	err = source.verifyArchivers(ctx, r.FirstID, r.LastID, expected)
+	if err != nil {
+		return r, err
+	}
+
+	log.Info("archivers verified", "first_id", r.FirstID, "last_id", r.LastID, "count", expected)
+
+	return r, nil
+}
+
+// verifyArchivers asks each archiver for the table that implements
+// storage.Verifier if it has the count rows from firstID to lastID.
+func (source *Source) verifyArchivers(ctx context.Context, firstID, lastID, count int64) error {
+	log := logger.Setup()
+
+	status, err := storage.GetArchiveStatus(ctx, source.Table)
+	if err != nil {
+		return fmt.Errorf("archive status: %s", err)
+	}
+
+	errs := []error{}
+
+	for _, s := range status {
+		if backend, _, _ := storage.ParseName(s.Archiver); backend == "cleanup" {
+			continue
+		}
+
+		arch, err := archiver.SetupArchiver(ctx, s.Archiver, source.Config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Archiver, err))
+			continue
+		}
+
+		v, ok := arch.(storage.Verifier)
+		if !ok {
+			log.Debug("archiver can't verify stored rows", "archiver", s.Archiver)
+			arch.Close()
+			continue
+		}
+
+		err = v.VerifyRange(ctx, firstID, lastID, count)
+		arch.Close()
+		if err != nil {
+			log.Error("archiver verification failed, not deleting",
+				"archiver", s.Archiver, "first_id", firstID, "last_id", lastID, "err", err)
+			cleanupVerifyFailures.WithLabelValues(s.Archiver).Inc()
+			errs = append(errs, fmt.Errorf("%s: %w", s.Archiver, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("refusing to delete ids %d to %d: %w", firstID, lastID, errors.Join(errs...))
+	}
+
+	return nil
+}
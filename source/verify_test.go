@@ -0,0 +1,113 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/db/dbtest"
+	"go.ntppool.org/archiver/storage"
+)
+
+// verifyingArchiver is registered as the "test-verify" backend
+type verifyingArchiver struct {
+	fakeArchiver
+}
+
+var verifyRanges [][3]int64
+var verifyErr error
+
+func (f *verifyingArchiver) VerifyRange(ctx context.Context, firstID, lastID, count int64) error {
+	verifyRanges = append(verifyRanges, [3]int64{firstID, lastID, count})
+	return verifyErr
+}
+
+func init() {
+	storage.Register(storage.Backend{
+		Name: "test-verify",
+		New: func(ctx context.Context, opts storage.Options) (storage.Archiver, error) {
+			return &verifyingArchiver{}, nil
+		},
+	})
+}
+
+func expectVerifyQueries(mock sqlmock.Sqlmock) {
+	expectStatusScope(mock, false)
+	mock.ExpectQuery("(?s)select count\\(\\*\\) as count.*from log_scores").
+		WithArgs(14, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "first_id", "last_id"}).AddRow(3, 1, 5))
+	mock.ExpectQuery("select count\\(\\*\\) from log_scores where id between").
+		WithArgs(int64(1), int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
+
+	expectStatusScope(mock, false)
+	mock.ExpectQuery("select id, archiver, log_score_id, modified_on").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "archiver", "log_score_id", "modified_on"}).
+			AddRow(1, "test-verify", 10, time.Now()).
+			AddRow(2, "cleanup", nil, time.Now()))
+}
+
+func TestCleanVerified(t *testing.T) {
+	source := &Source{Table: "log_scores", retentionDays: 14, Config: &config.Config{}}
+	c := &Cleanup{RetentionDays: 14, BatchSize: 100, Verify: true}
+
+	t.Run("verified", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		verifyRanges, verifyErr = nil, nil
+
+		expectVerifyQueries(mock)
+		mock.ExpectExec("(?s)delete\\s+from log_scores\\s+where\\s+id between \\? and \\?").
+			WithArgs(int64(1), int64(5), 14, 100).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+
+		count, err := c.Clean(context.Background(), source, 100)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), count)
+		assert.Equal(t, [][3]int64{{1, 5, 4}}, verifyRanges)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("missing rows", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+		verifyRanges = nil
+		verifyErr = storage.VerifyCount(1, 5, 4, 2)
+		defer func() { verifyErr = nil }()
+
+		before := testutil.ToFloat64(cleanupVerifyFailures.WithLabelValues("test-verify"))
+
+		expectVerifyQueries(mock)
+
+		count, err := c.Clean(context.Background(), source, 100)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "refusing to delete ids 1 to 5")
+		var verr *storage.VerifyError
+		assert.True(t, errors.As(err, &verr))
+		assert.Equal(t, int64(0), count)
+
+		after := testutil.ToFloat64(cleanupVerifyFailures.WithLabelValues("test-verify"))
+		assert.Equal(t, before+1, after)
+
+		// nothing was deleted
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("nothing to delete", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+
+		expectStatusScope(mock, false)
+		mock.ExpectQuery("(?s)select count\\(\\*\\) as count.*from log_scores").
+			WillReturnRows(sqlmock.NewRows([]string{"count", "first_id", "last_id"}).AddRow(0, 0, 0))
+
+		count, err := c.Clean(context.Background(), source, 100)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	"go.ntppool.org/archiver/config"
 	"go.ntppool.org/archiver/logscore"
 	"go.ntppool.org/archiver/storage"
 	"go.ntppool.org/archiver/storage/fileavro"
@@ -18,11 +19,34 @@ type bqArchiver struct {
 	fileAvro    storage.FileArchiver
 	datasetName string
 	tempdir     string
+	batch       config.BatchSize
 }
 
-// NewArchiver returns an archiver that stores data in avro files in the specified path
-func NewArchiver() (storage.Archiver, error) {
-	datasetName := os.Getenv("bq_dataset")
+func init() {
+	storage.Register(storage.Backend{
+		Name:        "bigquery",
+		Description: "Avro files loaded into a BigQuery dataset",
+		Params: []storage.Param{
+			{Name: "dataset", Env: "bq_dataset", Help: "BigQuery dataset name", Required: true},
+		},
+		New: func(ctx context.Context, opts storage.Options) (storage.Archiver, error) {
+			return NewArchiver(opts.Param("dataset"), opts.Batch,
+				opts.Config.Batch.FileAvroAppendSize, opts.Config.Storage.AvroCompression)
+		},
+		Batch: func(cfg *config.Config) config.BatchSize {
+			return cfg.Batch.BigQuery()
+		},
+	})
+}
+
+// defaultBatch is used when the archiver isn't given a batch size
+var defaultBatch = config.BatchSize{MinSize: 200, MaxSize: 10000000, Interval: time.Minute * 10}
+
+// NewArchiver returns an archiver that loads data into the BigQuery
+// dataset. A zero batch size uses the defaults; appendSize and the
+// compression are passed to the avro writer. BigQuery reads the
+// codec from the avro file header.
+func NewArchiver(datasetName string, batch config.BatchSize, appendSize int, compression string) (storage.Archiver, error) {
 	if len(datasetName) == 0 {
 		return nil, fmt.Errorf("bq_dataset must be set")
 	}
@@ -32,8 +56,9 @@ func NewArchiver() (storage.Archiver, error) {
 		return nil, err
 	}
 
-	fa, err := fileavro.NewArchiver(tempdir)
+	fa, err := fileavro.NewArchiver(tempdir, config.BatchSize{}, appendSize, compression)
 	if err != nil {
+		os.RemoveAll(tempdir)
 		return nil, err
 	}
 
@@ -41,6 +66,7 @@ func NewArchiver() (storage.Archiver, error) {
 		fileAvro:    fa,
 		datasetName: datasetName,
 		tempdir:     tempdir,
+		batch:       batch,
 	}
 
 	return a, nil
@@ -54,39 +80,54 @@ func (a *bqArchiver) Close() error {
 func (a *bqArchiver) BatchSizeMinMaxTime() (int, int, time.Duration) {
 	// we're limited to 1000 load jobs per table per day, so make
 	// sure we stay way under by waiting 10 minutes between each
-	return 200, 10000000, time.Minute * 10
+	// (unless configured otherwise)
+	bs := a.batch
+	if bs.MaxSize == 0 {
+		bs = defaultBatch
+	}
+	return bs.MinSize, bs.MaxSize, bs.Interval
 }
 
-func (a *bqArchiver) Store(logscores []*logscore.LogScore) (int, error) {
-	fh, err := os.CreateTemp("", "gcsavro-")
+func (a *bqArchiver) Store(ctx context.Context, logscores []*logscore.LogScore) (int, error) {
+	return a.StoreStream(ctx, storage.Stream(logscores))
+}
+
+// StoreStream writes the log scores to a temporary avro file and
+// loads it into BigQuery when the channel is closed
+func (a *bqArchiver) StoreStream(ctx context.Context, logscores <-chan *logscore.LogScore) (int, error) {
+	fh, err := os.CreateTemp(a.tempdir, "bqavro-")
 	if err != nil {
 		return 0, err
 	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
 
 	// log.Printf("Temp FH: %s", fh.Name())
 
-	n, err := a.fileAvro.StoreWriter(fh, logscores)
+	info, err := a.fileAvro.StoreStreamWriter(ctx, fh, logscores)
 	if err != nil {
 		return 0, err
 	}
+	if info.Count == 0 {
+		return 0, nil
+	}
+
 	_, err = fh.Seek(0, 0)
 	if err != nil {
 		return 0, err
 	}
 
-	err = a.Load(fh)
+	err = a.Load(ctx, fh)
 	if err != nil {
 		return 0, err
 	}
 
-	err = fh.Close()
-
-	os.Remove(fh.Name())
-
-	return n, err
+	return info.Count, fh.Close()
 }
 
-func (a *bqArchiver) Load(fh io.ReadWriteCloser) error {
+// Load runs a BigQuery load job for the avro file. If the context
+// is cancelled while waiting, the job is cancelled too.
+func (a *bqArchiver) Load(ctx context.Context, fh io.ReadWriteCloser) error {
 	tableName := "log_scores"
 
 	log.Printf("Loading into %s.%s", a.datasetName, tableName)
@@ -94,8 +135,6 @@ func (a *bqArchiver) Load(fh io.ReadWriteCloser) error {
 	r := bigquery.NewReaderSource(fh)
 	r.SourceFormat = "AVRO"
 
-	ctx := context.Background()
-
 	client, err := bigquery.NewClient(ctx, "ntppool")
 	if err != nil {
 		return err
@@ -112,6 +151,12 @@ func (a *bqArchiver) Load(fh io.ReadWriteCloser) error {
 	log.Printf("Loading BigQuery data with job %q", job.ID())
 	status, err := job.Wait(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			// the job might still complete, but it's the best we can do
+			if cerr := job.Cancel(context.WithoutCancel(ctx)); cerr != nil {
+				log.Printf("could not cancel job %q: %s", job.ID(), cerr)
+			}
+		}
 		return fmt.Errorf("error checking job status: %s", err)
 	}
 	if status.Err() != nil {
@@ -120,3 +165,38 @@ func (a *bqArchiver) Load(fh io.ReadWriteCloser) error {
 
 	return nil
 }
+
+// VerifyRange is for the Verifier interface; it counts the distinct
+// ids in the range in the BigQuery table
+func (a *bqArchiver) VerifyRange(ctx context.Context, firstID, lastID, count int64) error {
+	client, err := bigquery.NewClient(ctx, "ntppool")
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	table := client.Dataset(a.datasetName).Table("log_scores")
+
+	q := client.Query(fmt.Sprintf(
+		"select count(distinct id) as count from `%s.%s.%s` where id between @first and @last",
+		table.ProjectID, table.DatasetID, table.TableID,
+	))
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "first", Value: firstID},
+		{Name: "last", Value: lastID},
+	}
+
+	it, err := q.Read(ctx)
+	if err != nil {
+		return fmt.Errorf("verify query: %s", err)
+	}
+
+	var row struct {
+		Count int64 `bigquery:"count"`
+	}
+	if err := it.Next(&row); err != nil {
+		return fmt.Errorf("verify query: %s", err)
+	}
+
+	return storage.VerifyCount(firstID, lastID, count, row.Count)
+}
@@ -5,6 +5,7 @@ package cleanup
 // can be scheduled like the real storage "drivers".
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -12,7 +13,23 @@ import (
 	"go.ntppool.org/archiver/storage"
 )
 
-type fakeCleanup struct{}
+type fakeCleanup struct {
+	interval time.Duration
+}
+
+func init() {
+	storage.Register(storage.Backend{
+		Name:        "cleanup",
+		Description: "Deletes archived rows from the source table",
+		New: func(ctx context.Context, opts storage.Options) (storage.Archiver, error) {
+			a := &fakeCleanup{}
+			if opts.Config != nil {
+				a.interval = opts.Config.Cleanup.FakeInterval
+			}
+			return a, nil
+		},
+	})
+}
 
 // NewArchiver implements the storage interface
 func NewArchiver() (storage.Archiver, error) {
@@ -22,11 +39,14 @@ func NewArchiver() (storage.Archiver, error) {
 // BatchSizeMinMaxTime implements the storage interface, it doesn't
 // get used. The actual interval is in source/cleanup.go
 func (a *fakeCleanup) BatchSizeMinMaxTime() (int, int, time.Duration) {
-	return 0, 0, 10 * time.Minute
+	if a.interval == 0 {
+		return 0, 0, 10 * time.Minute
+	}
+	return 0, 0, a.interval
 }
 
 // Store implements the storage interface, but always returns an error
-func (a *fakeCleanup) Store(ls []*logscore.LogScore) (int, error) {
+func (a *fakeCleanup) Store(ctx context.Context, ls []*logscore.LogScore) (int, error) {
 	return 0, fmt.Errorf("cleanup can't store data")
 }
 
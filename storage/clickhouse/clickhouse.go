@@ -1,64 +1,241 @@
 package clickhouse
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 
+	"go.ntppool.org/archiver/config"
 	"go.ntppool.org/archiver/logscore"
 	"go.ntppool.org/archiver/storage"
 )
 
 // CHArchiver stores log scores in ClickHouse
 type CHArchiver struct {
-	connect *sql.DB
+	connect   *sql.DB
+	conn      batchConn
+	options   *clickhouse.Options
+	batch     config.BatchSize
+	blockSize int
+	rollups   bool
+
+	schema     schema
+	migrations []migration
+
+	// with ch_insert=shards the rows are inserted on the shards
+	// instead of with conn
+	insertShards bool
+	shards       *shards
 }
 
-// NewArchiver returns an archiver that stores data in avro files in the specified path
-func NewArchiver() (storage.Archiver, error) {
-	a := &CHArchiver{}
+// batchConn is the part of the native connection used for inserts
+type batchConn interface {
+	PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error)
+	Close() error
+}
 
-	dsn := os.Getenv("ch_dsn")
-	if len(dsn) == 0 {
-		return nil, fmt.Errorf("ch_dsn environment not set")
+// inserting data in "real time" is fine according to
+// https://clickhouse.yandex/docs/en/query_language/insert_into/
+// it's just after to do bigger batches, so do up to 500k at once
+var defaultBatch = config.BatchSize{MinSize: 50, MaxSize: 500000}
+
+// defaultBlockSize is the range of ids sent in each native block, so
+// the most rows in a block, unless configured otherwise
+const defaultBlockSize = 100000
+
+func init() {
+	storage.Register(storage.Backend{
+		Name:        "clickhouse",
+		Description: "ClickHouse log_scores table",
+		Params: []storage.Param{
+			{Name: "dsn", Env: "ch_dsn", Help: "ClickHouse DSN", Required: true},
+			{Name: "block_size", Env: "ch_block_size", Help: "Ids per native insert block (default 100000)"},
+			{Name: "compression", Env: "ch_compression", Help: "lz4 (default), zstd or none"},
+			{Name: "migrate", Env: "ch_migrate", Help: "Apply the schema migrations when starting (default true)"},
+			{Name: "rollups", Env: "ch_rollups", Help: "Maintain the hourly and daily rollup tables (default false)"},
+			{Name: "cluster", Env: "ch_cluster", Help: "Cluster to create replicated and Distributed tables on"},
+			{Name: "sharding_key", Env: "ch_sharding_key", Help: "Sharding key of the Distributed table (default server_id)"},
+			{Name: "insert", Env: "ch_insert", Help: "Insert through the distributed table (default) or directly to the shards"},
+		},
+		New: func(ctx context.Context, opts storage.Options) (storage.Archiver, error) {
+			st, err := parseSettings(opts)
+			if err != nil {
+				return nil, err
+			}
+			return NewArchiver(ctx, opts.Param("dsn"), opts.Batch, st.blockSize, opts.Param("compression"), st.migrate, st.rollups, st.cluster)
+		},
+		Batch: func(cfg *config.Config) config.BatchSize {
+			return cfg.Batch.ClickHouse()
+		},
+		Connect: func(ctx context.Context, opts storage.Options) (storage.Archiver, error) {
+			st, err := parseSettings(opts)
+			if err != nil {
+				return nil, err
+			}
+			a, err := Connect(ctx, opts.Param("dsn"), opts.Param("compression"), st.rollups, st.cluster)
+			if err != nil {
+				return nil, err
+			}
+			return a, nil
+		},
+	})
+}
+
+// settings are the backend parameters other than the DSN and
+// compression, which are passed as they are
+type settings struct {
+	blockSize int
+	migrate   bool
+	rollups   bool
+	cluster   Cluster
+}
+
+func parseSettings(opts storage.Options) (settings, error) {
+	st := settings{migrate: true}
+
+	var err error
+	if bs := opts.Param("block_size"); bs != "" {
+		st.blockSize, err = strconv.Atoi(bs)
+		if err != nil {
+			return st, fmt.Errorf("ch_block_size: %w", err)
+		}
 	}
+	if m := opts.Param("migrate"); m != "" {
+		st.migrate, err = strconv.ParseBool(m)
+		if err != nil {
+			return st, fmt.Errorf("ch_migrate: %w", err)
+		}
+	}
+	if r := opts.Param("rollups"); r != "" {
+		st.rollups, err = strconv.ParseBool(r)
+		if err != nil {
+			return st, fmt.Errorf("ch_rollups: %w", err)
+		}
+	}
+
+	st.cluster = Cluster{Name: opts.Param("cluster"), ShardingKey: opts.Param("sharding_key")}
+	switch insert := opts.Param("insert"); insert {
+	case "", "distributed":
+	case "shards":
+		st.cluster.InsertShards = true
+	default:
+		return st, fmt.Errorf("unknown ch_insert %q, must be distributed or shards", insert)
+	}
+
+	return st, nil
+}
 
-	connect, err := sql.Open("clickhouse", dsn)
+// NewArchiver returns an archiver that stores data in ClickHouse.
+// A zero batch size or block size uses the defaults; the compression
+// is lz4 unless it's set here or in the DSN. With migrate the pending
+// schema migrations are applied, except the ones for the rollup
+// tables, which are only applied by Migrate. The tables are created on
+// the cluster if it has a name.
+func NewArchiver(ctx context.Context, dsn string, batch config.BatchSize, blockSize int, compression string, migrate, rollups bool, cluster Cluster) (storage.Archiver, error) {
+	if blockSize < 0 {
+		return nil, fmt.Errorf("ch_block_size can't be negative")
+	}
+
+	a, err := Connect(ctx, dsn, compression, rollups, cluster)
 	if err != nil {
 		return nil, err
 	}
-	if err := connect.Ping(); err != nil {
-		if exception, ok := err.(*clickhouse.Exception); ok {
-			return nil, fmt.Errorf("[%d] %s \n%s", exception.Code, exception.Message, exception.StackTrace)
+	a.batch = batch
+	a.blockSize = blockSize
+
+	if migrate {
+		// the rollup tables are only created by the migrate command
+		if _, err := a.migrate(ctx, false); err != nil {
+			a.Close()
+			return nil, err
+		}
+	}
+
+	engine, err := a.Engine(ctx)
+	if err != nil {
+		a.Close()
+		if !migrate {
+			return nil, fmt.Errorf("%w (ch_migrate is off, run archiver migrate)", err)
 		}
 		return nil, err
 	}
+	if !strings.Contains(engine, "ReplacingMergeTree") {
+		log.Printf("%s is a %s table, rows stored again in different blocks after an error will be duplicated; see ch-dedupe-check", a.schema.local("log_scores"), engine)
+	}
 
-	_, err = connect.Exec(`
-	CREATE TABLE IF NOT EXISTS log_scores (
-		dt          Date,
-		id 		    UInt64,
-		monitor_id  UInt32,
-		server_id   UInt32,
-		ts	        DateTime,
-		score		Float32,
-		step 		Float32,
-		offset 		Nullable(Float64),
-		rtt			Nullable(UInt32),
-		leap 		Nullable(UInt8),
-		warning	    Nullable(String),
-		error       Nullable(String)
-	) engine=MergeTree
-	PARTITION BY dt
-	ORDER BY (server_id, ts)
-`)
+	if a.insertShards {
+		a.shards, err = a.openShards(ctx)
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		return a, nil
+	}
+
+	conn, err := clickhouse.Open(a.options)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+
+	a.conn = conn
+
+	return a, nil
+}
+
+// Connect returns an archiver connected to ClickHouse that doesn't
+// apply the migrations or check the log_scores table, for the migrate
+// and ch-dedupe-check commands. It can't store log scores.
+func Connect(ctx context.Context, dsn string, compression string, rollups bool, cluster Cluster) (*CHArchiver, error) {
+	a := &CHArchiver{rollups: rollups, insertShards: cluster.InsertShards}
+
+	if len(dsn) == 0 {
+		return nil, fmt.Errorf("ch_dsn environment not set")
+	}
+
+	var err error
+	a.schema, err = cluster.schema()
+	if err != nil {
+		return nil, err
+	}
+	a.migrations = a.schema.migrations()
+
+	options, err := clickhouse.ParseDSN(dsn)
 	if err != nil {
 		return nil, err
 	}
+	switch compression {
+	case "":
+		if options.Compression == nil {
+			options.Compression = &clickhouse.Compression{Method: clickhouse.CompressionLZ4}
+		}
+	case "lz4":
+		options.Compression = &clickhouse.Compression{Method: clickhouse.CompressionLZ4}
+	case "zstd":
+		options.Compression = &clickhouse.Compression{Method: clickhouse.CompressionZSTD, Level: 3}
+	case "none":
+		options.Compression = &clickhouse.Compression{Method: clickhouse.CompressionNone}
+	default:
+		return nil, fmt.Errorf("unknown ch_compression %q, must be lz4, zstd or none", compression)
+	}
+	a.options = options
+
+	connect := clickhouse.OpenDB(options)
+	if err := connect.PingContext(ctx); err != nil {
+		connect.Close()
+		if exception, ok := err.(*clickhouse.Exception); ok {
+			return nil, fmt.Errorf("[%d] %s \n%s", exception.Code, exception.Message, exception.StackTrace)
+		}
+		return nil, err
+	}
 
 	a.connect = connect
 
@@ -67,79 +244,329 @@ func NewArchiver() (storage.Archiver, error) {
 
 // BatchSizeMinMaxTime returns the minimum and maximum batch size
 func (a *CHArchiver) BatchSizeMinMaxTime() (int, int, time.Duration) {
-	// inserting data in "real time" is fine according to
-	// https://clickhouse.yandex/docs/en/query_language/insert_into/
-	// it's just after to do bigger batches, so do up to 500k at once
-	return 50, 500000, time.Millisecond * 0
+	bs := a.batch
+	if bs.MaxSize == 0 {
+		bs = defaultBatch
+	}
+	return bs.MinSize, bs.MaxSize, bs.Interval
 }
 
 // Store sends metrics to ClickHouse
-func (a *CHArchiver) Store(logscores []*logscore.LogScore) (int, error) {
-	connect := a.connect
+func (a *CHArchiver) Store(ctx context.Context, logscores []*logscore.LogScore) (int, error) {
+	return a.StoreStream(ctx, storage.Stream(logscores))
+}
 
-	tx, err := connect.Begin()
-	if err != nil {
+// StoreStream sends metrics to ClickHouse as they are received on
+// the channel, with an insert for each block of blockSize ids (ids 0
+// to blockSize-1, blockSize to 2*blockSize-1 and so on). Each insert
+// has a deduplication token from its rows, so if the batch is stored
+// again (because the archive status couldn't be updated) ClickHouse
+// skips the blocks it already has, even if the batch now ends at
+// another id. If the batch fails or is cancelled the blocks already
+// inserted stay in the table; this is the exception the StreamArchiver
+// contract allows for idempotent archivers.
+//
+// Only a block that's stored again with other rows, the last block of
+// a batch that now ends later, gets a new token; its rows that were
+// already inserted are duplicated until they are merged away by the
+// ReplacingMergeTree (or read with FINAL), and they are counted again
+// in the rollup tables.
+func (a *CHArchiver) StoreStream(ctx context.Context, logscores <-chan *logscore.LogScore) (int, error) {
+	blockSize := a.blockSize
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+
+	block := newColumns(blockSize)
+
+	i := 0
+	for l := range logscores {
+		if block.rows() > 0 && block.id[0]/uint64(blockSize) != uint64(l.ID)/uint64(blockSize) {
+			if err := a.insert(ctx, block); err != nil {
+				log.Printf("insert error after %d rows: %s", i-block.rows(), err)
+				return 0, err
+			}
+			block.reset()
+		}
+
+		block.add(l)
+		i++
+	}
+
+	// don't send the last block of a cancelled batch
+	if err := ctx.Err(); err != nil {
 		return 0, err
 	}
-	defer tx.Rollback() // Ensure transaction is cleaned up on any error
 
-	stmt, err := tx.Prepare(`
-		INSERT INTO log_scores
-			(dt, id, server_id, monitor_id, ts, score, step, offset, rtt, leap, error)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
-	if err != nil {
+	if err := a.insert(ctx, block); err != nil {
+		log.Printf("insert error after %d rows: %s", i-block.rows(), err)
 		return 0, err
 	}
-	defer stmt.Close()
 
-	i := 0
-	for _, l := range logscores {
-		// date := clickhouse.Date(time.Unix(l.Ts, 0).In(time.UTC))
+	return i, nil
+}
 
-		var leap *uint8
-		if l.Meta.Leap != 0 {
-			leap = &l.Meta.Leap
-		}
+// insert sends the block as a native insert, or with ch_insert=shards
+// the rows for each shard to its local table
+func (a *CHArchiver) insert(ctx context.Context, block *columns) error {
+	if block.rows() == 0 {
+		return nil
+	}
 
-		var lsError sql.NullString
-		if len(l.Meta.Error) > 0 {
-			lsError = sql.NullString{String: l.Meta.Error, Valid: true}
+	if a.shards != nil {
+		table := a.schema.local("log_scores")
+		for i, part := range a.shards.split(block) {
+			if part.rows() == 0 {
+				continue
+			}
+			if err := a.send(ctx, a.shards.conns[i], table, part); err != nil {
+				return fmt.Errorf("shard %d: %w", a.shards.nums[i], err)
+			}
 		}
+		return nil
+	}
 
-		ts := time.Unix(l.Ts, 0)
-		id := uint64(l.ID)
+	return a.send(ctx, a.conn, "log_scores", block)
+}
 
-		var rtt *uint32
-		if l.RTT != nil {
-			urtt := uint32(*l.RTT)
-			rtt = &urtt
-		}
+// send inserts the block into the table
+func (a *CHArchiver) send(ctx context.Context, conn batchConn, table string, block *columns) error {
+	settings := clickhouse.Settings{
+		"insert_deduplication_token": block.dedupToken(),
+		// so a block skipped as a duplicate isn't counted again in
+		// the rollup tables
+		"deduplicate_blocks_in_dependent_materialized_views": 1,
+	}
 
-		_, err := stmt.Exec(
-			ts,
-			id,
-			uint32(l.ServerID), uint32(l.MonitorID),
-			ts,
-			float32(l.Score), float32(l.Step),
-			l.Offset, rtt,
-			leap, lsError,
-		)
-		if err != nil {
-			log.Printf("insert error for %+v: %s", l, err)
-			return 0, err
-		}
-		i++
+	// on a cluster the rows go through the Distributed table, so each
+	// row is on the shard for its sharding key and a block stored again
+	// reaches the same shard to be deduplicated; return when the rows
+	// are on the shards, not just queued on this node
+	if table == "log_scores" && len(a.schema.Cluster) > 0 {
+		settings["insert_distributed_sync"] = 1
 	}
-	err = tx.Commit()
+
+	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(settings))
+
+	batch, err := conn.PrepareBatch(ctx, `
+		INSERT INTO `+table+`
+			(dt, id, server_id, monitor_id, ts, score, step, offset, rtt, leap, error)`)
 	if err != nil {
-		return 0, err
+		return err
 	}
+	defer func() {
+		if !batch.IsSent() {
+			batch.Abort()
+		}
+	}()
 
-	return i, nil
+	if err := block.appendTo(batch); err != nil {
+		return err
+	}
+	return batch.Send()
+}
+
+// columns collects a block of log scores a column at a time, in the
+// order of the insert statement
+type columns struct {
+	dt        []time.Time
+	id        []uint64
+	serverID  []uint32
+	monitorID []uint32
+	ts        []time.Time
+	score     []float32
+	step      []float32
+	offset    []*float64
+	rtt       []*uint32
+	leap      []*uint8
+	error     []*string
+}
+
+func newColumns(size int) *columns {
+	return &columns{
+		dt:        make([]time.Time, 0, size),
+		id:        make([]uint64, 0, size),
+		serverID:  make([]uint32, 0, size),
+		monitorID: make([]uint32, 0, size),
+		ts:        make([]time.Time, 0, size),
+		score:     make([]float32, 0, size),
+		step:      make([]float32, 0, size),
+		offset:    make([]*float64, 0, size),
+		rtt:       make([]*uint32, 0, size),
+		leap:      make([]*uint8, 0, size),
+		error:     make([]*string, 0, size),
+	}
+}
+
+func (c *columns) add(l *logscore.LogScore) {
+	ts := time.Unix(l.Ts, 0)
+
+	var rtt *uint32
+	if l.RTT != nil {
+		urtt := uint32(*l.RTT)
+		rtt = &urtt
+	}
+
+	var leap *uint8
+	if l.Meta.Leap != 0 {
+		leap = &l.Meta.Leap
+	}
+
+	var lsError *string
+	if len(l.Meta.Error) > 0 {
+		lsError = &l.Meta.Error
+	}
+
+	c.dt = append(c.dt, ts)
+	c.id = append(c.id, uint64(l.ID))
+	c.serverID = append(c.serverID, uint32(l.ServerID))
+	c.monitorID = append(c.monitorID, uint32(l.MonitorID))
+	c.ts = append(c.ts, ts)
+	c.score = append(c.score, float32(l.Score))
+	c.step = append(c.step, float32(l.Step))
+	c.offset = append(c.offset, l.Offset)
+	c.rtt = append(c.rtt, rtt)
+	c.leap = append(c.leap, leap)
+	c.error = append(c.error, lsError)
+}
+
+// addRow adds row i of the other columns
+func (c *columns) addRow(from *columns, i int) {
+	c.dt = append(c.dt, from.dt[i])
+	c.id = append(c.id, from.id[i])
+	c.serverID = append(c.serverID, from.serverID[i])
+	c.monitorID = append(c.monitorID, from.monitorID[i])
+	c.ts = append(c.ts, from.ts[i])
+	c.score = append(c.score, from.score[i])
+	c.step = append(c.step, from.step[i])
+	c.offset = append(c.offset, from.offset[i])
+	c.rtt = append(c.rtt, from.rtt[i])
+	c.leap = append(c.leap, from.leap[i])
+	c.error = append(c.error, from.error[i])
+}
+
+func (c *columns) rows() int {
+	return len(c.id)
+}
+
+// dedupToken identifies the block by its id range and row count; the
+// same rows get the same token when they are stored again
+func (c *columns) dedupToken() string {
+	return fmt.Sprintf("log_scores:%d-%d:%d", c.id[0], c.id[len(c.id)-1], len(c.id))
+}
+
+// appendTo adds the columns to the batch
+func (c *columns) appendTo(batch driver.Batch) error {
+	if c.rows() == 0 {
+		return nil
+	}
+	for i, col := range []any{
+		c.dt, c.id, c.serverID, c.monitorID, c.ts,
+		c.score, c.step, c.offset, c.rtt, c.leap, c.error,
+	} {
+		if err := batch.Column(i).Append(col); err != nil {
+			return fmt.Errorf("append column %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (c *columns) reset() {
+	c.dt = c.dt[:0]
+	c.id = c.id[:0]
+	c.serverID = c.serverID[:0]
+	c.monitorID = c.monitorID[:0]
+	c.ts = c.ts[:0]
+	c.score = c.score[:0]
+	c.step = c.step[:0]
+	c.offset = c.offset[:0]
+	c.rtt = c.rtt[:0]
+	c.leap = c.leap[:0]
+	c.error = c.error[:0]
 }
 
 // Close finishes up the archiver
 func (a *CHArchiver) Close() error {
+	if a.conn != nil {
+		a.conn.Close()
+	}
+	if a.shards != nil {
+		a.shards.Close()
+	}
 	a.connect.Close()
 	return nil
 }
+
+// VerifyRange is for the Verifier interface; it counts the distinct
+// ids in the range in the log_scores table
+func (a *CHArchiver) VerifyRange(ctx context.Context, firstID, lastID, count int64) error {
+	var found uint64
+	err := a.connect.QueryRowContext(ctx,
+		"select uniqExact(id) from log_scores where id between ? and ?",
+		firstID, lastID,
+	).Scan(&found)
+	if err != nil {
+		return fmt.Errorf("verify query: %s", err)
+	}
+
+	return storage.VerifyCount(firstID, lastID, count, int64(found))
+}
+
+// Engine returns the table engine of the log_scores table, or on a
+// cluster of the local table on the node the DSN connects to
+func (a *CHArchiver) Engine(ctx context.Context) (string, error) {
+	table := a.schema.local("log_scores")
+
+	var engine string
+	err := a.connect.QueryRowContext(ctx,
+		"select engine from system.tables where database = currentDatabase() and name = ?", table,
+	).Scan(&engine)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("table %s doesn't exist", table)
+	}
+	if err != nil {
+		return "", fmt.Errorf("table engine: %s", err)
+	}
+	return engine, nil
+}
+
+// Duplicates is the number of rows with an id that's already in the
+// table, for a log_scores partition
+type Duplicates struct {
+	Date       time.Time
+	Rows       uint64
+	Duplicates uint64
+}
+
+// Duplicates returns the partitions of the log_scores table that have
+// rows with the same id, from the date since (if it's not zero). With
+// a ReplacingMergeTree table they are removed by the background merges.
+func (a *CHArchiver) Duplicates(ctx context.Context, since time.Time) ([]Duplicates, error) {
+	if since.IsZero() {
+		since = time.Unix(0, 0)
+	}
+
+	rows, err := a.connect.QueryContext(ctx,
+		`select dt, count() as rows, count() - uniqExact(id) as duplicates
+		from log_scores
+		where dt >= ?
+		group by dt
+		having duplicates > 0
+		order by dt`,
+		since.UTC().Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("duplicates query: %s", err)
+	}
+	defer rows.Close()
+
+	dups := []Duplicates{}
+	for rows.Next() {
+		var d Duplicates
+		if err := rows.Scan(&d.Date, &d.Rows, &d.Duplicates); err != nil {
+			return nil, err
+		}
+		dups = append(dups, d)
+	}
+	return dups, rows.Err()
+}
@@ -1,15 +1,21 @@
 package clickhouse
 
 import (
+	"context"
 	"database/sql"
-	"os"
+	"errors"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2/lib/column"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.ntppool.org/archiver/config"
 	"go.ntppool.org/archiver/logscore"
+	"go.ntppool.org/archiver/storage"
 )
 
 func TestBatchSizeMinMaxTime(t *testing.T) {
@@ -20,108 +26,146 @@ func TestBatchSizeMinMaxTime(t *testing.T) {
 	assert.Equal(t, time.Millisecond*0, interval)
 }
 
-func TestNewArchiverMissingDSN(t *testing.T) {
-	// Test with missing ch_dsn environment variable
-	// Save and restore original env
-	originalDSN := os.Getenv("ch_dsn")
-	os.Setenv("ch_dsn", "")
-	defer os.Setenv("ch_dsn", originalDSN)
+func TestBatchSizeConfigured(t *testing.T) {
+	archiver := &CHArchiver{batch: config.BatchSize{MinSize: 1000, MaxSize: 100000, Interval: time.Minute}}
+	minSize, maxSize, interval := archiver.BatchSizeMinMaxTime()
+	assert.Equal(t, 1000, minSize)
+	assert.Equal(t, 100000, maxSize)
+	assert.Equal(t, time.Minute, interval)
+}
 
-	archiver, err := NewArchiver()
+func TestNewArchiverMissingDSN(t *testing.T) {
+	// Test with missing ch_dsn setting
+	archiver, err := NewArchiver(context.Background(), "", config.BatchSize{}, 0, "", false, false, Cluster{})
 	assert.Error(t, err)
 	assert.Nil(t, archiver)
 	assert.Contains(t, err.Error(), "ch_dsn environment not set")
+
+	_, err = Connect(context.Background(), "", "", false, Cluster{})
+	assert.ErrorContains(t, err, "ch_dsn environment not set")
 }
 
-func TestStore(t *testing.T) {
-	// Create a mock database
-	db, mock, err := sqlmock.New()
-	require.NoError(t, err)
-	defer db.Close()
+// fakeConn records the native batches
+type fakeConn struct {
+	batches    []*fakeBatch
+	prepareErr error
+	sendErr    error
+	failFrom   int // the first batch that fails with sendErr
+}
 
-	archiver := &CHArchiver{connect: db}
+func (c *fakeConn) PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	if c.prepareErr != nil {
+		return nil, c.prepareErr
+	}
+	b := &fakeBatch{conn: c, query: query, columns: make([][]any, 11)}
+	c.batches = append(c.batches, b)
+	return b, nil
+}
 
-	t.Run("empty logscores", func(t *testing.T) {
-		// ClickHouse Store still begins transaction even for empty slice
-		mock.ExpectBegin()
-		mock.ExpectPrepare("INSERT INTO log_scores")
-		mock.ExpectCommit()
+func (c *fakeConn) Close() error {
+	return nil
+}
 
-		count, err := archiver.Store([]*logscore.LogScore{})
-		assert.NoError(t, err)
-		assert.Equal(t, 0, count)
-	})
+// fakeBatch keeps the columns appended to the batch
+type fakeBatch struct {
+	conn    *fakeConn
+	query   string
+	columns [][]any
+	sent    bool
+	aborted bool
+}
 
-	t.Run("single logscore", func(t *testing.T) {
-		// Mock transaction and prepare
-		mock.ExpectBegin()
-		mock.ExpectPrepare("INSERT INTO log_scores")
-
-		// Mock the exec call
-		mock.ExpectExec("INSERT INTO log_scores").
-			WithArgs(
-				sqlmock.AnyArg(),                         // dt (time)
-				uint64(123),                              // id
-				uint32(20),                               // server_id
-				uint32(10),                               // monitor_id
-				sqlmock.AnyArg(),                         // ts (time)
-				float32(15.5),                            // score
-				float32(0.1),                             // step
-				nil,                                      // offset (null)
-				nil,                                      // rtt (null)
-				nil,                                      // leap (null)
-				sql.NullString{String: "", Valid: false}, // error (null)
-			).
-			WillReturnResult(sqlmock.NewResult(1, 1))
-
-		mock.ExpectCommit()
+func (b *fakeBatch) Abort() error {
+	b.aborted = true
+	return nil
+}
 
-		logscores := []*logscore.LogScore{
-			{
-				ID:        123,
-				ServerID:  20,
-				MonitorID: 10,
-				Ts:        1640995200,
-				Score:     15.5,
-				Step:      0.1,
-				Offset:    nil,
-				RTT:       nil,
-				Meta:      logscore.LogScoreMetadata{},
-			},
+func (b *fakeBatch) Append(v ...any) error       { return errors.New("not implemented") }
+func (b *fakeBatch) AppendStruct(v any) error    { return errors.New("not implemented") }
+func (b *fakeBatch) Columns() []column.Interface { return nil }
+func (b *fakeBatch) Close() error                { return nil }
+func (b *fakeBatch) IsSent() bool                { return b.sent }
+
+func (b *fakeBatch) Rows() int {
+	return len(b.columns[1])
+}
+
+func (b *fakeBatch) Column(i int) driver.BatchColumn {
+	return fakeColumn{b, i}
+}
+
+func (b *fakeBatch) Flush() error { return errors.New("not implemented") }
+
+func (b *fakeBatch) Send() error {
+	b.sent = true
+	if len(b.conn.batches) > b.conn.failFrom {
+		return b.conn.sendErr
+	}
+	return nil
+}
+
+// ids returns the id column of each batch that was sent
+func (c *fakeConn) ids() [][]uint64 {
+	ids := [][]uint64{}
+	for _, b := range c.batches {
+		if !b.sent {
+			continue
+		}
+		col := []uint64{}
+		for _, v := range b.columns[1] {
+			col = append(col, v.(uint64))
 		}
+		ids = append(ids, col)
+	}
+	return ids
+}
+
+type fakeColumn struct {
+	batch *fakeBatch
+	idx   int
+}
+
+func (c fakeColumn) Append(v any) error {
+	rv := reflect.ValueOf(v)
+	for i := 0; i < rv.Len(); i++ {
+		c.batch.columns[c.idx] = append(c.batch.columns[c.idx], rv.Index(i).Interface())
+	}
+	return nil
+}
+
+func (c fakeColumn) AppendRow(v any) error {
+	c.batch.columns[c.idx] = append(c.batch.columns[c.idx], v)
+	return nil
+}
+
+func testLogScores(ids ...int64) []*logscore.LogScore {
+	logscores := []*logscore.LogScore{}
+	for _, id := range ids {
+		logscores = append(logscores, &logscore.LogScore{
+			ID: id, ServerID: 20, MonitorID: 10, Ts: 1640995200 + id, Score: 15.5, Step: 0.1,
+		})
+	}
+	return logscores
+}
+
+func TestStore(t *testing.T) {
+	t.Run("empty logscores", func(t *testing.T) {
+		conn := &fakeConn{}
+		archiver := &CHArchiver{conn: conn}
 
-		count, err := archiver.Store(logscores)
+		count, err := archiver.Store(context.Background(), []*logscore.LogScore{})
 		assert.NoError(t, err)
-		assert.Equal(t, 1, count)
+		assert.Equal(t, 0, count)
+		assert.Empty(t, conn.batches)
 	})
 
 	t.Run("logscore with all fields", func(t *testing.T) {
-		// Mock transaction and prepare
-		mock.ExpectBegin()
-		mock.ExpectPrepare("INSERT INTO log_scores")
+		conn := &fakeConn{}
+		archiver := &CHArchiver{conn: conn}
 
 		offset := 0.05
 		rtt := int64(150)
 
-		// Mock the exec call with all fields populated
-		mock.ExpectExec("INSERT INTO log_scores").
-			WithArgs(
-				sqlmock.AnyArg(), // dt (time)
-				uint64(124),      // id
-				uint32(21),       // server_id
-				uint32(11),       // monitor_id
-				sqlmock.AnyArg(), // ts (time)
-				float32(16.0),    // score
-				float32(0.2),     // step
-				&offset,          // offset
-				sqlmock.AnyArg(), // rtt (uint32 pointer)
-				sqlmock.AnyArg(), // leap (uint8 pointer)
-				sql.NullString{String: "test error", Valid: true}, // error
-			).
-			WillReturnResult(sqlmock.NewResult(1, 1))
-
-		mock.ExpectCommit()
-
 		logscores := []*logscore.LogScore{
 			{
 				ID:        124,
@@ -137,196 +181,135 @@ func TestStore(t *testing.T) {
 					Error: "test error",
 				},
 			},
+			{ID: 125, ServerID: 22, MonitorID: 12, Ts: 1640995320, Score: 17.0, Step: 0.3},
 		}
 
-		count, err := archiver.Store(logscores)
-		assert.NoError(t, err)
-		assert.Equal(t, 1, count)
-	})
+		count, err := archiver.Store(context.Background(), logscores)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
 
-	t.Run("multiple logscores", func(t *testing.T) {
-		// Mock transaction and prepare
-		mock.ExpectBegin()
-		mock.ExpectPrepare("INSERT INTO log_scores")
-
-		// Mock first exec
-		mock.ExpectExec("INSERT INTO log_scores").
-			WithArgs(
-				sqlmock.AnyArg(),                         // dt
-				uint64(125),                              // id
-				uint32(22),                               // server_id
-				uint32(12),                               // monitor_id
-				sqlmock.AnyArg(),                         // ts
-				float32(17.0),                            // score
-				float32(0.3),                             // step
-				nil,                                      // offset
-				nil,                                      // rtt
-				nil,                                      // leap
-				sql.NullString{String: "", Valid: false}, // error
-			).
-			WillReturnResult(sqlmock.NewResult(1, 1))
-
-		// Mock second exec
-		mock.ExpectExec("INSERT INTO log_scores").
-			WithArgs(
-				sqlmock.AnyArg(),                         // dt
-				uint64(126),                              // id
-				uint32(23),                               // server_id
-				uint32(13),                               // monitor_id
-				sqlmock.AnyArg(),                         // ts
-				float32(18.0),                            // score
-				float32(0.4),                             // step
-				nil,                                      // offset
-				nil,                                      // rtt
-				nil,                                      // leap
-				sql.NullString{String: "", Valid: false}, // error
-			).
-			WillReturnResult(sqlmock.NewResult(1, 1))
-
-		mock.ExpectCommit()
+		require.Len(t, conn.batches, 1)
+		b := conn.batches[0]
+		assert.Contains(t, b.query, "INSERT INTO log_scores")
+		assert.True(t, b.sent)
 
-		logscores := []*logscore.LogScore{
-			{
-				ID:        125,
-				ServerID:  22,
-				MonitorID: 12,
-				Ts:        1640995320,
-				Score:     17.0,
-				Step:      0.3,
-				Offset:    nil,
-				RTT:       nil,
-				Meta:      logscore.LogScoreMetadata{},
-			},
-			{
-				ID:        126,
-				ServerID:  23,
-				MonitorID: 13,
-				Ts:        1640995380,
-				Score:     18.0,
-				Step:      0.4,
-				Offset:    nil,
-				RTT:       nil,
-				Meta:      logscore.LogScoreMetadata{},
-			},
+		ts := time.Unix(1640995260, 0)
+		row := []any{}
+		for _, col := range b.columns {
+			require.Len(t, col, 2)
+			row = append(row, col[0])
+		}
+		assert.Equal(t, ts, row[0])
+		assert.Equal(t, uint64(124), row[1])
+		assert.Equal(t, uint32(21), row[2])
+		assert.Equal(t, uint32(11), row[3])
+		assert.Equal(t, ts, row[4])
+		assert.Equal(t, float32(16.0), row[5])
+		assert.Equal(t, float32(0.2), row[6])
+		assert.Equal(t, &offset, row[7])
+		assert.Equal(t, uint32(150), *row[8].(*uint32))
+		assert.Equal(t, uint8(1), *row[9].(*uint8))
+		assert.Equal(t, "test error", *row[10].(*string))
+
+		// the nullable columns are NULL for the second row
+		for _, i := range []int{7, 8, 9, 10} {
+			assert.Nil(t, b.columns[i][1], "column %d", i)
 		}
-
-		count, err := archiver.Store(logscores)
-		assert.NoError(t, err)
-		assert.Equal(t, 2, count)
 	})
 
-	assert.NoError(t, mock.ExpectationsWereMet())
-}
+	t.Run("blocks", func(t *testing.T) {
+		conn := &fakeConn{}
+		archiver := &CHArchiver{conn: conn, blockSize: 2}
 
-func TestStoreErrors(t *testing.T) {
-	// Create a mock database
-	db, mock, err := sqlmock.New()
-	require.NoError(t, err)
-	defer db.Close()
+		count, err := archiver.Store(context.Background(), testLogScores(1, 2, 3, 4, 5))
+		require.NoError(t, err)
+		assert.Equal(t, 5, count)
 
-	archiver := &CHArchiver{connect: db}
+		// an insert for each block of ids
+		assert.Equal(t, [][]uint64{{1}, {2, 3}, {4, 5}}, conn.ids())
+	})
 
-	t.Run("begin transaction error", func(t *testing.T) {
-		mock.ExpectBegin().WillReturnError(sql.ErrConnDone)
+	t.Run("stored again", func(t *testing.T) {
+		conn := &fakeConn{}
+		archiver := &CHArchiver{conn: conn, blockSize: 2}
 
-		logscores := []*logscore.LogScore{
-			{
-				ID:        123,
-				ServerID:  20,
-				MonitorID: 10,
-				Ts:        1640995200,
-				Score:     15.5,
-				Step:      0.1,
-			},
-		}
+		_, err := archiver.Store(context.Background(), testLogScores(1, 2, 3, 4, 5, 6))
+		require.NoError(t, err)
+		_, err = archiver.Store(context.Background(), testLogScores(1, 2, 3, 4, 5, 6, 7, 8))
+		require.NoError(t, err)
 
-		count, err := archiver.Store(logscores)
-		assert.Error(t, err)
-		assert.Equal(t, 0, count)
-		assert.Equal(t, sql.ErrConnDone, err)
+		// the blocks are the same, so they get the same tokens, except
+		// the last block of the first batch that now has more rows
+		ids := conn.ids()
+		assert.Equal(t, [][]uint64{{1}, {2, 3}, {4, 5}, {6}}, ids[:4])
+		assert.Equal(t, [][]uint64{{1}, {2, 3}, {4, 5}, {6, 7}, {8}}, ids[4:])
 	})
+}
 
-	t.Run("prepare statement error", func(t *testing.T) {
-		mock.ExpectBegin()
-		mock.ExpectPrepare("INSERT INTO log_scores").WillReturnError(sql.ErrConnDone)
-		mock.ExpectRollback()
-
-		logscores := []*logscore.LogScore{
-			{
-				ID:        123,
-				ServerID:  20,
-				MonitorID: 10,
-				Ts:        1640995200,
-				Score:     15.5,
-				Step:      0.1,
-			},
-		}
+func TestStoreErrors(t *testing.T) {
+	t.Run("prepare batch error", func(t *testing.T) {
+		conn := &fakeConn{prepareErr: sql.ErrConnDone}
+		archiver := &CHArchiver{conn: conn}
 
-		count, err := archiver.Store(logscores)
-		assert.Error(t, err)
-		assert.Equal(t, 0, count)
+		count, err := archiver.Store(context.Background(), testLogScores(123))
 		assert.Equal(t, sql.ErrConnDone, err)
+		assert.Equal(t, 0, count)
 	})
 
-	t.Run("exec error", func(t *testing.T) {
-		mock.ExpectBegin()
-		mock.ExpectPrepare("INSERT INTO log_scores")
+	t.Run("send error", func(t *testing.T) {
+		conn := &fakeConn{sendErr: sql.ErrTxDone}
+		archiver := &CHArchiver{conn: conn}
 
-		mock.ExpectExec("INSERT INTO log_scores").
-			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
-				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
-				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
-			WillReturnError(sql.ErrConnDone)
+		count, err := archiver.Store(context.Background(), testLogScores(123))
+		assert.Equal(t, sql.ErrTxDone, err)
+		assert.Equal(t, 0, count)
+	})
 
-		mock.ExpectRollback()
+	t.Run("error after the first block", func(t *testing.T) {
+		conn := &fakeConn{sendErr: sql.ErrConnDone, failFrom: 1}
+		archiver := &CHArchiver{conn: conn, blockSize: 2}
 
-		logscores := []*logscore.LogScore{
-			{
-				ID:        123,
-				ServerID:  20,
-				MonitorID: 10,
-				Ts:        1640995200,
-				Score:     15.5,
-				Step:      0.1,
-			},
-		}
-
-		count, err := archiver.Store(logscores)
-		assert.Error(t, err)
-		assert.Equal(t, 0, count)
+		count, err := archiver.Store(context.Background(), testLogScores(1, 2, 3, 4, 5))
 		assert.Equal(t, sql.ErrConnDone, err)
+		assert.Equal(t, 0, count)
+
+		// the first block stays in the table and nothing is sent
+		// after the failed block
+		require.Len(t, conn.batches, 2)
+		assert.Equal(t, [][]uint64{{1}, {2, 3}}, conn.ids())
 	})
+}
 
-	t.Run("commit error", func(t *testing.T) {
-		mock.ExpectBegin()
-		mock.ExpectPrepare("INSERT INTO log_scores")
+func TestDedupToken(t *testing.T) {
+	block := newColumns(3)
+	for _, ls := range testLogScores(100, 101, 105) {
+		block.add(ls)
+	}
+	assert.Equal(t, "log_scores:100-105:3", block.dedupToken())
 
-		mock.ExpectExec("INSERT INTO log_scores").
-			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
-				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
-				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
-			WillReturnResult(sqlmock.NewResult(1, 1))
+	// the same rows stored again get the same token
+	again := newColumns(3)
+	for _, ls := range testLogScores(100, 101, 105) {
+		again.add(ls)
+	}
+	assert.Equal(t, block.dedupToken(), again.dedupToken())
 
-		mock.ExpectCommit().WillReturnError(sql.ErrTxDone)
+	block.reset()
+	block.add(testLogScores(106)[0])
+	assert.Equal(t, "log_scores:106-106:1", block.dedupToken())
+}
 
-		logscores := []*logscore.LogScore{
-			{
-				ID:        123,
-				ServerID:  20,
-				MonitorID: 10,
-				Ts:        1640995200,
-				Score:     15.5,
-				Step:      0.1,
-			},
-		}
+func TestNewArchiverOptions(t *testing.T) {
+	_, err := NewArchiver(context.Background(), "clickhouse://localhost:9000/default", config.BatchSize{}, -1, "", false, false, Cluster{})
+	assert.ErrorContains(t, err, "ch_block_size")
 
-		count, err := archiver.Store(logscores)
-		assert.Error(t, err)
-		assert.Equal(t, 0, count)
-		assert.Equal(t, sql.ErrTxDone, err)
-	})
+	_, err = NewArchiver(context.Background(), "clickhouse://localhost:9000/default", config.BatchSize{}, 0, "gzip", false, false, Cluster{})
+	assert.ErrorContains(t, err, "unknown ch_compression")
 
-	assert.NoError(t, mock.ExpectationsWereMet())
+	_, err = Connect(context.Background(), "clickhouse://localhost:9000/default", "gzip", false, Cluster{})
+	assert.ErrorContains(t, err, "unknown ch_compression")
+	_, err = Connect(context.Background(), "clickhouse://localhost:9000/default", "", false, Cluster{ShardingKey: "id"})
+	assert.ErrorContains(t, err, "require ch_cluster")
 }
 
 func TestClose(t *testing.T) {
@@ -460,3 +443,87 @@ func TestDataTypeConversions(t *testing.T) {
 		})
 	}
 }
+
+func TestStoreCancelled(t *testing.T) {
+	conn := &fakeConn{}
+	archiver := &CHArchiver{conn: conn}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	count, err := archiver.Store(ctx, testLogScores(123))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, count)
+
+	// nothing was sent to the database
+	assert.Empty(t, conn.batches)
+}
+
+func TestVerifyRange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	archiver := &CHArchiver{connect: db}
+
+	mock.ExpectQuery("select uniqExact\\(id\\) from log_scores where id between").
+		WithArgs(int64(100), int64(200)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(uint64(101)))
+	assert.NoError(t, archiver.VerifyRange(context.Background(), 100, 200, 101))
+
+	mock.ExpectQuery("select uniqExact\\(id\\) from log_scores where id between").
+		WithArgs(int64(100), int64(200)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(uint64(90)))
+	err = archiver.VerifyRange(context.Background(), 100, 200, 101)
+	var verr *storage.VerifyError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, int64(90), verr.Found)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEngine(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	archiver := &CHArchiver{connect: db}
+
+	mock.ExpectQuery("select engine from system.tables").
+		WithArgs("log_scores").
+		WillReturnRows(sqlmock.NewRows([]string{"engine"}).AddRow("ReplacingMergeTree"))
+
+	engine, err := archiver.Engine(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ReplacingMergeTree", engine)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDuplicates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	archiver := &CHArchiver{connect: db}
+
+	day := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("(?s)select dt, count\\(\\) as rows, count\\(\\) - uniqExact\\(id\\) as duplicates.*having duplicates > 0").
+		WithArgs("2022-01-01").
+		WillReturnRows(sqlmock.NewRows([]string{"dt", "rows", "duplicates"}).
+			AddRow(day, uint64(1000), uint64(50)))
+
+	dups, err := archiver.Duplicates(context.Background(), time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, []Duplicates{{Date: day, Rows: 1000, Duplicates: 50}}, dups)
+
+	mock.ExpectQuery("select dt").
+		WithArgs("1970-01-01").
+		WillReturnRows(sqlmock.NewRows([]string{"dt", "rows", "duplicates"}))
+
+	dups, err = archiver.Duplicates(context.Background(), time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, dups)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,286 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+
+	"go.ntppool.org/archiver/storage"
+)
+
+// migration is a versioned change to the ClickHouse schema. The
+// statements are run in order; a migration that fails part way is
+// run again from the start, so they should be safe to repeat (IF NOT
+// EXISTS and so on).
+type migration struct {
+	Version    int
+	Name       string
+	Statements []string
+
+	// Rollup migrations are only applied with ch_rollups enabled, and
+	// only by the migrate command as they read all of log_scores
+	Rollup bool
+}
+
+// Variables replaced in the migration statements when they are run
+const (
+	// varIDCutoff is the highest id in log_scores, read when the first
+	// statement of the migration using it is run
+	varIDCutoff = "{id_cutoff}"
+
+	// varFinal is " FINAL" if log_scores is a ReplacingMergeTree, so
+	// the rows that haven't been merged are read once
+	varFinal = "{final}"
+)
+
+// migrations returns the migrations for the schema. They are applied
+// in order and recorded in schema_migrations; applied migrations must
+// not be changed, add a new one instead.
+func (s schema) migrations() []migration {
+	settings := ""
+	if len(s.Cluster) == 0 {
+		settings = "\n\tSETTINGS non_replicated_deduplication_window = 1000"
+	}
+
+	create := migration{
+		Version: 1,
+		Name:    "create log_scores",
+		Statements: []string{fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s%s (
+		dt          Date,
+		id 		    UInt64,
+		monitor_id  UInt32,
+		server_id   UInt32,
+		ts	        DateTime,
+		score		Float32,
+		step 		Float32,
+		offset 		Nullable(Float64),
+		rtt			Nullable(UInt32),
+		leap 		Nullable(UInt8),
+		warning	    Nullable(String),
+		error       Nullable(String)
+	) engine=%s
+	PARTITION BY dt
+	ORDER BY (server_id, ts, id)%s
+`, s.local("log_scores"), s.onCluster(), s.engine("ReplacingMergeTree"), settings)},
+	}
+	if len(s.Cluster) > 0 {
+		create.Statements = append(create.Statements, s.distributed("log_scores", s.ShardingKey))
+	}
+
+	// log_scores tables created before migrations were added are plain
+	// MergeTree tables without the setting, so the insert deduplication
+	// tokens were ignored
+	window := "non_replicated_deduplication_window"
+	if len(s.Cluster) > 0 {
+		window = "replicated_deduplication_window"
+	}
+	dedup := migration{
+		Version: 2,
+		Name:    "set log_scores deduplication window",
+		Statements: []string{fmt.Sprintf(
+			"ALTER TABLE %s%s MODIFY SETTING %s = 1000",
+			s.local("log_scores"), s.onCluster(), window,
+		)},
+	}
+
+	return []migration{
+		create,
+		dedup,
+		hourlyRollup.migration(3, s),
+		dailyRollup.migration(4, s),
+	}
+}
+
+// createMigrationsTable records the applied migrations
+func (s schema) createMigrationsTable() string {
+	return fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS schema_migrations%s (
+		version     UInt32,
+		name        String,
+		applied_at  DateTime DEFAULT now()
+	) engine=%s
+	ORDER BY version
+`, s.onCluster(), s.engine("MergeTree"))
+}
+
+// hasMigrationsTable returns true if schema_migrations exists on the
+// server the archiver is connected to
+func (a *CHArchiver) hasMigrationsTable(ctx context.Context) (bool, error) {
+	var count uint64
+	err := a.connect.QueryRowContext(ctx,
+		"select count() from system.tables where database = currentDatabase() and name = 'schema_migrations'",
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("schema_migrations: %s", err)
+	}
+	return count > 0, nil
+}
+
+// applied returns when each migration version was applied; none are
+// if schema_migrations hasn't been created yet
+func (a *CHArchiver) applied(ctx context.Context) (map[int]time.Time, error) {
+	ok, err := a.hasMigrationsTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return map[int]time.Time{}, nil
+	}
+	return a.readApplied(ctx)
+}
+
+// readApplied reads when each migration version was applied from
+// schema_migrations
+func (a *CHArchiver) readApplied(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := a.connect.QueryContext(ctx, fmt.Sprintf(
+		"select version, min(applied_at) from %s group by version", a.schema.migrationsTable()))
+	if err != nil {
+		return nil, fmt.Errorf("schema_migrations: %s", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version uint32
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[int(version)] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Migrations is for the storage.Migrator interface. Rollup migrations
+// are only listed if rollups are enabled or they have been applied.
+func (a *CHArchiver) Migrations(ctx context.Context) ([]storage.Migration, error) {
+	applied, err := a.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []storage.Migration{}
+	for _, m := range a.migrations {
+		if _, ok := applied[m.Version]; !ok && m.Rollup && !a.rollups {
+			continue
+		}
+		list = append(list, storage.Migration{
+			Version:   m.Version,
+			Name:      m.Name,
+			AppliedAt: applied[m.Version],
+		})
+	}
+	return list, nil
+}
+
+// Migrate is for the storage.Migrator interface; it runs the
+// migrations that aren't in schema_migrations yet, skipping the rollup
+// migrations unless rollups are enabled
+func (a *CHArchiver) Migrate(ctx context.Context) ([]storage.Migration, error) {
+	return a.migrate(ctx, a.rollups)
+}
+
+// migrate runs the pending migrations, including the rollup migrations
+// if rollups is set. schema_migrations is only created when it's
+// missing, as on a cluster that's a distributed DDL query which waits
+// for every host and fails if one of them is down.
+func (a *CHArchiver) migrate(ctx context.Context, rollups bool) ([]storage.Migration, error) {
+	ok, err := a.hasMigrationsTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if _, err := a.connect.ExecContext(ctx, a.schema.createMigrationsTable()); err != nil {
+			return nil, fmt.Errorf("schema_migrations: %s", err)
+		}
+	}
+
+	applied, err := a.readApplied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the rollup tables are filled with an insert through the
+	// Distributed table on a cluster, wait for it to reach the shards
+	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"insert_distributed_sync": 1,
+	}))
+
+	done := []storage.Migration{}
+
+	for _, m := range a.migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if m.Rollup && !rollups {
+			if a.rollups {
+				log.Printf("clickhouse migration %d (%s) is pending, run archiver migrate", m.Version, m.Name)
+			}
+			continue
+		}
+
+		log.Printf("applying clickhouse migration %d: %s", m.Version, m.Name)
+
+		vars := map[string]string{}
+		for _, stmt := range m.Statements {
+			query, err := a.expand(ctx, stmt, vars)
+			if err != nil {
+				return done, fmt.Errorf("migration %d (%s): %s", m.Version, m.Name, err)
+			}
+			if _, err := a.connect.ExecContext(ctx, query); err != nil {
+				return done, fmt.Errorf("migration %d (%s): %s", m.Version, m.Name, err)
+			}
+		}
+
+		_, err := a.connect.ExecContext(ctx,
+			"insert into schema_migrations (version, name) values (?, ?)",
+			uint32(m.Version), m.Name,
+		)
+		if err != nil {
+			return done, fmt.Errorf("record migration %d: %s", m.Version, err)
+		}
+
+		done = append(done, storage.Migration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()})
+	}
+
+	return done, nil
+}
+
+// expand replaces the variables in the statement. The values are
+// looked up the first time they're used and kept in vars for the
+// rest of the migration.
+func (a *CHArchiver) expand(ctx context.Context, stmt string, vars map[string]string) (string, error) {
+	if strings.Contains(stmt, varIDCutoff) {
+		if _, ok := vars[varIDCutoff]; !ok {
+			var cutoff uint64
+			err := a.connect.QueryRowContext(ctx, "select max(id) from log_scores").Scan(&cutoff)
+			if err != nil {
+				return "", fmt.Errorf("id cutoff: %s", err)
+			}
+			vars[varIDCutoff] = strconv.FormatUint(cutoff, 10)
+		}
+		stmt = strings.ReplaceAll(stmt, varIDCutoff, vars[varIDCutoff])
+	}
+
+	if strings.Contains(stmt, varFinal) {
+		if _, ok := vars[varFinal]; !ok {
+			engine, err := a.Engine(ctx)
+			if err != nil {
+				return "", err
+			}
+			vars[varFinal] = ""
+			if strings.Contains(engine, "ReplacingMergeTree") {
+				vars[varFinal] = " FINAL"
+			}
+		}
+		stmt = strings.ReplaceAll(stmt, varFinal, vars[varFinal])
+	}
+
+	return stmt, nil
+}
@@ -0,0 +1,239 @@
+package clickhouse
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testMigrations = []migration{
+	{Version: 1, Name: "create log_scores", Statements: []string{"CREATE TABLE IF NOT EXISTS log_scores"}},
+	{Version: 2, Name: "add column", Statements: []string{
+		"ALTER TABLE log_scores ADD COLUMN IF NOT EXISTS a String",
+		"ALTER TABLE log_scores ADD COLUMN IF NOT EXISTS b String",
+	}},
+	{Version: 3, Name: "add index", Rollup: true, Statements: []string{"ALTER TABLE log_scores ADD INDEX IF NOT EXISTS"}},
+}
+
+// expectMigrationsTable expects the check whether schema_migrations
+// exists
+func expectMigrationsTable(mock sqlmock.Sqlmock, exists bool) {
+	count := uint64(0)
+	if exists {
+		count = 1
+	}
+	mock.ExpectQuery("select count\\(\\) from system.tables").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func TestMigrationVersions(t *testing.T) {
+	for _, s := range []schema{{}, {Cluster: "ntp", ShardingKey: "server_id"}} {
+		for i, m := range s.migrations() {
+			assert.Equal(t, i+1, m.Version, "migration %q", m.Name)
+			assert.NotEmpty(t, m.Statements, "migration %d", m.Version)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	archiver := &CHArchiver{connect: db, rollups: true, migrations: testMigrations}
+
+	applied := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	expectMigrationsTable(mock, true)
+	mock.ExpectQuery("select version, min\\(applied_at\\) from schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(uint32(1), applied))
+
+	mock.ExpectExec("ADD COLUMN IF NOT EXISTS a").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ADD COLUMN IF NOT EXISTS b").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert into schema_migrations").
+		WithArgs(uint32(2), "add column").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("ADD INDEX").WillReturnError(assert.AnError)
+
+	done, err := archiver.Migrate(context.Background())
+	require.ErrorContains(t, err, "migration 3 (add index)")
+	require.Len(t, done, 1)
+	assert.Equal(t, 2, done[0].Version)
+	assert.True(t, done[0].Applied())
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// nothing is pending
+	expectMigrationsTable(mock, true)
+	mock.ExpectQuery("select version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).
+			AddRow(uint32(1), applied).AddRow(uint32(2), applied).AddRow(uint32(3), applied))
+
+	done, err = archiver.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, done)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateWithoutRollups(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	archiver := &CHArchiver{connect: db, migrations: testMigrations}
+
+	expectMigrationsTable(mock, true)
+	mock.ExpectQuery("select version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).
+			AddRow(uint32(1), time.Now()).AddRow(uint32(2), time.Now()))
+
+	done, err := archiver.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, done)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	archiver := &CHArchiver{connect: db, migrations: testMigrations}
+
+	applied := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	expectMigrationsTable(mock, true)
+	mock.ExpectQuery("select version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).
+			AddRow(uint32(1), applied).AddRow(uint32(2), applied))
+
+	list, err := archiver.Migrations(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, 2, "pending rollup migrations are only listed with rollups")
+	assert.Equal(t, applied, list[1].AppliedAt)
+
+	archiver.rollups = true
+
+	expectMigrationsTable(mock, true)
+	mock.ExpectQuery("select version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).
+			AddRow(uint32(1), applied).AddRow(uint32(2), applied))
+
+	list, err = archiver.Migrations(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	assert.False(t, list[2].Applied())
+	assert.Equal(t, "add index", list[2].Name)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrationsTableMissing(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	archiver := &CHArchiver{connect: db, migrations: testMigrations[:1]}
+
+	// listing the migrations doesn't create the table
+	expectMigrationsTable(mock, false)
+
+	list, err := archiver.Migrations(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.False(t, list[0].Applied())
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// it's created before the first migration is applied
+	expectMigrationsTable(mock, false)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS log_scores").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert into schema_migrations").
+		WithArgs(uint32(1), "create log_scores").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	done, err := archiver.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, done, 1)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateStartup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the rollup migrations are left for the migrate command
+	archiver := &CHArchiver{connect: db, rollups: true, migrations: testMigrations}
+
+	expectMigrationsTable(mock, true)
+	mock.ExpectQuery("select version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).
+			AddRow(uint32(1), time.Now()).AddRow(uint32(2), time.Now()))
+
+	done, err := archiver.migrate(context.Background(), false)
+	require.NoError(t, err)
+	assert.Empty(t, done)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateVariables(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	archiver := &CHArchiver{connect: db, rollups: true, migrations: []migration{
+		{Version: 1, Name: "create rollup", Rollup: true, Statements: []string{
+			"CREATE MATERIALIZED VIEW mv AS SELECT * FROM log_scores WHERE id > {id_cutoff}",
+			"INSERT INTO rollup SELECT * FROM log_scores{final} WHERE id <= {id_cutoff}",
+		}},
+	}}
+
+	expectMigrationsTable(mock, true)
+	mock.ExpectQuery("select version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}))
+
+	// the cutoff is read once, right before the view is created
+	mock.ExpectQuery(regexp.QuoteMeta("select max(id) from log_scores")).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(uint64(1234)))
+	mock.ExpectExec(regexp.QuoteMeta("FROM log_scores WHERE id > 1234")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select engine from system.tables").
+		WithArgs("log_scores").
+		WillReturnRows(sqlmock.NewRows([]string{"engine"}).AddRow("ReplacingMergeTree"))
+	mock.ExpectExec(regexp.QuoteMeta("FROM log_scores FINAL WHERE id <= 1234")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert into schema_migrations").
+		WithArgs(uint32(1), "create rollup").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	done, err := archiver.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, done, 1)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// a plain MergeTree table can't be read with FINAL
+	vars := map[string]string{}
+	mock.ExpectQuery("select engine from system.tables").
+		WillReturnRows(sqlmock.NewRows([]string{"engine"}).AddRow("MergeTree"))
+	stmt, err := archiver.expand(context.Background(), "FROM log_scores{final} WHERE", vars)
+	require.NoError(t, err)
+	assert.Equal(t, "FROM log_scores WHERE", stmt)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,115 @@
+package clickhouse
+
+import "fmt"
+
+// rollupQuantiles are the offset and rtt percentiles kept in the
+// rollup tables
+const rollupQuantiles = "0.5, 0.9, 0.99"
+
+// rollup describes an aggregate table of log_scores per server and
+// monitor over a period, kept up to date by a materialized view
+type rollup struct {
+	Table     string // log_scores_hourly
+	Column    string // hour
+	Type      string // DateTime
+	Period    string // toStartOfHour
+	Partition string // toYYYYMM(hour)
+}
+
+// rollupSelect aggregates the log scores in the table matching the
+// condition into the rollup columns; it's used by the materialized
+// view and to fill the table with the rows already in log_scores
+func (r rollup) rollupSelect(from, where string) string {
+	return fmt.Sprintf(`
+	SELECT
+		%[1]s(ts) AS %[2]s,
+		server_id,
+		monitor_id,
+		countState() AS count,
+		avgState(score) AS score_avg,
+		minState(score) AS score_min,
+		maxState(score) AS score_max,
+		quantilesState(%[3]s)(offset) AS offset_quantiles,
+		avgState(rtt) AS rtt_avg,
+		quantilesState(%[3]s)(rtt) AS rtt_quantiles
+	FROM %[4]s
+	WHERE %[5]s
+	GROUP BY %[2]s, server_id, monitor_id
+`, r.Period, r.Column, rollupQuantiles, from, where)
+}
+
+// migration returns the statements that create the rollup table and
+// the materialized view. The view is created first and only adds the
+// rows after the highest id in log_scores at that time; the rows up to
+// it are then added from log_scores, with FINAL so rows that haven't
+// been merged yet aren't counted twice. Rows inserted after the cutoff
+// is read but before the view exists aren't counted at all, so the
+// migrate command holds the archiver lock while it runs. A migration
+// that failed part way drops the view and empties the table when it's
+// run again.
+//
+// The view counts every block that reaches log_scores, so rows stored
+// again under a new dedup token by a retried batch (see StoreStream)
+// are counted twice; merges and FINAL don't remove them from the
+// rollup table.
+//
+// On a cluster the view on each node adds to the local rollup table,
+// and the rollups are read through a Distributed table. The placement
+// of the aggregates doesn't matter as they are merged when read, so
+// the rows from log_scores are spread randomly.
+func (r rollup) migration(version int, s schema) migration {
+	local := s.local(r.Table)
+
+	statements := []string{
+		fmt.Sprintf("DROP VIEW IF EXISTS %s_mv%s", r.Table, s.onCluster()),
+		fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %[1]s%[6]s (
+		%[2]s              %[3]s,
+		server_id         UInt32,
+		monitor_id        UInt32,
+		count             AggregateFunction(count),
+		score_avg         AggregateFunction(avg, Float32),
+		score_min         AggregateFunction(min, Float32),
+		score_max         AggregateFunction(max, Float32),
+		offset_quantiles  AggregateFunction(quantiles(%[5]s), Nullable(Float64)),
+		rtt_avg           AggregateFunction(avg, Nullable(UInt32)),
+		rtt_quantiles     AggregateFunction(quantiles(%[5]s), Nullable(UInt32))
+	) engine=%[7]s
+	PARTITION BY %[4]s
+	ORDER BY (server_id, %[2]s, monitor_id)
+`, local, r.Column, r.Type, r.Partition, rollupQuantiles, s.onCluster(), s.engine("AggregatingMergeTree")),
+	}
+	if len(s.Cluster) > 0 {
+		statements = append(statements, s.distributed(r.Table, "rand()"))
+	}
+	statements = append(statements,
+		fmt.Sprintf("TRUNCATE TABLE %s%s", local, s.onCluster()),
+		fmt.Sprintf("CREATE MATERIALIZED VIEW IF NOT EXISTS %[1]s_mv%[2]s TO %[3]s AS %[4]s",
+			r.Table, s.onCluster(), local, r.rollupSelect(s.local("log_scores"), "id > "+varIDCutoff)),
+		fmt.Sprintf("INSERT INTO %s %s", r.Table, r.rollupSelect("log_scores"+varFinal, "id <= "+varIDCutoff)),
+	)
+
+	return migration{
+		Version:    version,
+		Name:       "create " + r.Table,
+		Rollup:     true,
+		Statements: statements,
+	}
+}
+
+var (
+	hourlyRollup = rollup{
+		Table:     "log_scores_hourly",
+		Column:    "hour",
+		Type:      "DateTime",
+		Period:    "toStartOfHour",
+		Partition: "toYYYYMM(hour)",
+	}
+	dailyRollup = rollup{
+		Table:     "log_scores_daily",
+		Column:    "day",
+		Type:      "Date",
+		Period:    "toDate",
+		Partition: "toYear(day)",
+	}
+)
@@ -0,0 +1,58 @@
+package clickhouse
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollupMigration(t *testing.T) {
+	m := hourlyRollup.migration(3, schema{})
+
+	assert.Equal(t, 3, m.Version)
+	assert.Equal(t, "create log_scores_hourly", m.Name)
+	assert.True(t, m.Rollup)
+	require.Len(t, m.Statements, 5)
+
+	// a migration that failed part way starts over
+	assert.Equal(t, "DROP VIEW IF EXISTS log_scores_hourly_mv", m.Statements[0])
+	assert.Contains(t, m.Statements[1], "CREATE TABLE IF NOT EXISTS log_scores_hourly")
+	assert.Contains(t, m.Statements[1], "ORDER BY (server_id, hour, monitor_id)")
+	assert.Contains(t, m.Statements[1], "PARTITION BY toYYYYMM(hour)")
+	assert.Equal(t, "TRUNCATE TABLE log_scores_hourly", m.Statements[2])
+
+	// the view is created before the table is filled, and they split
+	// the rows at the id cutoff
+	assert.True(t, strings.HasPrefix(m.Statements[3],
+		"CREATE MATERIALIZED VIEW IF NOT EXISTS log_scores_hourly_mv TO log_scores_hourly AS"))
+	assert.True(t, strings.HasSuffix(m.Statements[3], hourlyRollup.rollupSelect("log_scores", "id > {id_cutoff}")))
+	assert.Contains(t, m.Statements[3], "toStartOfHour(ts) AS hour")
+	assert.True(t, strings.HasPrefix(m.Statements[4], "INSERT INTO log_scores_hourly "))
+	assert.True(t, strings.HasSuffix(m.Statements[4], hourlyRollup.rollupSelect("log_scores{final}", "id <= {id_cutoff}")))
+
+	daily := dailyRollup.migration(4, schema{})
+	assert.Contains(t, daily.Statements[1], "day              Date")
+	assert.Contains(t, daily.Statements[3], "toDate(ts) AS day")
+}
+
+func TestRollupMigrationCluster(t *testing.T) {
+	m := hourlyRollup.migration(3, schema{Cluster: "ntp", ShardingKey: "server_id"})
+	require.Len(t, m.Statements, 6)
+
+	assert.Equal(t, "DROP VIEW IF EXISTS log_scores_hourly_mv ON CLUSTER ntp", m.Statements[0])
+	assert.Contains(t, m.Statements[1], "CREATE TABLE IF NOT EXISTS log_scores_hourly_local ON CLUSTER ntp")
+	assert.Contains(t, m.Statements[1], "engine=ReplicatedAggregatingMergeTree")
+	assert.Equal(t,
+		"CREATE TABLE IF NOT EXISTS log_scores_hourly ON CLUSTER ntp AS log_scores_hourly_local engine=Distributed(ntp, currentDatabase(), log_scores_hourly_local, rand())",
+		m.Statements[2])
+	assert.Equal(t, "TRUNCATE TABLE log_scores_hourly_local ON CLUSTER ntp", m.Statements[3])
+
+	// updated on each node, filled through the distributed tables
+	assert.True(t, strings.HasPrefix(m.Statements[4],
+		"CREATE MATERIALIZED VIEW IF NOT EXISTS log_scores_hourly_mv ON CLUSTER ntp TO log_scores_hourly_local AS"))
+	assert.Contains(t, m.Statements[4], "FROM log_scores_local\n")
+	assert.True(t, strings.HasPrefix(m.Statements[5], "INSERT INTO log_scores_hourly "))
+	assert.Contains(t, m.Statements[5], "FROM log_scores{final}\n")
+}
@@ -0,0 +1,97 @@
+package clickhouse
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Cluster configures the archiver for a ClickHouse cluster. The zero
+// value is a single node.
+type Cluster struct {
+	// Name is the cluster in the server configuration the tables are
+	// created on
+	Name string
+
+	// ShardingKey is the expression the Distributed table uses to pick
+	// the shard for each row (default server_id)
+	ShardingKey string
+
+	// InsertShards inserts directly into the local table on the shard
+	// for each row, by the sharding key, instead of through the
+	// Distributed table
+	InsertShards bool
+}
+
+var clusterName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// schema returns where the tables are created
+func (c Cluster) schema() (schema, error) {
+	if len(c.Name) == 0 {
+		if len(c.ShardingKey) > 0 || c.InsertShards {
+			return schema{}, fmt.Errorf("ch_sharding_key and ch_insert=shards require ch_cluster")
+		}
+		return schema{}, nil
+	}
+	if !clusterName.MatchString(c.Name) {
+		return schema{}, fmt.Errorf("invalid ch_cluster %q", c.Name)
+	}
+	s := schema{Cluster: c.Name, ShardingKey: c.ShardingKey}
+	if len(s.ShardingKey) == 0 {
+		s.ShardingKey = "server_id"
+	}
+	if c.InsertShards && !shardingColumns[s.ShardingKey] {
+		return schema{}, fmt.Errorf("ch_insert=shards needs ch_sharding_key to be server_id, monitor_id or id, not %q", s.ShardingKey)
+	}
+	return s, nil
+}
+
+// schema is where the tables are created: on a single node, or as
+// replicated local tables on each node of a cluster with a Distributed
+// table with the plain name in front of them
+type schema struct {
+	Cluster     string // empty for a single node
+	ShardingKey string
+}
+
+// onCluster is added to the DDL statements
+func (s schema) onCluster() string {
+	if len(s.Cluster) == 0 {
+		return ""
+	}
+	return " ON CLUSTER " + s.Cluster
+}
+
+// local returns the name of the table with the data on each node
+func (s schema) local(table string) string {
+	if len(s.Cluster) == 0 {
+		return table
+	}
+	return table + "_local"
+}
+
+// engine returns the replicated engine on a cluster
+func (s schema) engine(engine string) string {
+	if len(s.Cluster) == 0 {
+		return engine
+	}
+	return "Replicated" + engine
+}
+
+// distributed returns the statement creating the Distributed table for
+// the local table
+func (s schema) distributed(table, shardingKey string) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %[1]s%[2]s AS %[3]s engine=Distributed(%[4]s, currentDatabase(), %[3]s, %[5]s)",
+		table, s.onCluster(), s.local(table), s.Cluster, shardingKey,
+	)
+}
+
+// migrationsTable is where the applied migrations are read from. On a
+// cluster the table is replicated within each shard, and the migrations
+// recorded on any shard are read.
+func (s schema) migrationsTable() string {
+	if len(s.Cluster) == 0 {
+		return "schema_migrations"
+	}
+	return fmt.Sprintf("cluster('%s', currentDatabase(), schema_migrations)", s.Cluster)
+}
@@ -0,0 +1,73 @@
+package clickhouse
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterSchema(t *testing.T) {
+	s, err := Cluster{}.schema()
+	require.NoError(t, err)
+	assert.Equal(t, schema{}, s)
+	assert.Equal(t, "log_scores", s.local("log_scores"))
+	assert.Equal(t, "ReplacingMergeTree", s.engine("ReplacingMergeTree"))
+	assert.Equal(t, "schema_migrations", s.migrationsTable())
+
+	s, err = Cluster{Name: "ntp"}.schema()
+	require.NoError(t, err)
+	assert.Equal(t, schema{Cluster: "ntp", ShardingKey: "server_id"}, s)
+	assert.Equal(t, "log_scores_local", s.local("log_scores"))
+	assert.Equal(t, "ReplicatedReplacingMergeTree", s.engine("ReplacingMergeTree"))
+	assert.Equal(t, "cluster('ntp', currentDatabase(), schema_migrations)", s.migrationsTable())
+
+	_, err = Cluster{ShardingKey: "id"}.schema()
+	assert.ErrorContains(t, err, "require ch_cluster")
+	_, err = Cluster{InsertShards: true}.schema()
+	assert.ErrorContains(t, err, "require ch_cluster")
+	_, err = Cluster{Name: "ntp", ShardingKey: "rand()", InsertShards: true}.schema()
+	assert.ErrorContains(t, err, "ch_insert=shards needs ch_sharding_key")
+	s, err = Cluster{Name: "ntp", ShardingKey: "monitor_id", InsertShards: true}.schema()
+	require.NoError(t, err)
+	assert.Equal(t, "monitor_id", s.ShardingKey)
+	_, err = Cluster{Name: "ntp; drop table"}.schema()
+	assert.ErrorContains(t, err, "invalid ch_cluster")
+}
+
+func TestClusterMigrations(t *testing.T) {
+	m := schema{Cluster: "ntp", ShardingKey: "cityHash64(server_id)"}.migrations()[0]
+	require.Len(t, m.Statements, 2)
+
+	assert.Contains(t, m.Statements[0], "CREATE TABLE IF NOT EXISTS log_scores_local ON CLUSTER ntp (")
+	assert.Contains(t, m.Statements[0], "engine=ReplicatedReplacingMergeTree")
+	assert.NotContains(t, m.Statements[0], "non_replicated_deduplication_window")
+	assert.Equal(t,
+		"CREATE TABLE IF NOT EXISTS log_scores ON CLUSTER ntp AS log_scores_local engine=Distributed(ntp, currentDatabase(), log_scores_local, cityHash64(server_id))",
+		m.Statements[1])
+
+	m = schema{}.migrations()[0]
+	require.Len(t, m.Statements, 1)
+	assert.Contains(t, m.Statements[0], "CREATE TABLE IF NOT EXISTS log_scores (")
+	assert.Contains(t, m.Statements[0], "engine=ReplacingMergeTree")
+	assert.Contains(t, m.Statements[0], "SETTINGS non_replicated_deduplication_window = 1000")
+
+	// for tables created before the migrations
+	m = schema{}.migrations()[1]
+	assert.Equal(t, []string{"ALTER TABLE log_scores MODIFY SETTING non_replicated_deduplication_window = 1000"}, m.Statements)
+	m = schema{Cluster: "ntp", ShardingKey: "server_id"}.migrations()[1]
+	assert.Equal(t, []string{"ALTER TABLE log_scores_local ON CLUSTER ntp MODIFY SETTING replicated_deduplication_window = 1000"}, m.Statements)
+}
+
+func TestStoreCluster(t *testing.T) {
+	cluster := schema{Cluster: "ntp", ShardingKey: "server_id"}
+
+	conn := &fakeConn{}
+	archiver := &CHArchiver{conn: conn, schema: cluster}
+
+	_, err := archiver.Store(context.Background(), testLogScores(1, 2))
+	require.NoError(t, err)
+	require.Len(t, conn.batches, 1)
+	assert.Contains(t, conn.batches[0].query, "INSERT INTO log_scores\n")
+}
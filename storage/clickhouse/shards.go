@@ -0,0 +1,150 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// shardingColumns are the sharding keys rows can be routed by with
+// ch_insert=shards, as the archiver has to compute them itself
+var shardingColumns = map[string]bool{
+	"server_id":  true,
+	"monitor_id": true,
+	"id":         true,
+}
+
+// shardHosts is a shard of the cluster from system.clusters
+type shardHosts struct {
+	Num    uint32
+	Weight uint32
+	Addr   []string // the replicas, host:port
+}
+
+// shards inserts the rows directly into the local table on the shard
+// the Distributed table would have sent them to: the sharding key
+// modulo the total weight picks a slot, and the shards have as many
+// slots as their weight, in order.
+type shards struct {
+	key   string
+	nums  []uint32
+	conns []batchConn
+	slots []int // the index in conns for each slot
+}
+
+// readShards returns the shards of the cluster with their replicas
+func (a *CHArchiver) readShards(ctx context.Context) ([]shardHosts, error) {
+	rows, err := a.connect.QueryContext(ctx, `
+		select shard_num, shard_weight, host_address, port
+		from system.clusters
+		where cluster = ?
+		order by shard_num, replica_num`, a.schema.Cluster)
+	if err != nil {
+		return nil, fmt.Errorf("cluster shards: %s", err)
+	}
+	defer rows.Close()
+
+	hosts := []shardHosts{}
+	for rows.Next() {
+		var num, weight uint32
+		var host string
+		var port uint16
+		if err := rows.Scan(&num, &weight, &host, &port); err != nil {
+			return nil, err
+		}
+		if len(hosts) == 0 || hosts[len(hosts)-1].Num != num {
+			hosts = append(hosts, shardHosts{Num: num, Weight: weight})
+		}
+		sh := &hosts[len(hosts)-1]
+		sh.Addr = append(sh.Addr, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("cluster %s not found in system.clusters", a.schema.Cluster)
+	}
+	return hosts, nil
+}
+
+// openShards connects to each shard of the cluster with the options
+// of the DSN, trying its replicas in order
+func (a *CHArchiver) openShards(ctx context.Context) (*shards, error) {
+	hosts, err := a.readShards(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conns := make([]batchConn, 0, len(hosts))
+	for _, h := range hosts {
+		options := *a.options
+		options.Addr = h.Addr
+		conn, err := clickhouse.Open(&options)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("shard %d: %s", h.Num, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	s, err := newShards(a.schema.ShardingKey, hosts, conns)
+	if err != nil {
+		for _, c := range conns {
+			c.Close()
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// newShards returns the router for the shards, with a connection for
+// each of them
+func newShards(key string, hosts []shardHosts, conns []batchConn) (*shards, error) {
+	s := &shards{key: key, conns: conns}
+	for i, h := range hosts {
+		s.nums = append(s.nums, h.Num)
+		for w := uint32(0); w < h.Weight; w++ {
+			s.slots = append(s.slots, i)
+		}
+	}
+	if len(s.slots) == 0 {
+		return nil, fmt.Errorf("the shards have no weight")
+	}
+	return s, nil
+}
+
+// split returns the rows of the block for each shard, in the order of
+// the connections. The same rows are always split the same way, so a
+// block stored again gets the same deduplication token on each shard.
+func (s *shards) split(block *columns) []*columns {
+	parts := make([]*columns, len(s.conns))
+	for i := range parts {
+		parts[i] = newColumns(0)
+	}
+
+	for i := 0; i < block.rows(); i++ {
+		var key uint64
+		switch s.key {
+		case "server_id":
+			key = uint64(block.serverID[i])
+		case "monitor_id":
+			key = uint64(block.monitorID[i])
+		default:
+			key = block.id[i]
+		}
+		parts[s.slots[key%uint64(len(s.slots))]].addRow(block, i)
+	}
+	return parts
+}
+
+// Close closes the connections to the shards
+func (s *shards) Close() {
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
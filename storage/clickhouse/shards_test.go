@@ -0,0 +1,90 @@
+package clickhouse
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/logscore"
+)
+
+func TestReadShards(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	archiver := &CHArchiver{connect: db, schema: schema{Cluster: "ntp", ShardingKey: "server_id"}}
+
+	mock.ExpectQuery("from system.clusters").
+		WithArgs("ntp").
+		WillReturnRows(sqlmock.NewRows([]string{"shard_num", "shard_weight", "host_address", "port"}).
+			AddRow(uint32(1), uint32(1), "10.0.0.1", uint16(9000)).
+			AddRow(uint32(1), uint32(1), "10.0.0.2", uint16(9000)).
+			AddRow(uint32(2), uint32(2), "fd00::3", uint16(9440)))
+
+	hosts, err := archiver.readShards(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []shardHosts{
+		{Num: 1, Weight: 1, Addr: []string{"10.0.0.1:9000", "10.0.0.2:9000"}},
+		{Num: 2, Weight: 2, Addr: []string{"[fd00::3]:9440"}},
+	}, hosts)
+
+	mock.ExpectQuery("from system.clusters").
+		WillReturnRows(sqlmock.NewRows([]string{"shard_num", "shard_weight", "host_address", "port"}))
+
+	_, err = archiver.readShards(context.Background())
+	assert.ErrorContains(t, err, "cluster ntp not found")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestNewShards(t *testing.T) {
+	_, err := newShards("server_id", []shardHosts{{Num: 1}}, []batchConn{&fakeConn{}})
+	assert.ErrorContains(t, err, "no weight")
+
+	s, err := newShards("server_id",
+		[]shardHosts{{Num: 1, Weight: 1}, {Num: 2, Weight: 0}, {Num: 3, Weight: 2}},
+		[]batchConn{&fakeConn{}, &fakeConn{}, &fakeConn{}})
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 2, 2}, s.slots)
+}
+
+func TestStoreShards(t *testing.T) {
+	first, second := &fakeConn{}, &fakeConn{}
+	s, err := newShards("server_id",
+		[]shardHosts{{Num: 1, Weight: 1}, {Num: 2, Weight: 2}},
+		[]batchConn{first, second})
+	require.NoError(t, err)
+
+	archiver := &CHArchiver{schema: schema{Cluster: "ntp", ShardingKey: "server_id"}, shards: s}
+
+	logscores := testLogScores(1, 2, 3, 4)
+	for i, serverID := range []int64{3, 4, 5, 6} {
+		logscores[i].ServerID = serverID
+	}
+
+	// server 3 and 6 are in the first slot, 4 and 5 in the others
+	n, err := archiver.Store(context.Background(), logscores)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, [][]uint64{{1, 4}}, first.ids())
+	assert.Equal(t, [][]uint64{{2, 3}}, second.ids())
+	assert.Contains(t, first.batches[0].query, "INSERT INTO log_scores_local\n")
+
+	// the same rows are split the same way
+	block := newColumns(0)
+	for _, l := range logscores {
+		block.add(l)
+	}
+	parts := s.split(block)
+	require.Len(t, parts, 2)
+	assert.Equal(t, "log_scores:1-4:2", parts[0].dedupToken())
+	assert.Equal(t, "log_scores:2-3:2", parts[1].dedupToken())
+
+	second.sendErr = assert.AnError
+	_, err = archiver.Store(context.Background(), []*logscore.LogScore{logscores[1]})
+	assert.ErrorContains(t, err, "shard 2")
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 
+	"go.ntppool.org/archiver/config"
 	"go.ntppool.org/archiver/logscore"
 	"go.ntppool.org/archiver/storage/fileavro"
 )
@@ -18,14 +20,14 @@ func main() {
 	fmt.Printf("tempdir: %s", tempdir)
 	// defer os.RemoveAll(tempdir)
 
-	av, err := fileavro.NewArchiver(tempdir)
+	av, err := fileavro.NewArchiver(tempdir, config.BatchSize{}, 0, "")
 	if err != nil {
 		log.Fatalf("could not NewArchiver(): %s", err)
 	}
 
 	ls := []*logscore.LogScore{}
 
-	i, err := av.Store(ls)
+	i, err := av.Store(context.Background(), ls)
 	if err != nil {
 		log.Fatalf("store(): %s", err)
 	}
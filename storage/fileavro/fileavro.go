@@ -1,6 +1,7 @@
 package fileavro
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"path"
 	"time"
 
+	"go.ntppool.org/archiver/config"
 	"go.ntppool.org/archiver/logscore"
 	"go.ntppool.org/archiver/storage"
 
@@ -16,14 +18,63 @@ import (
 
 // AvroArchiver stores avro files to a file system path
 type AvroArchiver struct {
-	path string
+	path        string
+	batch       config.BatchSize
+	appendSize  int
+	compression string
 }
 
+// defaultBatch is used when the archiver isn't given a batch size
+var defaultBatch = config.BatchSize{MinSize: 500000, MaxSize: 10000000, Interval: time.Hour * 24}
+
+// batchAppendSize is how many rows are buffered before they are
+// appended to the file, unless configured otherwise
 const batchAppendSize = 50000
 
-// NewArchiver returns an archiver that stores data in avro files in the specified path
-func NewArchiver(path string) (storage.FileArchiver, error) {
-	a := &AvroArchiver{path: path}
+const avroSchema = `
+	{
+	  "type": "record",
+	  "name": "logscore",
+	  "fields" : [
+		  {"name": "id", "type": "long"},
+		  {"name": "server_id", "type": "int"},
+		  {"name": "monitor_id", "type": "int"},
+		  {"name": "ts", "type": "long", "logicalType": "timestamp-micros"},
+		  {"name": "score", "type": "float"},
+		  {"name": "step", "type": "float"},
+		  {"name": "offset", "type": ["null", "float"]},
+		  {"name": "rtt", "type": ["null", "int"]},
+		  {"name": "leap", "type": ["null", "int"]},
+		  {"name": "error", "type": ["null", "string"]}
+		 ]
+	}`
+
+func init() {
+	storage.Register(storage.Backend{
+		Name:        "fileavro",
+		Description: "Avro files in a local directory",
+		Params: []storage.Param{
+			{Name: "path", Env: "avro_path", Help: "Directory for the avro files", Required: true},
+		},
+		New: func(ctx context.Context, opts storage.Options) (storage.Archiver, error) {
+			return NewArchiver(opts.Param("path"), opts.Batch,
+				opts.Config.Batch.FileAvroAppendSize, opts.Config.Storage.AvroCompression)
+		},
+		Batch: func(cfg *config.Config) config.BatchSize {
+			return cfg.Batch.FileAvro()
+		},
+	})
+}
+
+// NewArchiver returns an archiver that stores data in avro files in the
+// specified path. A zero batch size or append size uses the defaults
+// and an empty compression writes uncompressed files.
+func NewArchiver(path string, batch config.BatchSize, appendSize int, compression string) (storage.FileArchiver, error) {
+	codec, err := Compression(compression)
+	if err != nil {
+		return nil, err
+	}
+	a := &AvroArchiver{path: path, batch: batch, appendSize: appendSize, compression: codec}
 	fi, err := os.Stat(path)
 	if err != nil {
 		return nil, err
@@ -34,9 +85,31 @@ func NewArchiver(path string) (storage.FileArchiver, error) {
 	return a, nil
 }
 
+// Compression returns the OCF codec name for the compression setting.
+// The codec is recorded in the file header, so readers don't need to
+// be told which one was used.
+func Compression(name string) (string, error) {
+	switch name {
+	case "", goavro.CompressionNullLabel, "none":
+		return goavro.CompressionNullLabel, nil
+	case goavro.CompressionDeflateLabel:
+		return goavro.CompressionDeflateLabel, nil
+	case goavro.CompressionSnappyLabel:
+		return goavro.CompressionSnappyLabel, nil
+	case "zstd", "zstandard":
+		return "", fmt.Errorf("avro compression %q isn't supported by goavro, use deflate or snappy", name)
+	default:
+		return "", fmt.Errorf("unknown avro compression %q, must be null, deflate or snappy", name)
+	}
+}
+
 // BatchSizeMinMaxTime returns the minimum and maximum batch size
 func (a *AvroArchiver) BatchSizeMinMaxTime() (int, int, time.Duration) {
-	return 500000, 10000000, time.Hour * 24
+	bs := a.batch
+	if bs.MaxSize == 0 {
+		bs = defaultBatch
+	}
+	return bs.MinSize, bs.MaxSize, bs.Interval
 }
 
 // FileName returns the suggested filename for the given logscores
@@ -48,13 +121,25 @@ func (a *AvroArchiver) FileName(logscores []*logscore.LogScore) string {
 }
 
 // Store is for the Archiver interface
-func (a *AvroArchiver) Store(logscores []*logscore.LogScore) (int, error) {
+func (a *AvroArchiver) Store(ctx context.Context, logscores []*logscore.LogScore) (int, error) {
 	if len(logscores) == 0 {
 		log.Printf("no input data!")
 		return 0, nil
 	}
 
-	fileName := a.FileName(logscores)
+	return a.StoreStream(ctx, storage.Stream(logscores))
+}
+
+// StoreStream is for the StreamArchiver interface, the file is
+// named after the first log score received
+func (a *AvroArchiver) StoreStream(ctx context.Context, logscores <-chan *logscore.LogScore) (int, error) {
+	first, ok := <-logscores
+	if !ok {
+		log.Printf("no input data!")
+		return 0, nil
+	}
+
+	fileName := a.FileName([]*logscore.LogScore{first})
 	fileName = path.Join(a.path, fileName)
 
 	fh, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0o666)
@@ -62,8 +147,9 @@ func (a *AvroArchiver) Store(logscores []*logscore.LogScore) (int, error) {
 		return 0, fmt.Errorf("open file %q: %s", fileName, err)
 	}
 
-	n, err := a.StoreWriter(fh, logscores)
+	info, err := a.storeStreamWriter(ctx, fh, first, logscores)
 	if err != nil {
+		fh.Close()
 		os.Remove(fileName)
 		return 0, err
 	}
@@ -73,131 +159,321 @@ func (a *AvroArchiver) Store(logscores []*logscore.LogScore) (int, error) {
 		return 0, err
 	}
 
-	return n, err
+	err = storage.AppendManifest(a.path, storage.ManifestEntry{
+		File:    path.Base(fileName),
+		FirstID: info.First.ID,
+		LastID:  info.Last.ID,
+		Count:   int64(info.Count),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Count, err
 }
 
-// StoreWriter is like store, but writes to the specified ReadWriter
-func (a *AvroArchiver) StoreWriter(fh io.ReadWriter, logscores []*logscore.LogScore) (int, error) {
-	log.Println("Running Avro File batcher")
+// Manifest returns the files recorded in the manifest. Files that
+// aren't in the manifest, because they were written before the
+// archiver kept one, are read and added to it.
+func (a *AvroArchiver) Manifest(ctx context.Context) ([]storage.ManifestEntry, error) {
+	entries, err := storage.ReadManifest(a.path)
+	if err != nil {
+		return nil, err
+	}
 
-	codec, err := goavro.NewCodec(`
-	{
-	  "type": "record",
-	  "name": "logscore",
-	  "fields" : [
-		  {"name": "id", "type": "long"},
-		  {"name": "server_id", "type": "int"},
-		  {"name": "monitor_id", "type": "int"},
-		  {"name": "ts", "type": "long", "logicalType": "timestamp-micros"},
-		  {"name": "score", "type": "float"},
-		  {"name": "step", "type": "float"},
-		  {"name": "offset", "type": ["null", "float"]},
-		  {"name": "rtt", "type": ["null", "int"]},
-		  {"name": "leap", "type": ["null", "int"]},
-		  {"name": "error", "type": ["null", "string"]}
-		 ]
-	}`)
+	files, err := a.Files(ctx)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	// fmt.Printf("Canonical Schema: %s\n", codec.CanonicalSchema())
+	recorded := map[string]bool{}
+	for _, e := range entries {
+		recorded[e.File] = true
+	}
 
-	if len(logscores) == 0 {
-		log.Printf("no input data!")
-		return 0, nil
+	for _, file := range files {
+		if recorded[file] {
+			continue
+		}
+
+		log.Printf("%s isn't in the manifest, adding it", file)
+
+		entry, ok, err := storage.ScanFile(ctx, a, file)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if err := storage.AppendManifest(a.path, entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
 	}
 
-	ocfconfig := goavro.OCFConfig{
-		W:               fh,
-		Codec:           codec,
-		CompressionName: "null",
+	return entries, nil
+}
+
+// VerifyRange is for the Verifier interface; it checks the range
+// against the files in the manifest
+func (a *AvroArchiver) VerifyRange(ctx context.Context, firstID, lastID, count int64) error {
+	entries, err := a.Manifest(ctx)
+	if err != nil {
+		return err
 	}
+	return storage.VerifyManifest(ctx, entries, firstID, lastID, count, storage.ReaderIDCounter(a))
+}
 
-	w, err := goavro.NewOCFWriter(ocfconfig)
+// Files is for the Reader interface; it returns the avro files in
+// the directory
+func (a *AvroArchiver) Files(ctx context.Context) ([]string, error) {
+	dir, err := os.ReadDir(a.path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range dir {
+		if e.Type().IsRegular() && path.Ext(e.Name()) == ".avro" {
+			files = append(files, e.Name())
+		}
+	}
+	return files, nil
+}
+
+// ReadFile is for the Reader interface
+func (a *AvroArchiver) ReadFile(ctx context.Context, name string, fn func(*logscore.LogScore) error) error {
+	fh, err := os.Open(path.Join(a.path, name))
 	if err != nil {
-		return 0, fmt.Errorf("NewOCFWriter: %s", err)
+		return err
 	}
+	defer fh.Close()
+	return Decode(ctx, fh, fn)
+}
 
-	queue := []interface{}{}
-	count := 0
+// StoreWriter is like store, but writes to the specified ReadWriter
+func (a *AvroArchiver) StoreWriter(ctx context.Context, fh io.ReadWriter, logscores []*logscore.LogScore) (int, error) {
+	info, err := a.StoreStreamWriter(ctx, fh, storage.Stream(logscores))
+	return info.Count, err
+}
 
-	for _, ls := range logscores {
+// StoreStreamWriter is like StoreStream, but writes to the specified Writer
+func (a *AvroArchiver) StoreStreamWriter(ctx context.Context, fh io.Writer, logscores <-chan *logscore.LogScore) (storage.BatchInfo, error) {
+	first, ok := <-logscores
+	if !ok {
+		log.Printf("no input data!")
+		return storage.BatchInfo{}, nil
+	}
+	return a.storeStreamWriter(ctx, fh, first, logscores)
+}
 
-		// fmt.Printf("ls: %+v\n", ls)
+func (a *AvroArchiver) storeStreamWriter(ctx context.Context, fh io.Writer, first *logscore.LogScore, logscores <-chan *logscore.LogScore) (storage.BatchInfo, error) {
+	log.Println("Running Avro File batcher")
 
-		// // Convert native Go form to binary Avro data
-		// binary, err := codec.BinaryFromNative(nil, native)
-		// if err != nil {
-		// 	fmt.Println(err)
-		// }
+	info := storage.BatchInfo{First: first}
 
-		var offset interface{}
-		var rtt interface{}
+	codec, err := goavro.NewCodec(avroSchema)
+	if err != nil {
+		return info, err
+	}
 
-		if ls.Offset == nil {
-			offset = nil
-		} else {
-			offset = goavro.Union("float", *ls.Offset)
-		}
+	// fmt.Printf("Canonical Schema: %s\n", codec.CanonicalSchema())
 
-		if ls.RTT == nil {
-			rtt = nil
-		} else {
-			rtt = goavro.Union("int", *ls.RTT)
-		}
+	compression := a.compression
+	if compression == "" {
+		compression = goavro.CompressionNullLabel
+	}
 
-		var leap interface{}
-		if ls.Meta.Leap != 0 {
-			leap = goavro.Union("int", int(ls.Meta.Leap))
-		}
+	ocfconfig := goavro.OCFConfig{
+		W:               fh,
+		Codec:           codec,
+		CompressionName: compression,
+	}
 
-		var lsError interface{}
-		if len(ls.Meta.Error) > 0 {
-			lsError = goavro.Union("string", ls.Meta.Error)
-		}
+	w, err := goavro.NewOCFWriter(ocfconfig)
+	if err != nil {
+		return info, fmt.Errorf("NewOCFWriter: %s", err)
+	}
 
-		avromap := map[string]interface{}{
-			"id":         ls.ID,
-			"server_id":  ls.ServerID,
-			"monitor_id": ls.MonitorID,
-			"ts":         time.Unix(ls.Ts, 0),
-			"score":      ls.Score,
-			"step":       ls.Step,
-			"offset":     offset,
-			"rtt":        rtt,
-			"leap":       leap,
-			"error":      lsError,
-		}
+	appendSize := a.appendSize
+	if appendSize <= 0 {
+		appendSize = batchAppendSize
+	}
 
-		// textual, err := codec.TextualFromNative(nil, avromap)
-		// if err != nil {
-		// 	return 0, fmt.Errorf("TextualFromNative: %s", err)
-		// }
-		// fmt.Printf("AVRO: %s\n", textual)
+	queue := []interface{}{}
 
-		queue = append(queue, avromap)
+	add := func(ls *logscore.LogScore) error {
+		queue = append(queue, avroMap(ls))
+		info.Last = ls
 
-		if len(queue) > batchAppendSize {
+		if len(queue) > appendSize {
 			err = w.Append(queue)
 			if err != nil {
-				return count, fmt.Errorf("append: %s", err)
+				return fmt.Errorf("append: %s", err)
 			}
-			count = count + len(queue)
+			info.Count = info.Count + len(queue)
 			queue = []interface{}{}
 		}
+		return nil
+	}
+
+	if err := add(first); err != nil {
+		return info, err
+	}
+	for ls := range logscores {
+		if err := ctx.Err(); err != nil {
+			return info, err
+		}
+		if err := add(ls); err != nil {
+			return info, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return info, err
 	}
 
 	if len(queue) > 0 {
 		err = w.Append(queue)
 		if err != nil {
-			return count, fmt.Errorf("append: %s", err)
+			return info, fmt.Errorf("append: %s", err)
 		}
-		count = count + len(queue)
+		info.Count = info.Count + len(queue)
 		// queue = []interface{}{}
 	}
 
-	return count, nil
+	return info, nil
+}
+
+// Decode reads an avro file written by the archiver, with any of the
+// supported compression codecs, and calls fn for each log score.
+func Decode(ctx context.Context, r io.Reader, fn func(*logscore.LogScore) error) error {
+	ocf, err := goavro.NewOCFReader(r)
+	if err != nil {
+		return fmt.Errorf("NewOCFReader: %s", err)
+	}
+	for ocf.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		datum, err := ocf.Read()
+		if err != nil {
+			return fmt.Errorf("read: %s", err)
+		}
+		ls, err := logScore(datum)
+		if err != nil {
+			return err
+		}
+		if err := fn(ls); err != nil {
+			return err
+		}
+	}
+	return ocf.Err()
+}
+
+// logScore converts the native goavro representation back to a
+// log score; it's the reverse of avroMap
+func logScore(datum interface{}) (*logscore.LogScore, error) {
+	m, ok := datum.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected avro record %T", datum)
+	}
+
+	ls := &logscore.LogScore{}
+
+	id, ok := m["id"].(int64)
+	if !ok {
+		return nil, fmt.Errorf("avro record without an id")
+	}
+	ls.ID = id
+
+	if v, ok := m["server_id"].(int32); ok {
+		ls.ServerID = int64(v)
+	}
+	if v, ok := m["monitor_id"].(int32); ok {
+		ls.MonitorID = int64(v)
+	}
+	switch ts := m["ts"].(type) {
+	case time.Time:
+		ls.Ts = ts.Unix()
+	case int64:
+		ls.Ts = ts / int64(time.Second/time.Microsecond)
+	default:
+		return nil, fmt.Errorf("avro record %d has an unexpected ts %T", id, m["ts"])
+	}
+	if v, ok := m["score"].(float32); ok {
+		ls.Score = float64(v)
+	}
+	if v, ok := m["step"].(float32); ok {
+		ls.Step = float64(v)
+	}
+
+	// the nullable fields are unions, {"float": 0.1} or nil
+	if u, ok := m["offset"].(map[string]interface{}); ok {
+		if v, ok := u["float"].(float32); ok {
+			offset := float64(v)
+			ls.Offset = &offset
+		}
+	}
+	if u, ok := m["rtt"].(map[string]interface{}); ok {
+		if v, ok := u["int"].(int32); ok {
+			rtt := int64(v)
+			ls.RTT = &rtt
+		}
+	}
+	if u, ok := m["leap"].(map[string]interface{}); ok {
+		if v, ok := u["int"].(int32); ok {
+			ls.Meta.Leap = uint8(v)
+		}
+	}
+	if u, ok := m["error"].(map[string]interface{}); ok {
+		if v, ok := u["string"].(string); ok {
+			ls.Meta.Error = v
+		}
+	}
+
+	return ls, nil
+}
+
+// avroMap converts a log score to the native goavro representation
+func avroMap(ls *logscore.LogScore) map[string]interface{} {
+	// fmt.Printf("ls: %+v\n", ls)
+
+	var offset interface{}
+	var rtt interface{}
+
+	if ls.Offset == nil {
+		offset = nil
+	} else {
+		offset = goavro.Union("float", *ls.Offset)
+	}
+
+	if ls.RTT == nil {
+		rtt = nil
+	} else {
+		rtt = goavro.Union("int", *ls.RTT)
+	}
+
+	var leap interface{}
+	if ls.Meta.Leap != 0 {
+		leap = goavro.Union("int", int(ls.Meta.Leap))
+	}
+
+	var lsError interface{}
+	if len(ls.Meta.Error) > 0 {
+		lsError = goavro.Union("string", ls.Meta.Error)
+	}
+
+	return map[string]interface{}{
+		"id":         ls.ID,
+		"server_id":  ls.ServerID,
+		"monitor_id": ls.MonitorID,
+		"ts":         time.Unix(ls.Ts, 0),
+		"score":      ls.Score,
+		"step":       ls.Step,
+		"offset":     offset,
+		"rtt":        rtt,
+		"leap":       leap,
+		"error":      lsError,
+	}
 }
 
 // Close finishes up the archiver
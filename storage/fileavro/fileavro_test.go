@@ -2,15 +2,19 @@ package fileavro
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	goavro "github.com/linkedin/goavro/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.ntppool.org/archiver/config"
 	"go.ntppool.org/archiver/logscore"
+	"go.ntppool.org/archiver/storage"
 )
 
 func TestNewArchiver(t *testing.T) {
@@ -49,7 +53,7 @@ func TestNewArchiver(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			archiver, err := NewArchiver(tt.path)
+			archiver, err := NewArchiver(tt.path, config.BatchSize{}, 0, "")
 			if tt.wantErr {
 				assert.Error(t, err)
 				assert.Nil(t, archiver)
@@ -70,6 +74,18 @@ func TestBatchSizeMinMaxTime(t *testing.T) {
 	assert.Equal(t, time.Hour*24, interval)
 }
 
+func TestBatchSizeConfigured(t *testing.T) {
+	tempDir := t.TempDir()
+
+	archiver, err := NewArchiver(tempDir, config.BatchSize{MinSize: 10, MaxSize: 100, Interval: time.Minute}, 0, "")
+	require.NoError(t, err)
+
+	minSize, maxSize, interval := archiver.BatchSizeMinMaxTime()
+	assert.Equal(t, 10, minSize)
+	assert.Equal(t, 100, maxSize)
+	assert.Equal(t, time.Minute, interval)
+}
+
 func TestFileName(t *testing.T) {
 	archiver := &AvroArchiver{path: "/tmp"}
 
@@ -119,7 +135,7 @@ func TestStoreWriter(t *testing.T) {
 
 	t.Run("empty logscores", func(t *testing.T) {
 		var buf bytes.Buffer
-		count, err := archiver.StoreWriter(&buf, []*logscore.LogScore{})
+		count, err := archiver.StoreWriter(context.Background(), &buf, []*logscore.LogScore{})
 		assert.NoError(t, err)
 		assert.Equal(t, 0, count)
 	})
@@ -146,7 +162,7 @@ func TestStoreWriter(t *testing.T) {
 			},
 		}
 
-		count, err := archiver.StoreWriter(&buf, logscores)
+		count, err := archiver.StoreWriter(context.Background(), &buf, logscores)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, count)
 		assert.Greater(t, buf.Len(), 0, "Buffer should contain avro data")
@@ -180,7 +196,7 @@ func TestStoreWriter(t *testing.T) {
 			},
 		}
 
-		count, err := archiver.StoreWriter(&buf, logscores)
+		count, err := archiver.StoreWriter(context.Background(), &buf, logscores)
 		assert.NoError(t, err)
 		assert.Equal(t, 2, count)
 		assert.Greater(t, buf.Len(), 0, "Buffer should contain avro data")
@@ -203,7 +219,7 @@ func TestStoreWriter(t *testing.T) {
 			},
 		}
 
-		count, err := archiver.StoreWriter(&buf, logscores)
+		count, err := archiver.StoreWriter(context.Background(), &buf, logscores)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, count)
 		assert.Greater(t, buf.Len(), 0, "Buffer should contain avro data")
@@ -232,11 +248,32 @@ func TestStoreWriterBatching(t *testing.T) {
 			}
 		}
 
-		count, err := archiver.StoreWriter(&buf, logscores)
+		count, err := archiver.StoreWriter(context.Background(), &buf, logscores)
 		assert.NoError(t, err)
 		assert.Equal(t, len(logscores), count)
 		assert.Greater(t, buf.Len(), 0, "Buffer should contain avro data")
 	})
+
+	t.Run("configured append size", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		archiver := &AvroArchiver{path: "/tmp", appendSize: 3}
+
+		logscores := make([]*logscore.LogScore, 10)
+		for i := range logscores {
+			logscores[i] = &logscore.LogScore{
+				ID:        int64(i + 1),
+				ServerID:  20,
+				MonitorID: 10,
+				Ts:        int64(1640995200 + i),
+				Score:     15.5,
+			}
+		}
+
+		count, err := archiver.StoreWriter(context.Background(), &buf, logscores)
+		assert.NoError(t, err)
+		assert.Equal(t, len(logscores), count)
+	})
 }
 
 func TestStore(t *testing.T) {
@@ -245,11 +282,11 @@ func TestStore(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(tempDir)
 
-	archiver, err := NewArchiver(tempDir)
+	archiver, err := NewArchiver(tempDir, config.BatchSize{}, 0, "")
 	require.NoError(t, err)
 
 	t.Run("empty logscores", func(t *testing.T) {
-		count, err := archiver.Store([]*logscore.LogScore{})
+		count, err := archiver.Store(context.Background(), []*logscore.LogScore{})
 		assert.NoError(t, err)
 		assert.Equal(t, 0, count)
 	})
@@ -274,7 +311,7 @@ func TestStore(t *testing.T) {
 			},
 		}
 
-		count, err := archiver.Store(logscores)
+		count, err := archiver.Store(context.Background(), logscores)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, count)
 
@@ -315,7 +352,7 @@ func TestStore(t *testing.T) {
 			},
 		}
 
-		count, err := archiver.Store(logscores)
+		count, err := archiver.Store(context.Background(), logscores)
 		assert.NoError(t, err)
 		assert.Equal(t, 2, count)
 
@@ -348,7 +385,7 @@ func TestStore(t *testing.T) {
 			},
 		}
 
-		i, err := archiver.Store(ls)
+		i, err := archiver.Store(context.Background(), ls)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, i)
 	})
@@ -372,7 +409,7 @@ func TestStoreFileError(t *testing.T) {
 		},
 	}
 
-	count, err := archiver.Store(logscores)
+	count, err := archiver.Store(context.Background(), logscores)
 	assert.Error(t, err)
 	assert.Equal(t, 0, count)
 	assert.Contains(t, err.Error(), "open file")
@@ -420,8 +457,293 @@ func TestStoreWriterError(t *testing.T) {
 			writeErr: assert.AnError,
 		}
 
-		count, err := archiver.StoreWriter(mockWriter, logscores)
+		count, err := archiver.StoreWriter(context.Background(), mockWriter, logscores)
 		assert.Error(t, err)
 		assert.Equal(t, 0, count)
 	})
 }
+
+func TestStoreStream(t *testing.T) {
+	tempDir := t.TempDir()
+
+	archiver, err := NewArchiver(tempDir, config.BatchSize{}, 0, "")
+	require.NoError(t, err)
+
+	logscores := []*logscore.LogScore{
+		{ID: 300, ServerID: 40, MonitorID: 30, Ts: 1640995400, Score: 19.5, Step: 1},
+		{ID: 301, ServerID: 41, MonitorID: 31, Ts: 1640995460, Score: 19.0, Step: 1},
+		{ID: 302, ServerID: 42, MonitorID: 32, Ts: 1640995520, Score: 18.5, Step: 1},
+	}
+
+	t.Run("stream to file", func(t *testing.T) {
+		ch := make(chan *logscore.LogScore)
+		go func() {
+			for _, ls := range logscores {
+				ch <- ls
+			}
+			close(ch)
+		}()
+
+		count, err := archiver.StoreStream(context.Background(), ch)
+		require.NoError(t, err)
+		assert.Equal(t, 3, count)
+		assert.FileExists(t, filepath.Join(tempDir, "1640995400-300.avro"))
+	})
+
+	t.Run("empty stream", func(t *testing.T) {
+		count, err := archiver.StoreStream(context.Background(), storage.Stream(nil))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("cancelled stream removes the file", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		ls := []*logscore.LogScore{
+			{ID: 400, Ts: 1640995600},
+			{ID: 401, Ts: 1640995660},
+		}
+
+		count, err := archiver.StoreStream(ctx, storage.Stream(ls))
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 0, count)
+		assert.NoFileExists(t, filepath.Join(tempDir, "1640995600-400.avro"))
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		entries, err := archiver.(*AvroArchiver).Manifest(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []storage.ManifestEntry{
+			{File: "1640995400-300.avro", FirstID: 300, LastID: 302, Count: 3},
+		}, entries)
+	})
+}
+
+func TestVerifyRange(t *testing.T) {
+	tempDir := t.TempDir()
+
+	archiver, err := NewArchiver(tempDir, config.BatchSize{}, 0, "")
+	require.NoError(t, err)
+	verifier := archiver.(storage.Verifier)
+
+	// no manifest yet
+	err = verifier.VerifyRange(context.Background(), 1, 10, 10)
+	assert.Error(t, err)
+
+	for _, ids := range [][]int64{{1, 2, 3}, {4, 6}} {
+		ls := []*logscore.LogScore{}
+		for _, id := range ids {
+			ls = append(ls, &logscore.LogScore{ID: id, Ts: 1640995200 + id})
+		}
+		_, err := archiver.Store(context.Background(), ls)
+		require.NoError(t, err)
+	}
+
+	assert.NoError(t, verifier.VerifyRange(context.Background(), 1, 6, 5))
+	assert.NoError(t, verifier.VerifyRange(context.Background(), 2, 4, 3))
+	assert.Error(t, verifier.VerifyRange(context.Background(), 1, 6, 6))
+	assert.Error(t, verifier.VerifyRange(context.Background(), 1, 7, 5))
+
+	// the rows of the partly covered file outside the range don't count
+	assert.NoError(t, verifier.VerifyRange(context.Background(), 3, 6, 3))
+	assert.Error(t, verifier.VerifyRange(context.Background(), 3, 6, 4))
+}
+
+func TestManifestRebuild(t *testing.T) {
+	tempDir := t.TempDir()
+
+	archiver, err := NewArchiver(tempDir, config.BatchSize{}, 0, "")
+	require.NoError(t, err)
+	a := archiver.(*AvroArchiver)
+
+	_, err = archiver.Store(context.Background(), testLogScores(10))
+	require.NoError(t, err)
+
+	// as if the file was written before the manifest existed
+	require.NoError(t, os.Remove(filepath.Join(tempDir, storage.ManifestFile)))
+
+	entries, err := a.Manifest(context.Background())
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(1), entries[0].FirstID)
+	assert.Equal(t, int64(10), entries[0].LastID)
+	assert.Equal(t, int64(10), entries[0].Count)
+
+	// and it's recorded for the next time
+	recorded, err := storage.ReadManifest(tempDir)
+	require.NoError(t, err)
+	assert.Equal(t, entries, recorded)
+
+	assert.NoError(t, a.VerifyRange(context.Background(), 1, 10, 10))
+}
+
+func TestStoreStreamWriter(t *testing.T) {
+	archiver := &AvroArchiver{path: "/tmp"}
+
+	var buf bytes.Buffer
+
+	logscores := []*logscore.LogScore{
+		{ID: 500, Ts: 1640995700},
+		{ID: 501, Ts: 1640995760},
+	}
+
+	info, err := archiver.StoreStreamWriter(context.Background(), &buf, storage.Stream(logscores))
+	require.NoError(t, err)
+	assert.Equal(t, 2, info.Count)
+	assert.Equal(t, int64(500), info.First.ID)
+	assert.Equal(t, int64(501), info.Last.ID)
+	assert.Greater(t, buf.Len(), 0, "Buffer should contain avro data")
+}
+
+func TestCompression(t *testing.T) {
+	for name, want := range map[string]string{
+		"":        "null",
+		"null":    "null",
+		"none":    "null",
+		"deflate": "deflate",
+		"snappy":  "snappy",
+	} {
+		got, err := Compression(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, want, got, name)
+	}
+
+	_, err := Compression("zstd")
+	assert.ErrorContains(t, err, "isn't supported")
+
+	_, err = Compression("lz4")
+	assert.ErrorContains(t, err, "unknown avro compression")
+
+	_, err = NewArchiver(t.TempDir(), config.BatchSize{}, 0, "gzip")
+	assert.Error(t, err)
+}
+
+// testLogScores returns n log scores with a mix of set and null fields
+func testLogScores(n int) []*logscore.LogScore {
+	logscores := make([]*logscore.LogScore, n)
+	for i := range logscores {
+		ls := &logscore.LogScore{
+			ID:        int64(i + 1),
+			ServerID:  int64(1000 + i%500),
+			MonitorID: int64(i % 40),
+			Ts:        int64(1640995200 + i/40),
+			Score:     20 - float64(i%7)*0.5,
+			Step:      1,
+		}
+		if i%10 != 0 {
+			offset := float64(i%100) * 0.0001
+			rtt := int64(20000 + i%5000)
+			ls.Offset, ls.RTT = &offset, &rtt
+		} else {
+			ls.Meta.Error = "i/o timeout"
+		}
+		logscores[i] = ls
+	}
+	return logscores
+}
+
+func TestStoreWriterCompression(t *testing.T) {
+	logscores := testLogScores(1000)
+
+	for _, name := range []string{"null", "deflate", "snappy"} {
+		t.Run(name, func(t *testing.T) {
+			archiver, err := NewArchiver(t.TempDir(), config.BatchSize{}, 0, name)
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			count, err := archiver.StoreWriter(context.Background(), &buf, logscores)
+			require.NoError(t, err)
+			assert.Equal(t, len(logscores), count)
+
+			r, err := goavro.NewOCFReader(&buf)
+			require.NoError(t, err)
+			assert.Equal(t, name, r.CompressionName())
+			assert.Equal(t, name, string(r.MetaData()["avro.codec"]))
+
+			read := 0
+			for r.Scan() {
+				datum, err := r.Read()
+				require.NoError(t, err)
+				read++
+				assert.Equal(t, int64(read), datum.(map[string]interface{})["id"])
+			}
+			require.NoError(t, r.Err())
+			assert.Equal(t, len(logscores), read)
+		})
+	}
+}
+
+// BenchmarkStoreWriterCompression compares the codecs; the file size is
+// reported as bytes/row.
+func BenchmarkStoreWriterCompression(b *testing.B) {
+	logscores := testLogScores(100000)
+
+	for _, name := range []string{"null", "deflate", "snappy"} {
+		b.Run(name, func(b *testing.B) {
+			archiver := &AvroArchiver{path: b.TempDir(), compression: name}
+
+			var size int
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				_, err := archiver.StoreWriter(context.Background(), &buf, logscores)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = buf.Len()
+			}
+			b.ReportMetric(float64(size)/float64(len(logscores)), "bytes/row")
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	tempDir := t.TempDir()
+	ctx := context.Background()
+
+	archiver, err := NewArchiver(tempDir, config.BatchSize{}, 0, "deflate")
+	require.NoError(t, err)
+
+	logscores := testLogScores(25)
+	logscores[3].Meta.Leap = 1
+	count, err := archiver.Store(ctx, logscores)
+	require.NoError(t, err)
+	assert.Equal(t, 25, count)
+
+	files, err := archiver.(storage.Reader).Files(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1640995200-1.avro"}, files)
+
+	read := []*logscore.LogScore{}
+	err = archiver.(storage.Reader).ReadFile(ctx, files[0], func(ls *logscore.LogScore) error {
+		read = append(read, ls)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, read, len(logscores))
+
+	for i, ls := range logscores {
+		got := read[i]
+		assert.Equal(t, ls.ID, got.ID)
+		assert.Equal(t, ls.ServerID, got.ServerID)
+		assert.Equal(t, ls.MonitorID, got.MonitorID)
+		assert.Equal(t, ls.Ts, got.Ts)
+		assert.InDelta(t, ls.Score, got.Score, 0.0001)
+		assert.Equal(t, ls.Meta, got.Meta)
+		assert.Equal(t, ls.RTT, got.RTT)
+		if ls.Offset == nil {
+			assert.Nil(t, got.Offset)
+		} else {
+			assert.InDelta(t, *ls.Offset, *got.Offset, 0.000001)
+		}
+	}
+
+	// errors from the callback stop the read
+	calls := 0
+	err = archiver.(storage.Reader).ReadFile(ctx, files[0], func(ls *logscore.LogScore) error {
+		calls++
+		return io.ErrUnexpectedEOF
+	})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, 1, calls)
+}
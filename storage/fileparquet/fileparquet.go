@@ -0,0 +1,398 @@
+// Package fileparquet stores log scores in Parquet files, with the
+// same columns as the fileavro files, for DuckDB, Spark and the like.
+package fileparquet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet"
+	"github.com/apache/arrow/go/v15/parquet/compress"
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/logscore"
+	"go.ntppool.org/archiver/storage"
+)
+
+// ParquetArchiver stores parquet files to a file system path
+type ParquetArchiver struct {
+	path         string
+	batch        config.BatchSize
+	rowGroupSize int
+	compression  compress.Compression
+}
+
+// defaultBatch is used when the archiver isn't given a batch size
+var defaultBatch = config.BatchSize{MinSize: 500000, MaxSize: 10000000, Interval: time.Hour * 24}
+
+// defaultRowGroupSize is the number of rows per row group, unless
+// configured otherwise. A row group is buffered in memory until it's
+// written.
+const defaultRowGroupSize = 500000
+
+// schema has the columns of the fileavro schema
+var schema = arrow.NewSchema([]arrow.Field{
+	{Name: "id", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "server_id", Type: arrow.PrimitiveTypes.Int32},
+	{Name: "monitor_id", Type: arrow.PrimitiveTypes.Int32},
+	{Name: "ts", Type: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}},
+	{Name: "score", Type: arrow.PrimitiveTypes.Float32},
+	{Name: "step", Type: arrow.PrimitiveTypes.Float32},
+	{Name: "offset", Type: arrow.PrimitiveTypes.Float32, Nullable: true},
+	{Name: "rtt", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+	{Name: "leap", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+	{Name: "error", Type: arrow.BinaryTypes.String, Nullable: true},
+}, nil)
+
+func init() {
+	storage.Register(storage.Backend{
+		Name:        "fileparquet",
+		Description: "Parquet files in a local directory",
+		Params: []storage.Param{
+			{Name: "path", Env: "parquet_path", Help: "Directory for the parquet files", Required: true},
+			{Name: "compression", Env: "parquet_compression", Help: "zstd (default), snappy, gzip or none"},
+			{Name: "row_group_size", Env: "parquet_row_group_size", Help: "Rows per row group (default 500000)"},
+		},
+		New: func(ctx context.Context, opts storage.Options) (storage.Archiver, error) {
+			rowGroupSize := 0
+			if s := opts.Param("row_group_size"); s != "" {
+				var err error
+				rowGroupSize, err = strconv.Atoi(s)
+				if err != nil {
+					return nil, fmt.Errorf("parquet_row_group_size: %w", err)
+				}
+			}
+			return NewArchiver(opts.Param("path"), opts.Batch, rowGroupSize, opts.Param("compression"))
+		},
+		Batch: func(cfg *config.Config) config.BatchSize {
+			return cfg.Batch.FileAvro()
+		},
+	})
+}
+
+// NewArchiver returns an archiver that stores data in parquet files in
+// the specified path. A zero batch size or row group size and a blank
+// compression use the defaults.
+func NewArchiver(path string, batch config.BatchSize, rowGroupSize int, compression string) (storage.FileArchiver, error) {
+	codec, err := Compression(compression)
+	if err != nil {
+		return nil, err
+	}
+	if rowGroupSize < 0 {
+		return nil, fmt.Errorf("row group size can't be negative")
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("path %q is not a directory", path)
+	}
+
+	a := &ParquetArchiver{
+		path:         path,
+		batch:        batch,
+		rowGroupSize: rowGroupSize,
+		compression:  codec,
+	}
+	return a, nil
+}
+
+// Compression returns the parquet codec for the name
+func Compression(name string) (compress.Compression, error) {
+	switch strings.ToLower(name) {
+	case "", "zstd":
+		return compress.Codecs.Zstd, nil
+	case "snappy":
+		return compress.Codecs.Snappy, nil
+	case "gzip":
+		return compress.Codecs.Gzip, nil
+	case "none", "uncompressed":
+		return compress.Codecs.Uncompressed, nil
+	default:
+		return compress.Codecs.Uncompressed, fmt.Errorf("unknown parquet compression %q", name)
+	}
+}
+
+// BatchSizeMinMaxTime returns the minimum and maximum batch size
+func (a *ParquetArchiver) BatchSizeMinMaxTime() (int, int, time.Duration) {
+	bs := a.batch
+	if bs.MaxSize == 0 {
+		bs = defaultBatch
+	}
+	return bs.MinSize, bs.MaxSize, bs.Interval
+}
+
+// FileName returns the suggested filename for the given logscores
+func (a *ParquetArchiver) FileName(logscores []*logscore.LogScore) string {
+	if len(logscores) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d.parquet", logscores[0].Ts, logscores[0].ID)
+}
+
+// Store is for the Archiver interface
+func (a *ParquetArchiver) Store(ctx context.Context, logscores []*logscore.LogScore) (int, error) {
+	if len(logscores) == 0 {
+		log.Printf("no input data!")
+		return 0, nil
+	}
+
+	return a.StoreStream(ctx, storage.Stream(logscores))
+}
+
+// StoreStream is for the StreamArchiver interface, the file is
+// named after the first log score received
+func (a *ParquetArchiver) StoreStream(ctx context.Context, logscores <-chan *logscore.LogScore) (int, error) {
+	first, ok := <-logscores
+	if !ok {
+		log.Printf("no input data!")
+		return 0, nil
+	}
+
+	fileName := a.FileName([]*logscore.LogScore{first})
+	fileName = path.Join(a.path, fileName)
+
+	fh, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return 0, fmt.Errorf("open file %q: %s", fileName, err)
+	}
+
+	info, err := a.storeStreamWriter(ctx, fh, first, logscores)
+	if err != nil {
+		fh.Close()
+		os.Remove(fileName)
+		return 0, err
+	}
+
+	err = fh.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	err = storage.AppendManifest(a.path, storage.ManifestEntry{
+		File:    path.Base(fileName),
+		FirstID: info.First.ID,
+		LastID:  info.Last.ID,
+		Count:   int64(info.Count),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Count, nil
+}
+
+// Manifest returns the files recorded in the manifest
+func (a *ParquetArchiver) Manifest() ([]storage.ManifestEntry, error) {
+	return storage.ReadManifest(a.path)
+}
+
+// VerifyRange is for the Verifier interface; it checks the range
+// against the files in the manifest
+func (a *ParquetArchiver) VerifyRange(ctx context.Context, firstID, lastID, count int64) error {
+	entries, err := a.Manifest()
+	if err != nil {
+		return err
+	}
+	return storage.VerifyManifest(ctx, entries, firstID, lastID, count, a.countIDs)
+}
+
+func (a *ParquetArchiver) countIDs(ctx context.Context, name string, firstID, lastID int64) (int64, error) {
+	fh, err := os.Open(path.Join(a.path, name))
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	return CountIDs(ctx, fh, firstID, lastID)
+}
+
+// CountIDs returns the number of rows in the parquet file with ids
+// from firstID to lastID (inclusive). Only the id column is read.
+func CountIDs(ctx context.Context, r parquet.ReaderAtSeeker, firstID, lastID int64) (int64, error) {
+	pr, err := file.NewParquetReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer pr.Close()
+
+	fr, err := pqarrow.NewFileReader(pr, pqarrow.ArrowReadProperties{BatchSize: 64 * 1024}, memory.DefaultAllocator)
+	if err != nil {
+		return 0, err
+	}
+
+	rr, err := fr.GetRecordReader(ctx, []int{0}, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer rr.Release()
+
+	var n int64
+	for rr.Next() {
+		ids, ok := rr.Record().Column(0).(*array.Int64)
+		if !ok {
+			return 0, fmt.Errorf("id column is %s", rr.Record().Column(0).DataType())
+		}
+		for _, id := range ids.Int64Values() {
+			if id >= firstID && id <= lastID {
+				n++
+			}
+		}
+	}
+	if err := rr.Err(); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// StoreWriter is like store, but writes to the specified ReadWriter
+func (a *ParquetArchiver) StoreWriter(ctx context.Context, fh io.ReadWriter, logscores []*logscore.LogScore) (int, error) {
+	info, err := a.StoreStreamWriter(ctx, fh, storage.Stream(logscores))
+	return info.Count, err
+}
+
+// StoreStreamWriter is like StoreStream, but writes to the specified Writer
+func (a *ParquetArchiver) StoreStreamWriter(ctx context.Context, fh io.Writer, logscores <-chan *logscore.LogScore) (storage.BatchInfo, error) {
+	first, ok := <-logscores
+	if !ok {
+		log.Printf("no input data!")
+		return storage.BatchInfo{}, nil
+	}
+	return a.storeStreamWriter(ctx, fh, first, logscores)
+}
+
+// writer hides the Close method of the file from the parquet writer,
+// which would otherwise close it when the parquet file is finished
+type writer struct {
+	io.Writer
+}
+
+func (a *ParquetArchiver) storeStreamWriter(ctx context.Context, fh io.Writer, first *logscore.LogScore, logscores <-chan *logscore.LogScore) (storage.BatchInfo, error) {
+	log.Println("Running Parquet File batcher")
+
+	info := storage.BatchInfo{First: first}
+
+	rowGroupSize := a.rowGroupSize
+	if rowGroupSize <= 0 {
+		rowGroupSize = defaultRowGroupSize
+	}
+
+	props := parquet.NewWriterProperties(
+		parquet.WithCompression(a.compression),
+		parquet.WithMaxRowGroupLength(int64(rowGroupSize)),
+	)
+
+	w, err := pqarrow.NewFileWriter(schema, writer{fh}, props, pqarrow.DefaultWriterProps())
+	if err != nil {
+		return info, fmt.Errorf("parquet writer: %s", err)
+	}
+
+	b := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer b.Release()
+
+	rows := 0
+
+	// each row group is written as a record
+	flush := func() error {
+		rec := b.NewRecord()
+		defer rec.Release()
+		if err := w.Write(rec); err != nil {
+			return fmt.Errorf("write row group: %s", err)
+		}
+		info.Count += rows
+		rows = 0
+		return nil
+	}
+
+	add := func(ls *logscore.LogScore) error {
+		appendRow(b, ls)
+		info.Last = ls
+		rows++
+
+		if rows >= rowGroupSize {
+			return flush()
+		}
+		return nil
+	}
+
+	if err := add(first); err != nil {
+		return info, err
+	}
+	for ls := range logscores {
+		if err := ctx.Err(); err != nil {
+			return info, err
+		}
+		if err := add(ls); err != nil {
+			return info, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return info, err
+	}
+
+	if rows > 0 {
+		if err := flush(); err != nil {
+			return info, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return info, fmt.Errorf("close parquet writer: %s", err)
+	}
+
+	return info, nil
+}
+
+// appendRow adds the log score to the record builder, with the same
+// conversions as the avro files
+func appendRow(b *array.RecordBuilder, ls *logscore.LogScore) {
+	b.Field(0).(*array.Int64Builder).Append(ls.ID)
+	b.Field(1).(*array.Int32Builder).Append(int32(ls.ServerID))
+	b.Field(2).(*array.Int32Builder).Append(int32(ls.MonitorID))
+	b.Field(3).(*array.TimestampBuilder).Append(arrow.Timestamp(ls.Ts * int64(time.Second/time.Microsecond)))
+	b.Field(4).(*array.Float32Builder).Append(float32(ls.Score))
+	b.Field(5).(*array.Float32Builder).Append(float32(ls.Step))
+
+	if ls.Offset == nil {
+		b.Field(6).AppendNull()
+	} else {
+		b.Field(6).(*array.Float32Builder).Append(float32(*ls.Offset))
+	}
+
+	if ls.RTT == nil {
+		b.Field(7).AppendNull()
+	} else {
+		b.Field(7).(*array.Int32Builder).Append(int32(*ls.RTT))
+	}
+
+	if ls.Meta.Leap == 0 {
+		b.Field(8).AppendNull()
+	} else {
+		b.Field(8).(*array.Int32Builder).Append(int32(ls.Meta.Leap))
+	}
+
+	if len(ls.Meta.Error) == 0 {
+		b.Field(9).AppendNull()
+	} else {
+		b.Field(9).(*array.StringBuilder).Append(ls.Meta.Error)
+	}
+}
+
+// Close finishes up the archiver
+func (a *ParquetArchiver) Close() error {
+	return nil
+}
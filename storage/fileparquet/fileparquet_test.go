@@ -0,0 +1,163 @@
+package fileparquet
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet"
+	"github.com/apache/arrow/go/v15/parquet/compress"
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/logscore"
+	"go.ntppool.org/archiver/storage"
+)
+
+func testLogScores(n int) []*logscore.LogScore {
+	offset := 0.0015
+	rtt := int64(25000)
+
+	logscores := make([]*logscore.LogScore, n)
+	for i := range logscores {
+		logscores[i] = &logscore.LogScore{
+			ID:        int64(1000 + i),
+			ServerID:  int64(40 + i%3),
+			MonitorID: 30,
+			Ts:        1640995400 + int64(i)*60,
+			Score:     19.5,
+			Step:      1,
+		}
+		if i%2 == 0 {
+			logscores[i].Offset = &offset
+			logscores[i].RTT = &rtt
+		} else {
+			logscores[i].Meta = logscore.LogScoreMetadata{Leap: 1, Error: "i/o timeout"}
+		}
+	}
+	return logscores
+}
+
+func TestNewArchiver(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := NewArchiver(filepath.Join(dir, "missing"), config.BatchSize{}, 0, "")
+	assert.Error(t, err)
+
+	_, err = NewArchiver(dir, config.BatchSize{}, 0, "lz77")
+	assert.ErrorContains(t, err, "unknown parquet compression")
+
+	a, err := NewArchiver(dir, config.BatchSize{}, 0, "")
+	require.NoError(t, err)
+	assert.Equal(t, compress.Codecs.Zstd, a.(*ParquetArchiver).compression)
+
+	min, max, interval := a.BatchSizeMinMaxTime()
+	assert.Equal(t, defaultBatch.MinSize, min)
+	assert.Equal(t, defaultBatch.MaxSize, max)
+	assert.Equal(t, defaultBatch.Interval, interval)
+}
+
+func TestStoreStream(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := NewArchiver(dir, config.BatchSize{}, 4, "snappy")
+	require.NoError(t, err)
+
+	logscores := testLogScores(10)
+
+	count, err := a.StoreStream(context.Background(), storage.Stream(logscores))
+	require.NoError(t, err)
+	assert.Equal(t, 10, count)
+
+	fileName := filepath.Join(dir, "1640995400-1000.parquet")
+	require.FileExists(t, fileName)
+
+	// 10 rows in row groups of 4
+	r, err := file.OpenParquetFile(fileName, false)
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, int64(10), r.NumRows())
+	assert.Equal(t, 3, r.NumRowGroups())
+	cc, err := r.MetaData().RowGroup(0).ColumnChunk(0)
+	require.NoError(t, err)
+	assert.Equal(t, compress.Codecs.Snappy, cc.Compression())
+
+	entries, err := a.(*ParquetArchiver).Manifest()
+	require.NoError(t, err)
+	assert.Equal(t, []storage.ManifestEntry{
+		{File: "1640995400-1000.parquet", FirstID: 1000, LastID: 1009, Count: 10},
+	}, entries)
+	assert.NoError(t, a.(*ParquetArchiver).VerifyRange(context.Background(), 1000, 1009, 10))
+	// the file is only partly in the range, so the rows are counted
+	assert.NoError(t, a.(*ParquetArchiver).VerifyRange(context.Background(), 1003, 1006, 4))
+	assert.Error(t, a.(*ParquetArchiver).VerifyRange(context.Background(), 1003, 1006, 5))
+
+	count, err = a.StoreStream(context.Background(), storage.Stream(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestStoreStreamWriter(t *testing.T) {
+	a, err := NewArchiver(t.TempDir(), config.BatchSize{}, 0, "")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	info, err := a.StoreStreamWriter(context.Background(), &buf, storage.Stream(testLogScores(3)))
+	require.NoError(t, err)
+	assert.Equal(t, 3, info.Count)
+	assert.Equal(t, int64(1000), info.First.ID)
+	assert.Equal(t, int64(1002), info.Last.ID)
+
+	tbl, err := pqarrow.ReadTable(context.Background(), bytes.NewReader(buf.Bytes()),
+		parquet.NewReaderProperties(memory.DefaultAllocator), pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	require.NoError(t, err)
+	defer tbl.Release()
+
+	// the same columns, the reader adds field id metadata
+	for i, f := range tbl.Schema().Fields() {
+		assert.Equal(t, schema.Field(i).Name, f.Name)
+		assert.True(t, arrow.TypeEqual(schema.Field(i).Type, f.Type), f.Name)
+		assert.Equal(t, schema.Field(i).Nullable, f.Nullable, f.Name)
+	}
+	require.Equal(t, int64(3), tbl.NumRows())
+
+	col := func(name string) arrow.Array {
+		idx := tbl.Schema().FieldIndices(name)[0]
+		return tbl.Column(idx).Data().Chunk(0)
+	}
+
+	assert.Equal(t, []int64{1000, 1001, 1002}, col("id").(*array.Int64).Int64Values())
+	assert.Equal(t, []int32{40, 41, 42}, col("server_id").(*array.Int32).Int32Values())
+	assert.Equal(t, "2022-01-01 00:03:20Z", col("ts").(*array.Timestamp).ValueStr(0))
+	assert.Equal(t, float32(0.0015), col("offset").(*array.Float32).Value(0))
+	assert.True(t, col("offset").IsNull(1))
+	assert.Equal(t, int32(25000), col("rtt").(*array.Int32).Value(0))
+	assert.True(t, col("leap").IsNull(0))
+	assert.Equal(t, int32(1), col("leap").(*array.Int32).Value(1))
+	assert.Equal(t, "i/o timeout", col("error").(*array.String).Value(1))
+}
+
+func TestStoreStreamCancelled(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := NewArchiver(dir, config.BatchSize{}, 0, "")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = a.StoreStream(ctx, storage.Stream(testLogScores(3)))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files, "the partial file is removed")
+}
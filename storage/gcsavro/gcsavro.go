@@ -6,24 +6,55 @@ import (
 	"io"
 	"log"
 	"os"
+	"path"
+	"strconv"
 	"time"
 
 	gstorage "cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 
+	"go.ntppool.org/archiver/config"
 	"go.ntppool.org/archiver/logscore"
 	"go.ntppool.org/archiver/storage"
 	"go.ntppool.org/archiver/storage/fileavro"
+	"go.ntppool.org/archiver/storage/fileparquet"
 )
 
 type gcsAvroArchiver struct {
-	fileAvro   storage.FileArchiver
-	bucketName string
-	tempdir    string
+	fileAvro    storage.FileArchiver
+	bucketName  string
+	contentType string
+	tempdir     string
 }
 
-// NewArchiver returns an archiver that stores data in avro files in the specified path
-func NewArchiver() (storage.Archiver, error) {
-	bucketName := os.Getenv("gc_bucket")
+func init() {
+	storage.Register(storage.Backend{
+		Name:        "gcsavro",
+		Description: "Avro files uploaded to Google Cloud Storage",
+		Params: []storage.Param{
+			{Name: "bucket", Env: "gc_bucket", Help: "GCS bucket name", Required: true},
+			{Name: "format", Env: "gc_format", Help: "File format, avro (default) or parquet"},
+		},
+		New: func(ctx context.Context, opts storage.Options) (storage.Archiver, error) {
+			if opts.Param("format") == "parquet" {
+				return NewParquetArchiver(opts.Param("bucket"), opts.Batch)
+			}
+			if f := opts.Param("format"); f != "" && f != "avro" {
+				return nil, fmt.Errorf("unknown gc_format %q", f)
+			}
+			return NewArchiver(opts.Param("bucket"), opts.Batch,
+				opts.Config.Batch.FileAvroAppendSize, opts.Config.Storage.AvroCompression)
+		},
+		Batch: func(cfg *config.Config) config.BatchSize {
+			return cfg.Batch.FileAvro()
+		},
+	})
+}
+
+// NewArchiver returns an archiver that uploads avro files to the GCS
+// bucket. The batch and append sizes and the compression are passed to
+// the avro writer.
+func NewArchiver(bucketName string, batch config.BatchSize, appendSize int, compression string) (storage.Archiver, error) {
 	if len(bucketName) == 0 {
 		return nil, fmt.Errorf("gc_bucket must be set")
 	}
@@ -33,15 +64,45 @@ func NewArchiver() (storage.Archiver, error) {
 		return nil, err
 	}
 
-	fa, err := fileavro.NewArchiver(tempdir)
+	fa, err := fileavro.NewArchiver(tempdir, batch, appendSize, compression)
 	if err != nil {
+		os.RemoveAll(tempdir)
 		return nil, err
 	}
 
 	a := &gcsAvroArchiver{
-		fileAvro:   fa,
-		bucketName: bucketName,
-		tempdir:    tempdir,
+		fileAvro:    fa,
+		bucketName:  bucketName,
+		contentType: "avro/binary",
+		tempdir:     tempdir,
+	}
+
+	return a, nil
+}
+
+// NewParquetArchiver returns an archiver that uploads parquet files
+// to the GCS bucket, with the default compression and row groups.
+func NewParquetArchiver(bucketName string, batch config.BatchSize) (storage.Archiver, error) {
+	if len(bucketName) == 0 {
+		return nil, fmt.Errorf("gc_bucket must be set")
+	}
+
+	tempdir, err := os.MkdirTemp("", "gcsavro")
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := fileparquet.NewArchiver(tempdir, batch, 0, "")
+	if err != nil {
+		os.RemoveAll(tempdir)
+		return nil, err
+	}
+
+	a := &gcsAvroArchiver{
+		fileAvro:    fp,
+		bucketName:  bucketName,
+		contentType: "application/vnd.apache.parquet",
+		tempdir:     tempdir,
 	}
 
 	return a, nil
@@ -56,43 +117,59 @@ func (a *gcsAvroArchiver) BatchSizeMinMaxTime() (int, int, time.Duration) {
 	return a.fileAvro.BatchSizeMinMaxTime()
 }
 
-func (a *gcsAvroArchiver) Store(logscores []*logscore.LogScore) (int, error) {
-	fh, err := os.CreateTemp("", "gcsavro-")
+func (a *gcsAvroArchiver) Store(ctx context.Context, logscores []*logscore.LogScore) (int, error) {
+	return a.StoreStream(ctx, storage.Stream(logscores))
+}
+
+// StoreStream writes the log scores to a temporary file and
+// uploads it when the channel is closed
+func (a *gcsAvroArchiver) StoreStream(ctx context.Context, logscores <-chan *logscore.LogScore) (int, error) {
+	fh, err := os.CreateTemp(a.tempdir, "gcsavro-")
 	if err != nil {
 		return 0, err
 	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
 
 	// log.Printf("Temp FH: %s", fh.Name())
 
-	n, err := a.fileAvro.StoreWriter(fh, logscores)
+	info, err := a.fileAvro.StoreStreamWriter(ctx, fh, logscores)
 	if err != nil {
 		return 0, err
 	}
+	if info.Count == 0 {
+		return 0, nil
+	}
+
 	_, err = fh.Seek(0, 0)
 	if err != nil {
 		return 0, err
 	}
 
-	fileName := a.fileAvro.(*fileavro.AvroArchiver).FileName(logscores)
-	year := time.Unix(logscores[0].Ts, 0).UTC().Year()
+	fileName := a.fileAvro.FileName([]*logscore.LogScore{info.First})
+	year := time.Unix(info.First.Ts, 0).UTC().Year()
 	fileName = fmt.Sprintf("%d/%s", year, fileName)
 
-	err = a.Upload(fh, fileName)
+	metadata := map[string]string{
+		"first_id": strconv.FormatInt(info.First.ID, 10),
+		"last_id":  strconv.FormatInt(info.Last.ID, 10),
+		"count":    strconv.Itoa(info.Count),
+	}
+
+	err = a.Upload(ctx, fh, fileName, metadata)
 	if err != nil {
 		return 0, err
 	}
 
-	err = fh.Close()
-
-	os.Remove(fh.Name())
-
-	return n, err
+	return info.Count, fh.Close()
 }
 
-func (a *gcsAvroArchiver) Upload(fh io.ReadWriteCloser, path string) error {
+// Upload copies the file to the bucket with the metadata set on the
+// object. Cancelling the context aborts the upload without creating
+// the object.
+func (a *gcsAvroArchiver) Upload(ctx context.Context, fh io.ReadWriteCloser, path string, metadata map[string]string) error {
 	log.Printf("Uploading to %s/%s", a.bucketName, path)
 
-	ctx := context.Background()
 	client, err := gstorage.NewClient(ctx)
 	if err != nil {
 		return err
@@ -101,8 +178,9 @@ func (a *gcsAvroArchiver) Upload(fh io.ReadWriteCloser, path string) error {
 	bucket := client.Bucket(a.bucketName).UserProject("ntppool")
 	obj := bucket.Object(path)
 	wc := obj.NewWriter(ctx)
-	wc.ContentType = "avro/binary"
+	wc.ContentType = a.contentType
 	wc.CacheControl = "public, max-age=157248000"
+	wc.Metadata = metadata
 
 	if _, err = io.Copy(wc, fh); err != nil {
 		return err
@@ -113,3 +191,166 @@ func (a *gcsAvroArchiver) Upload(fh io.ReadWriteCloser, path string) error {
 
 	return nil
 }
+
+// Manifest returns the id range and row count for the objects in the
+// bucket that can have ids from firstID to lastID, from the metadata
+// set when they were uploaded. Objects uploaded without the metadata
+// are read to count their rows.
+func (a *gcsAvroArchiver) Manifest(ctx context.Context, firstID, lastID int64) ([]storage.ManifestEntry, error) {
+	client, err := gstorage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(a.bucketName).UserProject("ntppool")
+
+	metadata := map[string]map[string]string{}
+	names := []string{}
+
+	it := bucket.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		metadata[attrs.Name] = attrs.Metadata
+		names = append(names, attrs.Name)
+	}
+
+	entries := []storage.ManifestEntry{}
+
+	for _, name := range storage.OverlappingFiles(names, firstID, lastID) {
+		entry, ok := manifestEntry(name, metadata[name])
+		if !ok {
+			log.Printf("%s doesn't have the id metadata, reading it", name)
+			entry, ok, err = storage.ScanFile(ctx, a, name)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Files is for the Reader interface; it returns the avro objects in
+// the bucket
+func (a *gcsAvroArchiver) Files(ctx context.Context) ([]string, error) {
+	client, err := gstorage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(a.bucketName).UserProject("ntppool")
+
+	files := []string{}
+
+	it := bucket.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Ext(attrs.Name) != ".avro" {
+			continue
+		}
+		files = append(files, attrs.Name)
+	}
+
+	return files, nil
+}
+
+// ReadFile is for the Reader interface; it downloads and decodes the
+// avro object
+func (a *gcsAvroArchiver) ReadFile(ctx context.Context, name string, fn func(*logscore.LogScore) error) error {
+	if path.Ext(name) != ".avro" {
+		return fmt.Errorf("%s: only avro files can be read", name)
+	}
+
+	client, err := gstorage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	r, err := client.Bucket(a.bucketName).UserProject("ntppool").Object(name).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	defer r.Close()
+
+	return fileavro.Decode(ctx, r, fn)
+}
+
+// manifestEntry parses the object metadata set by StoreStream
+func manifestEntry(name string, metadata map[string]string) (storage.ManifestEntry, bool) {
+	entry := storage.ManifestEntry{File: name}
+
+	var err error
+	if entry.FirstID, err = strconv.ParseInt(metadata["first_id"], 10, 64); err != nil {
+		return entry, false
+	}
+	if entry.LastID, err = strconv.ParseInt(metadata["last_id"], 10, 64); err != nil {
+		return entry, false
+	}
+	if entry.Count, err = strconv.ParseInt(metadata["count"], 10, 64); err != nil {
+		return entry, false
+	}
+
+	return entry, true
+}
+
+// VerifyRange is for the Verifier interface; it checks the range
+// against the metadata of the objects in the bucket
+func (a *gcsAvroArchiver) VerifyRange(ctx context.Context, firstID, lastID, count int64) error {
+	entries, err := a.Manifest(ctx, firstID, lastID)
+	if err != nil {
+		return err
+	}
+	return storage.VerifyManifest(ctx, entries, firstID, lastID, count, a.countIDs)
+}
+
+// countIDs counts the rows in the range in an avro or parquet object
+func (a *gcsAvroArchiver) countIDs(ctx context.Context, name string, firstID, lastID int64) (int64, error) {
+	if path.Ext(name) != ".parquet" {
+		return storage.ReaderIDCounter(a)(ctx, name, firstID, lastID)
+	}
+
+	client, err := gstorage.NewClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	r, err := client.Bucket(a.bucketName).UserProject("ntppool").Object(name).NewReader(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	defer r.Close()
+
+	// parquet files are read from the end, so it's downloaded first
+	fh, err := os.CreateTemp(a.tempdir, "gcsavro-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if _, err := io.Copy(fh, r); err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return fileparquet.CountIDs(ctx, fh, firstID, lastID)
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// ManifestFile lists the files written to an archive directory, one
+// JSON encoded ManifestEntry per line
+const ManifestFile = "manifest.jsonl"
+
+// AppendManifest records the file in the manifest in dir
+func AppendManifest(dir string, entry ManifestEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.OpenFile(path.Join(dir, ManifestFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return fmt.Errorf("open manifest: %s", err)
+	}
+	if _, err := fh.Write(append(b, '\n')); err != nil {
+		fh.Close()
+		return fmt.Errorf("write manifest: %s", err)
+	}
+	return fh.Close()
+}
+
+// ReadManifest returns the files recorded in the manifest in dir
+func ReadManifest(dir string) ([]ManifestEntry, error) {
+	fh, err := os.Open(path.Join(dir, ManifestFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fh.Close()
+
+	entries := []ManifestEntry{}
+	dec := json.NewDecoder(fh)
+	for {
+		var e ManifestEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("manifest: %s", err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Migrator is implemented by archivers that manage the schema of the
+// database they store to with versioned migrations
+type Migrator interface {
+	// Migrations returns the known migrations and when they were
+	// applied, in version order
+	Migrations(ctx context.Context) ([]Migration, error)
+
+	// Migrate applies the pending migrations in version order and
+	// returns the ones that were applied
+	Migrate(ctx context.Context) ([]Migration, error)
+}
+
+// Migration is a schema migration and when it was applied (zero if
+// it's pending)
+type Migration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+// Applied returns true if the migration has been applied
+func (m Migration) Applied() bool {
+	return !m.AppliedAt.IsZero()
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.ntppool.org/archiver/config"
+)
+
+// Factory creates an archiver from the options
+type Factory func(ctx context.Context, opts Options) (Archiver, error)
+
+// Param is a configuration setting for a backend, read from the
+// environment variable Env. For a named instance of the backend the
+// variable is suffixed with the instance name, for example ch_dsn_primary
+// for "clickhouse:primary".
+type Param struct {
+	Name     string
+	Env      string
+	Help     string
+	Required bool
+}
+
+// Backend describes an archiver type that can be used in
+// log_scores_archive_status
+type Backend struct {
+	Name        string
+	Description string
+	Params      []Param
+	New         Factory
+
+	// Batch returns the default batch sizing from the configuration,
+	// it's nil for backends that don't store batches.
+	Batch func(cfg *config.Config) config.BatchSize
+
+	// Connect creates the archiver for the migrate and maintenance
+	// commands without applying or checking the schema, as New does.
+	// It's nil if New doesn't change the schema.
+	Connect Factory
+}
+
+// Options are passed to the Factory when creating an archiver
+type Options struct {
+	// Name is the archiver name from log_scores_archive_status
+	Name string
+
+	// Instance is the part of the name after the colon for a named
+	// instance of the backend, or blank
+	Instance string
+
+	// Config is the validated application configuration
+	Config *config.Config
+
+	// Batch is the batch sizing for the archiver, including any
+	// override for its name
+	Batch config.BatchSize
+
+	params map[string]string
+}
+
+// Param returns the value of the named backend parameter
+func (opts Options) Param(name string) string {
+	return opts.params[name]
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]Backend{}
+)
+
+// Register makes a backend available by its name. It's meant to be
+// called from the init function of the package implementing the
+// backend and panics if the name is registered twice.
+func Register(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if b.New == nil {
+		panic("storage: Register factory is nil for " + b.Name)
+	}
+	if _, dup := backends[b.Name]; dup {
+		panic("storage: Register called twice for " + b.Name)
+	}
+	backends[b.Name] = b
+}
+
+// Backends returns the registered backends sorted by name
+func Backends() []Backend {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	list := make([]Backend, 0, len(backends))
+	for _, b := range backends {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Lookup returns the backend registered with the name
+func Lookup(name string) (Backend, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	b, ok := backends[name]
+	return b, ok
+}
+
+// Configured returns true if all required parameters are set for
+// the named instance (or the default instance if blank)
+func (b Backend) Configured(cfg *config.Config, instance string) bool {
+	return len(b.missing(instance, b.params(cfg, instance))) == 0
+}
+
+// Instances returns the names of the instances that have at least
+// one parameter set in the environment
+func (b Backend) Instances() []string {
+	envs := make([]string, 0, len(b.Params))
+	for _, p := range b.Params {
+		envs = append(envs, p.Env)
+	}
+	return config.Instances(envs...)
+}
+
+// EnvName returns the environment variable for the parameter
+// for the named instance
+func (p Param) EnvName(instance string) string {
+	return config.InstanceEnv(p.Env, instance)
+}
+
+func (b Backend) params(cfg *config.Config, instance string) map[string]string {
+	params := map[string]string{}
+	for _, p := range b.Params {
+		params[p.Name] = cfg.Storage.Setting(p.Env, instance)
+	}
+	return params
+}
+
+// missing returns the environment variables for the required
+// parameters that aren't set
+func (b Backend) missing(instance string, params map[string]string) []string {
+	missing := []string{}
+	for _, p := range b.Params {
+		if p.Required && len(params[p.Name]) == 0 {
+			missing = append(missing, p.EnvName(instance))
+		}
+	}
+	return missing
+}
+
+// ParseName splits an archiver name like "clickhouse:primary" into
+// the backend name and the instance name. The instance is blank if
+// the name doesn't have one.
+func ParseName(name string) (string, string, error) {
+	backend, instance, found := strings.Cut(name, ":")
+	if !found {
+		return name, "", nil
+	}
+	if err := config.ValidInstanceName(instance); err != nil {
+		return "", "", fmt.Errorf("archiver '%s': %w", name, err)
+	}
+	return backend, instance, nil
+}
+
+// BatchSize returns the batch sizing for the named archiver without
+// setting it up. The second return value is true if the sizing is an
+// override for the archiver; ok is false if the backend is unknown or
+// doesn't store batches.
+func BatchSize(name string, cfg *config.Config) (bs config.BatchSize, override bool, ok bool) {
+	backend, _, err := ParseName(name)
+	if err != nil {
+		return bs, false, false
+	}
+	b, found := Lookup(backend)
+	if !found || b.Batch == nil {
+		return bs, false, false
+	}
+	bs, override = cfg.Batch.For(name, b.Batch(cfg))
+	return bs, override, true
+}
+
+// New returns the archiver for the name used in log_scores_archive_status,
+// either a backend name or "backend:instance" for a named instance with
+// its own settings. If cfg is nil the configuration is loaded from the
+// environment.
+func New(ctx context.Context, name string, cfg *config.Config) (Archiver, error) {
+	b, opts, err := options(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return b.New(ctx, opts)
+}
+
+// Connect is like New, but uses the Connect factory of the backend if
+// it has one, so the schema isn't changed or checked; it's for the
+// migrate command.
+func Connect(ctx context.Context, name string, cfg *config.Config) (Archiver, error) {
+	b, opts, err := options(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if b.Connect == nil {
+		return b.New(ctx, opts)
+	}
+	return b.Connect(ctx, opts)
+}
+
+// options returns the backend and its options for the archiver name
+func options(name string, cfg *config.Config) (Backend, Options, error) {
+	backend, instance, err := ParseName(name)
+	if err != nil {
+		return Backend{}, Options{}, err
+	}
+
+	b, ok := Lookup(backend)
+	if !ok {
+		return Backend{}, Options{}, fmt.Errorf("unknown archiver '%s'", name)
+	}
+
+	if cfg == nil {
+		cfg, err = config.LoadGlobalConfig()
+		if err != nil {
+			return Backend{}, Options{}, fmt.Errorf("loading config: %w", err)
+		}
+	}
+
+	params := b.params(cfg, instance)
+	if missing := b.missing(instance, params); len(missing) > 0 {
+		return Backend{}, Options{}, fmt.Errorf("%s: %v not set", name, missing)
+	}
+
+	opts := Options{
+		Name:     name,
+		Instance: instance,
+		Config:   cfg,
+		params:   params,
+	}
+	if b.Batch != nil {
+		opts.Batch, _ = cfg.Batch.For(name, b.Batch(cfg))
+	}
+
+	return b, opts, nil
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/logscore"
+)
+
+type registryArchiver struct {
+	target string
+	batch  config.BatchSize
+}
+
+func (a *registryArchiver) BatchSizeMinMaxTime() (int, int, time.Duration) {
+	return 1, 10, time.Minute
+}
+
+func (a *registryArchiver) Store(ctx context.Context, ls []*logscore.LogScore) (int, error) {
+	return len(ls), nil
+}
+
+func (a *registryArchiver) Close() error {
+	return nil
+}
+
+func registerTestBackend(t *testing.T, name string) {
+	t.Helper()
+
+	Register(Backend{
+		Name:        name,
+		Description: "test backend",
+		Params: []Param{
+			{Name: "target", Env: "test_registry_target", Help: "where to store", Required: true},
+			{Name: "opt", Env: "test_registry_opt", Help: "optional"},
+		},
+		New: func(ctx context.Context, opts Options) (Archiver, error) {
+			return &registryArchiver{target: opts.Param("target"), batch: opts.Batch}, nil
+		},
+		Batch: func(cfg *config.Config) config.BatchSize {
+			return cfg.Batch.ClickHouse()
+		},
+	})
+	t.Cleanup(func() {
+		backendsMu.Lock()
+		delete(backends, name)
+		backendsMu.Unlock()
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	registerTestBackend(t, "test-registry")
+
+	b, ok := Lookup("test-registry")
+	require.True(t, ok)
+	assert.Equal(t, "test backend", b.Description)
+
+	names := []string{}
+	for _, b := range Backends() {
+		names = append(names, b.Name)
+	}
+	assert.Contains(t, names, "test-registry")
+	assert.IsNonDecreasing(t, names)
+
+	t.Setenv("test_registry_target", "")
+	assert.False(t, b.Configured(&config.Config{}, ""))
+
+	_, err := New(context.Background(), "test-registry", &config.Config{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "test_registry_target")
+
+	t.Setenv("test_registry_target", "somewhere")
+	assert.True(t, b.Configured(&config.Config{}, ""))
+
+	arch, err := New(context.Background(), "test-registry", &config.Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "somewhere", arch.(*registryArchiver).target)
+}
+
+func TestRegistryInstance(t *testing.T) {
+	registerTestBackend(t, "test-instance")
+
+	t.Setenv("test_registry_target", "default")
+	t.Setenv("test_registry_target_primary", "primary")
+	t.Setenv("test_registry_opt_secondary", "x")
+
+	b, ok := Lookup("test-instance")
+	require.True(t, ok)
+	assert.Equal(t, []string{"primary", "secondary"}, b.Instances())
+	assert.True(t, b.Configured(&config.Config{}, "primary"))
+	assert.False(t, b.Configured(&config.Config{}, "secondary"))
+
+	arch, err := New(context.Background(), "test-instance:primary", &config.Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "primary", arch.(*registryArchiver).target)
+
+	// named instances don't fall back to the default settings
+	_, err = New(context.Background(), "test-instance:secondary", &config.Config{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "test_registry_target_secondary")
+}
+
+func TestRegistryBatchSize(t *testing.T) {
+	registerTestBackend(t, "test-batch")
+	t.Setenv("test_registry_target_big", "x")
+
+	cfg := &config.Config{
+		Storage: config.Storage{AvroPath: "/tmp"},
+		App: config.App{
+			DefaultTable:  "log_scores",
+			ValidTables:   []string{"log_scores"},
+			RetentionDays: 15,
+		},
+		Batch: config.Batch{
+			BigQueryMinSize:   1,
+			BigQueryMaxSize:   1,
+			ClickHouseMinSize: 50,
+			ClickHouseMaxSize: 500,
+			FileAvroMinSize:   1,
+			FileAvroMaxSize:   1,
+			Overrides:         "test-batch:big=1000/5000/1h",
+		},
+	}
+	require.NoError(t, cfg.PostProcess())
+
+	bs, override, ok := BatchSize("test-batch", cfg)
+	assert.True(t, ok)
+	assert.False(t, override)
+	assert.Equal(t, config.BatchSize{MinSize: 50, MaxSize: 500}, bs)
+
+	bs, override, ok = BatchSize("test-batch:big", cfg)
+	assert.True(t, ok)
+	assert.True(t, override)
+	assert.Equal(t, config.BatchSize{MinSize: 1000, MaxSize: 5000, Interval: time.Hour}, bs)
+
+	arch, err := New(context.Background(), "test-batch:big", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, bs, arch.(*registryArchiver).batch)
+
+	_, _, ok = BatchSize("no-such-backend", cfg)
+	assert.False(t, ok)
+}
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		name     string
+		backend  string
+		instance string
+		err      bool
+	}{
+		{"clickhouse", "clickhouse", "", false},
+		{"clickhouse:primary", "clickhouse", "primary", false},
+		{"clickhouse:new_cluster2", "clickhouse", "new_cluster2", false},
+		{"clickhouse:", "", "", true},
+		{"clickhouse:a-b", "", "", true},
+		{"clickhouse:a:b", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, instance, err := ParseName(tt.name)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.backend, backend)
+			assert.Equal(t, tt.instance, instance)
+		})
+	}
+}
+
+func TestRegistryConnect(t *testing.T) {
+	registerTestBackend(t, "test-connect")
+	t.Setenv("test_registry_target", "somewhere")
+
+	// without a Connect factory the archiver is made with New
+	arch, err := Connect(context.Background(), "test-connect", &config.Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "somewhere", arch.(*registryArchiver).target)
+
+	backendsMu.Lock()
+	b := backends["test-connect"]
+	b.Connect = func(ctx context.Context, opts Options) (Archiver, error) {
+		return &registryArchiver{target: "connected to " + opts.Param("target")}, nil
+	}
+	backends["test-connect"] = b
+	backendsMu.Unlock()
+
+	arch, err = Connect(context.Background(), "test-connect", &config.Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "connected to somewhere", arch.(*registryArchiver).target)
+
+	_, err = Connect(context.Background(), "no-such-backend", &config.Config{})
+	assert.ErrorContains(t, err, "unknown archiver")
+}
+
+func TestRegistryUnknown(t *testing.T) {
+	_, err := New(context.Background(), "no-such-backend", &config.Config{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown archiver")
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	registerTestBackend(t, "test-duplicate")
+
+	assert.Panics(t, func() {
+		registerTestBackend(t, "test-duplicate")
+	})
+}
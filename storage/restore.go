@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.ntppool.org/archiver/logscore"
+)
+
+// Reader is implemented by archivers that can read back the files they
+// stored, to restore log scores into the database or to backfill
+// another archiver.
+type Reader interface {
+	// Files returns the names of the archive files
+	Files(ctx context.Context) ([]string, error)
+
+	// ReadFile calls fn for each log score in the file, stopping at
+	// the first error
+	ReadFile(ctx context.Context, name string, fn func(*logscore.LogScore) error) error
+}
+
+// FileStart returns the timestamp and id of the first log score in an
+// archive file from its name ("2022/1640995200-123.avro"). The second
+// return value is false if the name isn't an archive file name.
+func FileStart(name string) (int64, int64, bool) {
+	base := path.Base(name)
+	if ext := path.Ext(base); len(ext) > 0 {
+		base = strings.TrimSuffix(base, ext)
+	}
+	tsStr, idStr, found := strings.Cut(base, "-")
+	if !found {
+		return 0, 0, false
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return ts, id, true
+}
+
+// fileSlack is how far outside the time range files are still read;
+// a file's name only has the time of its first row and the rows are
+// ordered by id, not strictly by time.
+const fileSlack = time.Hour
+
+// Filter selects the log scores to read from archive files. Zero
+// values match everything.
+type Filter struct {
+	ServerID int64
+	Since    time.Time // inclusive
+	Until    time.Time // exclusive
+	BeforeID int64     // exclusive
+}
+
+// Match returns true if the log score is selected by the filter
+func (f Filter) Match(ls *logscore.LogScore) bool {
+	if f.ServerID != 0 && ls.ServerID != f.ServerID {
+		return false
+	}
+	if !f.Since.IsZero() && ls.Ts < f.Since.Unix() {
+		return false
+	}
+	if !f.Until.IsZero() && ls.Ts >= f.Until.Unix() {
+		return false
+	}
+	if f.BeforeID != 0 && ls.ID >= f.BeforeID {
+		return false
+	}
+	return true
+}
+
+// SelectFiles returns the archive files that can have rows selected by
+// the filter, ordered by their first row. Each file is assumed to have
+// the rows until the next file starts. Names that aren't archive file
+// names are skipped.
+func SelectFiles(names []string, filter Filter) []string {
+	type file struct {
+		name string
+		ts   int64
+		id   int64
+	}
+
+	files := []file{}
+	for _, name := range names {
+		ts, id, ok := FileStart(name)
+		if !ok {
+			continue
+		}
+		files = append(files, file{name, ts, id})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].ts == files[j].ts {
+			return files[i].id < files[j].id
+		}
+		return files[i].ts < files[j].ts
+	})
+
+	slack := int64(fileSlack / time.Second)
+
+	selected := []string{}
+	for i, f := range files {
+		if !filter.Until.IsZero() && f.ts >= filter.Until.Unix()+slack {
+			break
+		}
+		if filter.BeforeID != 0 && f.id >= filter.BeforeID {
+			break
+		}
+		if !filter.Since.IsZero() && i+1 < len(files) && files[i+1].ts < filter.Since.Unix()-slack {
+			continue
+		}
+		selected = append(selected, f.name)
+	}
+
+	return selected
+}
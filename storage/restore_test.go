@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.ntppool.org/archiver/logscore"
+)
+
+func TestFileStart(t *testing.T) {
+	ts, id, ok := FileStart("2022/1640995200-123.avro")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1640995200), ts)
+	assert.Equal(t, int64(123), id)
+
+	ts, id, ok = FileStart("1640995200-123.parquet")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1640995200), ts)
+	assert.Equal(t, int64(123), id)
+
+	for _, name := range []string{"manifest.jsonl", "2022/abc-1.avro", "2022/1-x.avro", ""} {
+		_, _, ok := FileStart(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	ls := &logscore.LogScore{ID: 100, ServerID: 20, Ts: 1640995200}
+
+	assert.True(t, Filter{}.Match(ls))
+	assert.True(t, Filter{ServerID: 20, BeforeID: 101}.Match(ls))
+	assert.False(t, Filter{ServerID: 21}.Match(ls))
+	assert.False(t, Filter{BeforeID: 100}.Match(ls))
+
+	assert.True(t, Filter{Since: time.Unix(1640995200, 0)}.Match(ls))
+	assert.False(t, Filter{Since: time.Unix(1640995201, 0)}.Match(ls))
+	assert.True(t, Filter{Until: time.Unix(1640995201, 0)}.Match(ls))
+	assert.False(t, Filter{Until: time.Unix(1640995200, 0)}.Match(ls))
+}
+
+func TestSelectFiles(t *testing.T) {
+	day := func(d int) int64 {
+		return time.Date(2022, 1, d, 0, 0, 0, 0, time.UTC).Unix()
+	}
+	names := []string{
+		fmt.Sprintf("2022/%d-300.avro", day(3)),
+		fmt.Sprintf("2022/%d-100.avro", day(1)),
+		fmt.Sprintf("2022/%d-200.avro", day(2)),
+		"manifest.jsonl",
+	}
+
+	assert.Equal(t, []string{names[1], names[2], names[0]}, SelectFiles(names, Filter{}))
+
+	// the rows from the 2nd are in the file starting on the 2nd
+	assert.Equal(t, []string{names[2]}, SelectFiles(names, Filter{
+		Since: time.Date(2022, 1, 2, 6, 0, 0, 0, time.UTC),
+		Until: time.Date(2022, 1, 2, 12, 0, 0, 0, time.UTC),
+	}))
+
+	// the last file has everything after it started
+	assert.Equal(t, []string{names[0]}, SelectFiles(names, Filter{
+		Since: time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC),
+	}))
+
+	// rows just before midnight can be in the next file
+	assert.Equal(t, []string{names[1], names[2]}, SelectFiles(names, Filter{
+		Until: time.Date(2022, 1, 1, 23, 30, 0, 0, time.UTC),
+	}))
+
+	// files starting at or after the id have nothing before it
+	assert.Equal(t, []string{names[1], names[2]}, SelectFiles(names, Filter{BeforeID: 300}))
+}
@@ -0,0 +1,478 @@
+// Package s3avro stores avro files in S3 compatible object storage
+// (AWS S3, MinIO, Ceph, Cloudflare R2), named like the gcsavro files.
+package s3avro
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/logscore"
+	"go.ntppool.org/archiver/storage"
+	"go.ntppool.org/archiver/storage/fileavro"
+)
+
+const (
+	defaultEndpoint = "https://s3.amazonaws.com"
+
+	// defaultPartSize is the part size for multipart uploads; files
+	// up to this size are uploaded with a single request
+	defaultPartSize = 64 << 20
+)
+
+// Options configure the connection to the object storage
+type Options struct {
+	// Endpoint is the URL of the S3 API, http:// for no TLS
+	Endpoint string
+	Bucket   string
+	Region   string
+
+	// AccessKey and SecretKey are the credentials; without them
+	// the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+	// variables or the instance IAM role are used
+	AccessKey string
+	SecretKey string
+
+	// Prefix is prepended to the object names
+	Prefix string
+
+	// PartSize is the multipart upload part size in bytes
+	PartSize uint64
+
+	// Checksum is the checksum the server verifies for each upload
+	// (CRC32C, CRC32, SHA1 or SHA256)
+	Checksum string
+
+	// transport is used instead of the default HTTP transport in tests
+	transport http.RoundTripper
+}
+
+type s3AvroArchiver struct {
+	fileAvro storage.FileArchiver
+	client   *minio.Client
+	opts     Options
+	checksum minio.ChecksumType
+	tempdir  string
+}
+
+func init() {
+	storage.Register(storage.Backend{
+		Name:        "s3avro",
+		Description: "Avro files uploaded to S3 compatible object storage",
+		Params: []storage.Param{
+			{Name: "bucket", Env: "s3_bucket", Help: "Bucket name", Required: true},
+			{Name: "endpoint", Env: "s3_endpoint", Help: "S3 API URL (default " + defaultEndpoint + ")"},
+			{Name: "region", Env: "s3_region", Help: "Bucket region"},
+			{Name: "access_key", Env: "s3_access_key_id", Help: "Access key (default from AWS_ACCESS_KEY_ID or IAM)"},
+			{Name: "secret_key", Env: "s3_secret_access_key", Help: "Secret key"},
+			{Name: "prefix", Env: "s3_prefix", Help: "Prefix for the object names"},
+			{Name: "part_size", Env: "s3_part_size", Help: "Multipart upload part size in bytes (default 64MiB)"},
+			{Name: "checksum", Env: "s3_checksum", Help: "Upload checksum: CRC32C (default), CRC32, SHA1 or SHA256"},
+		},
+		New: func(ctx context.Context, opts storage.Options) (storage.Archiver, error) {
+			o := Options{
+				Endpoint:  opts.Param("endpoint"),
+				Bucket:    opts.Param("bucket"),
+				Region:    opts.Param("region"),
+				AccessKey: opts.Param("access_key"),
+				SecretKey: opts.Param("secret_key"),
+				Prefix:    opts.Param("prefix"),
+				Checksum:  opts.Param("checksum"),
+			}
+			if ps := opts.Param("part_size"); ps != "" {
+				var err error
+				o.PartSize, err = strconv.ParseUint(ps, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("s3_part_size: %w", err)
+				}
+			}
+			return NewArchiver(o, opts.Batch,
+				opts.Config.Batch.FileAvroAppendSize, opts.Config.Storage.AvroCompression)
+		},
+		Batch: func(cfg *config.Config) config.BatchSize {
+			return cfg.Batch.FileAvro()
+		},
+	})
+}
+
+// NewArchiver returns an archiver that uploads avro files to the
+// bucket. The batch and append sizes and the compression are passed to
+// the avro writer.
+func NewArchiver(opts Options, batch config.BatchSize, appendSize int, compression string) (storage.Archiver, error) {
+	if len(opts.Bucket) == 0 {
+		return nil, fmt.Errorf("s3_bucket must be set")
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = defaultEndpoint
+	}
+	if opts.PartSize == 0 {
+		opts.PartSize = defaultPartSize
+	}
+
+	checksum, err := checksumType(opts.Checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tempdir, err := os.MkdirTemp("", "s3avro")
+	if err != nil {
+		return nil, err
+	}
+
+	fa, err := fileavro.NewArchiver(tempdir, batch, appendSize, compression)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		return nil, err
+	}
+
+	a := &s3AvroArchiver{
+		fileAvro: fa,
+		client:   client,
+		opts:     opts,
+		checksum: checksum,
+		tempdir:  tempdir,
+	}
+
+	return a, nil
+}
+
+func newClient(opts Options) (*minio.Client, error) {
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3_endpoint: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("s3_endpoint %q must be a URL like https://s3.example.com", opts.Endpoint)
+	}
+
+	var creds *credentials.Credentials
+	if opts.AccessKey != "" {
+		creds = credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.IAM{},
+		})
+	}
+
+	return minio.New(u.Host, &minio.Options{
+		Creds:     creds,
+		Secure:    u.Scheme != "http",
+		Region:    opts.Region,
+		Transport: opts.transport,
+	})
+}
+
+// checksumType returns the minio checksum for the setting
+func checksumType(name string) (minio.ChecksumType, error) {
+	switch strings.ToUpper(name) {
+	case "", "CRC32C":
+		return minio.ChecksumCRC32C, nil
+	case "CRC32":
+		return minio.ChecksumCRC32, nil
+	case "SHA1":
+		return minio.ChecksumSHA1, nil
+	case "SHA256":
+		return minio.ChecksumSHA256, nil
+	default:
+		return minio.ChecksumNone, fmt.Errorf("unknown s3_checksum %q", name)
+	}
+}
+
+func (a *s3AvroArchiver) Close() error {
+	os.RemoveAll(a.tempdir)
+	return nil
+}
+
+func (a *s3AvroArchiver) BatchSizeMinMaxTime() (int, int, time.Duration) {
+	return a.fileAvro.BatchSizeMinMaxTime()
+}
+
+func (a *s3AvroArchiver) Store(ctx context.Context, logscores []*logscore.LogScore) (int, error) {
+	return a.StoreStream(ctx, storage.Stream(logscores))
+}
+
+// StoreStream writes the log scores to a temporary file and
+// uploads it when the channel is closed
+func (a *s3AvroArchiver) StoreStream(ctx context.Context, logscores <-chan *logscore.LogScore) (int, error) {
+	fh, err := os.CreateTemp(a.tempdir, "s3avro-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	info, err := a.fileAvro.StoreStreamWriter(ctx, fh, logscores)
+	if err != nil {
+		return 0, err
+	}
+	if info.Count == 0 {
+		return 0, nil
+	}
+
+	size, err := fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	_, err = fh.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	fileName := a.fileAvro.FileName([]*logscore.LogScore{info.First})
+	year := time.Unix(info.First.Ts, 0).UTC().Year()
+	fileName = fmt.Sprintf("%s%d/%s", a.opts.Prefix, year, fileName)
+
+	// like the gcsavro metadata, but with dashes as some proxies
+	// drop headers with underscores
+	metadata := map[string]string{
+		"first-id": strconv.FormatInt(info.First.ID, 10),
+		"last-id":  strconv.FormatInt(info.Last.ID, 10),
+		"count":    strconv.Itoa(info.Count),
+	}
+
+	err = a.Upload(ctx, fh, size, fileName, metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Count, fh.Close()
+}
+
+// Upload copies size bytes from r to the bucket with the metadata set
+// on the object. Files larger than the part size are uploaded in
+// parts; the server checks the checksum of each part. If the upload
+// fails or the context is cancelled the object isn't created.
+func (a *s3AvroArchiver) Upload(ctx context.Context, r io.Reader, size int64, path string, metadata map[string]string) error {
+	log.Printf("Uploading to s3://%s/%s", a.opts.Bucket, path)
+
+	_, err := a.client.PutObject(ctx, a.opts.Bucket, path, r, size, minio.PutObjectOptions{
+		ContentType:  "avro/binary",
+		CacheControl: "public, max-age=157248000",
+		UserMetadata: metadata,
+		PartSize:     a.opts.PartSize,
+		AutoChecksum: a.checksum,
+	})
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Manifest returns the id range and row count for the objects under
+// the prefix that can have ids from firstID to lastID, from the
+// metadata set when they were uploaded. Only the years that can have
+// the ids are listed. Objects uploaded without the metadata are read
+// to count their rows.
+func (a *s3AvroArchiver) Manifest(ctx context.Context, firstID, lastID int64) ([]storage.ManifestEntry, error) {
+	years, err := a.years(ctx, firstID, lastID)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, year := range years {
+		objects := a.client.ListObjects(ctx, a.opts.Bucket, minio.ListObjectsOptions{
+			Prefix:    year,
+			Recursive: true,
+		})
+		for obj := range objects {
+			if obj.Err != nil {
+				return nil, obj.Err
+			}
+			names = append(names, obj.Key)
+		}
+	}
+
+	entries := []storage.ManifestEntry{}
+
+	for _, name := range storage.OverlappingFiles(names, firstID, lastID) {
+		// the listing doesn't include the user metadata
+		info, err := a.client.StatObject(ctx, a.opts.Bucket, name, minio.StatObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		entry, ok := manifestEntry(name, info.UserMetadata)
+		if !ok {
+			log.Printf("%s doesn't have the id metadata, reading it", name)
+			entry, ok, err = storage.ScanFile(ctx, a, name)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// years returns the year "directories" under the prefix that can have
+// objects with ids from firstID to lastID. The objects are named by
+// the time of their first row, so the first object of a year has its
+// lowest id and the year has the ids until the next year starts.
+func (a *s3AvroArchiver) years(ctx context.Context, firstID, lastID int64) ([]string, error) {
+	type year struct {
+		prefix string
+		id     int64
+	}
+
+	years := []year{}
+
+	prefixes := a.client.ListObjects(ctx, a.opts.Bucket, minio.ListObjectsOptions{
+		Prefix: a.opts.Prefix,
+	})
+	for obj := range prefixes {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if !strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(obj.Key, a.opts.Prefix), "/")); err != nil {
+			continue
+		}
+
+		key, err := a.firstKey(ctx, obj.Key)
+		if err != nil {
+			return nil, err
+		}
+		if _, id, ok := storage.FileStart(key); ok {
+			years = append(years, year{obj.Key, id})
+		}
+	}
+
+	sort.Slice(years, func(i, j int) bool {
+		return years[i].id < years[j].id
+	})
+
+	selected := []string{}
+	for i, y := range years {
+		if y.id > lastID {
+			break
+		}
+		if i+1 < len(years) && years[i+1].id <= firstID {
+			continue
+		}
+		selected = append(selected, y.prefix)
+	}
+
+	return selected, nil
+}
+
+// firstKey returns the name of the first object under the prefix, or
+// an empty string if there isn't any
+func (a *s3AvroArchiver) firstKey(ctx context.Context, prefix string) (string, error) {
+	// stop the listing after the first object
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objects := a.client.ListObjects(ctx, a.opts.Bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+		MaxKeys:   1,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			return "", obj.Err
+		}
+		return obj.Key, nil
+	}
+
+	return "", nil
+}
+
+// Files is for the Reader interface; it returns the avro objects under
+// the prefix
+func (a *s3AvroArchiver) Files(ctx context.Context) ([]string, error) {
+	files := []string{}
+
+	objects := a.client.ListObjects(ctx, a.opts.Bucket, minio.ListObjectsOptions{
+		Prefix:    a.opts.Prefix,
+		Recursive: true,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if path.Ext(obj.Key) != ".avro" {
+			continue
+		}
+		files = append(files, obj.Key)
+	}
+
+	return files, nil
+}
+
+// ReadFile is for the Reader interface; it downloads and decodes the
+// avro object
+func (a *s3AvroArchiver) ReadFile(ctx context.Context, name string, fn func(*logscore.LogScore) error) error {
+	obj, err := a.client.GetObject(ctx, a.opts.Bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	defer obj.Close()
+
+	return fileavro.Decode(ctx, obj, fn)
+}
+
+// manifestEntry parses the object metadata set by StoreStream
+func manifestEntry(name string, metadata map[string]string) (storage.ManifestEntry, bool) {
+	entry := storage.ManifestEntry{File: name}
+
+	// the metadata keys are canonicalized like HTTP headers
+	get := func(key string) string {
+		for k, v := range metadata {
+			if strings.EqualFold(k, key) {
+				return v
+			}
+		}
+		return ""
+	}
+
+	var err error
+	if entry.FirstID, err = strconv.ParseInt(get("first-id"), 10, 64); err != nil {
+		return entry, false
+	}
+	if entry.LastID, err = strconv.ParseInt(get("last-id"), 10, 64); err != nil {
+		return entry, false
+	}
+	if entry.Count, err = strconv.ParseInt(get("count"), 10, 64); err != nil {
+		return entry, false
+	}
+
+	return entry, true
+}
+
+// VerifyRange is for the Verifier interface; it checks the range
+// against the metadata of the objects in the bucket
+func (a *s3AvroArchiver) VerifyRange(ctx context.Context, firstID, lastID, count int64) error {
+	entries, err := a.Manifest(ctx, firstID, lastID)
+	if err != nil {
+		return err
+	}
+	return storage.VerifyManifest(ctx, entries, firstID, lastID, count, storage.ReaderIDCounter(a))
+}
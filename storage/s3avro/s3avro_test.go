@@ -0,0 +1,177 @@
+package s3avro
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/config"
+	"go.ntppool.org/archiver/logscore"
+	"go.ntppool.org/archiver/storage"
+)
+
+// setupArchiver returns an archiver using an in-memory S3 server
+func setupArchiver(t *testing.T, opts Options) *s3AvroArchiver {
+	backend := s3mem.New()
+	fake := gofakes3.New(backend).Server()
+
+	// gofakes3 treats the empty delimiter minio sends when listing
+	// recursively as a delimiter; it's served with TLS as it doesn't
+	// support the chunked uploads minio uses without it
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Has("delimiter") && q.Get("delimiter") == "" {
+			q.Del("delimiter")
+			r.URL.RawQuery = q.Encode()
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	opts.transport = srv.Client().Transport
+
+	require.NoError(t, backend.CreateBucket("archive"))
+
+	opts.Endpoint = srv.URL
+	opts.Bucket = "archive"
+	opts.AccessKey = "test"
+	opts.SecretKey = "test"
+
+	a, err := NewArchiver(opts, config.BatchSize{}, 0, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+
+	return a.(*s3AvroArchiver)
+}
+
+func TestNewArchiver(t *testing.T) {
+	_, err := NewArchiver(Options{}, config.BatchSize{}, 0, "")
+	assert.ErrorContains(t, err, "s3_bucket")
+
+	_, err = NewArchiver(Options{Bucket: "archive", Endpoint: "s3.example.com"}, config.BatchSize{}, 0, "")
+	assert.ErrorContains(t, err, "must be a URL")
+
+	_, err = NewArchiver(Options{Bucket: "archive", Checksum: "md5"}, config.BatchSize{}, 0, "")
+	assert.ErrorContains(t, err, "unknown s3_checksum")
+
+	a, err := NewArchiver(Options{Bucket: "archive", Checksum: "sha256"}, config.BatchSize{}, 0, "")
+	require.NoError(t, err)
+	defer a.Close()
+	assert.Equal(t, minio.ChecksumSHA256, a.(*s3AvroArchiver).checksum)
+	assert.Equal(t, uint64(defaultPartSize), a.(*s3AvroArchiver).opts.PartSize)
+}
+
+func TestStoreStream(t *testing.T) {
+	a := setupArchiver(t, Options{Prefix: "avro/"})
+	ctx := context.Background()
+
+	logscores := []*logscore.LogScore{
+		{ID: 300, ServerID: 40, MonitorID: 30, Ts: 1640995400, Score: 19.5, Step: 1},
+		{ID: 301, ServerID: 41, MonitorID: 31, Ts: 1640995460, Score: 19.0, Step: 1},
+		{ID: 302, ServerID: 42, MonitorID: 32, Ts: 1640995520, Score: 18.5, Step: 1},
+	}
+
+	count, err := a.StoreStream(ctx, storage.Stream(logscores))
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	obj, err := a.client.GetObject(ctx, "archive", "avro/2022/1640995400-300.avro", minio.GetObjectOptions{})
+	require.NoError(t, err)
+	data, err := io.ReadAll(obj)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(data, []byte("Obj\x01")), "avro file")
+
+	entries, err := a.Manifest(ctx, 300, 302)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.ManifestEntry{
+		{File: "avro/2022/1640995400-300.avro", FirstID: 300, LastID: 302, Count: 3},
+	}, entries)
+
+	assert.NoError(t, a.VerifyRange(ctx, 300, 302, 3))
+	assert.Error(t, a.VerifyRange(ctx, 300, 310, 5))
+
+	count, err = a.StoreStream(ctx, storage.Stream(nil))
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestUploadMultipart(t *testing.T) {
+	// the smallest part size S3 allows
+	a := setupArchiver(t, Options{PartSize: 5 << 20})
+	ctx := context.Background()
+
+	data := make([]byte, 11<<20)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	err = a.Upload(ctx, bytes.NewReader(data), int64(len(data)), "2022/large.avro", nil)
+	require.NoError(t, err)
+
+	obj, err := a.client.GetObject(ctx, "archive", "2022/large.avro", minio.GetObjectOptions{})
+	require.NoError(t, err)
+	got, err := io.ReadAll(obj)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestManifestEntry(t *testing.T) {
+	entry, ok := manifestEntry("2022/a.avro", map[string]string{
+		"First-Id": "1", "Last-Id": "10", "Count": "10",
+	})
+	assert.True(t, ok)
+	assert.Equal(t, storage.ManifestEntry{File: "2022/a.avro", FirstID: 1, LastID: 10, Count: 10}, entry)
+
+	// uploaded before the metadata was added
+	_, ok = manifestEntry("2022/b.avro", map[string]string{})
+	assert.False(t, ok)
+}
+
+func TestVerifyRangeYears(t *testing.T) {
+	a := setupArchiver(t, Options{Prefix: "avro/"})
+	ctx := context.Background()
+
+	// 2021 and 2022 as uploaded by StoreStream
+	for _, logscores := range [][]*logscore.LogScore{
+		{{ID: 1, Ts: 1609459200}, {ID: 2, Ts: 1609459260}, {ID: 3, Ts: 1609459320}},
+		{{ID: 4, Ts: 1640995200}, {ID: 6, Ts: 1640995260}},
+	} {
+		_, err := a.StoreStream(ctx, storage.Stream(logscores))
+		require.NoError(t, err)
+	}
+
+	// 2023 uploaded without the metadata
+	var buf bytes.Buffer
+	_, err := a.fileAvro.StoreWriter(ctx, &buf, []*logscore.LogScore{{ID: 7, Ts: 1672531200}, {ID: 8, Ts: 1672531260}})
+	require.NoError(t, err)
+	require.NoError(t, a.Upload(ctx, &buf, int64(buf.Len()), "avro/2023/1672531200-7.avro", nil))
+
+	years, err := a.years(ctx, 7, 8)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"avro/2023/"}, years)
+
+	years, err = a.years(ctx, 3, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"avro/2021/", "avro/2022/"}, years)
+
+	entries, err := a.Manifest(ctx, 7, 8)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.ManifestEntry{
+		{File: "avro/2023/1672531200-7.avro", FirstID: 7, LastID: 8, Count: 2},
+	}, entries)
+
+	assert.NoError(t, a.VerifyRange(ctx, 1, 8, 7))
+	assert.Error(t, a.VerifyRange(ctx, 1, 8, 8))
+
+	// the rows of the 2021 file before the range don't count
+	assert.NoError(t, a.VerifyRange(ctx, 3, 7, 4))
+	assert.Error(t, a.VerifyRange(ctx, 3, 7, 5))
+}
@@ -3,11 +3,17 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"time"
 
 	"go.ntppool.org/archiver/db"
 )
 
+// DefaultTable is the source table for status rows that don't have
+// a table_name set (or when log_scores_archive_status doesn't have
+// the table_name column).
+const DefaultTable = "log_scores"
+
 // ArchiveStatus is the data structure from the log_scores_archive_status
 // table, keeping track of the last copied log_score for each archive type.
 type ArchiveStatus struct {
@@ -17,14 +23,21 @@ type ArchiveStatus struct {
 	ModifiedOn time.Time     `db:"modified_on"`
 }
 
-// GetArchiveStatus returns a list of archivers and their status
-func GetArchiveStatus(ctx context.Context) ([]ArchiveStatus, error) {
+// GetArchiveStatus returns a list of archivers and their status for
+// the source table
+func GetArchiveStatus(ctx context.Context, table string) ([]ArchiveStatus, error) {
 	statuses := []ArchiveStatus{}
 
-	err := db.Pool.Select(ctx, &statuses,
+	where, args, err := StatusScope(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Pool.Select(ctx, &statuses,
 		`select id, archiver, log_score_id, modified_on
-		from log_scores_archive_status
+		from log_scores_archive_status`+where+`
 		order by log_score_id, modified_on`,
+		args...,
 	)
 	if err != nil {
 		return nil, err
@@ -33,6 +46,41 @@ func GetArchiveStatus(ctx context.Context) ([]ArchiveStatus, error) {
 	return statuses, nil
 }
 
+// StatusScope returns the where clause (with a leading space) and
+// arguments selecting the log_scores_archive_status rows for the
+// source table. If the status table doesn't have a table_name column
+// all rows are for DefaultTable and the where clause only matches
+// anything for that table.
+func StatusScope(ctx context.Context, table string) (string, []any, error) {
+	scoped, err := hasStatusTableName(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if !scoped {
+		if table == DefaultTable {
+			return "", nil, nil
+		}
+		return " where 1=0", nil, nil
+	}
+	return " where coalesce(table_name, ?) = ?", []any{DefaultTable, table}, nil
+}
+
+// hasStatusTableName checks if log_scores_archive_status has the
+// table_name column for scoping the status rows to a source table
+func hasStatusTableName(ctx context.Context) (bool, error) {
+	var count int
+	err := db.Pool.Get(ctx, &count,
+		`select count(*) from information_schema.columns
+		where table_schema = database()
+		  and table_name = 'log_scores_archive_status'
+		  and column_name = 'table_name'`,
+	)
+	if err != nil {
+		return false, fmt.Errorf("checking for table_name column: %w", err)
+	}
+	return count > 0, nil
+}
+
 // SetStatus updates the "last ID" status for the given archiver
 func (status *ArchiveStatus) SetStatus(ctx context.Context, lastID int64) error {
 	var logScoreID sql.NullInt64
@@ -42,8 +90,8 @@ func (status *ArchiveStatus) SetStatus(ctx context.Context, lastID int64) error
 
 	_, err := db.Pool.Exec(ctx,
 		`update log_scores_archive_status
-			set log_score_id=?, modified_on=NOW() where archiver=?`,
-		logScoreID, status.Archiver,
+			set log_score_id=?, modified_on=NOW() where id=?`,
+		logScoreID, status.ID,
 	)
 	if err != nil {
 		return err
@@ -52,3 +100,27 @@ func (status *ArchiveStatus) SetStatus(ctx context.Context, lastID int64) error
 	status.LogScoreID = logScoreID
 	return nil
 }
+
+// SetStatusBackdated updates the status like SetStatus, but with
+// modified_on set backdate before now so the archiver is due again
+// that much sooner than its usual interval.
+func (status *ArchiveStatus) SetStatusBackdated(ctx context.Context, lastID int64, backdate time.Duration) error {
+	var logScoreID sql.NullInt64
+	if lastID > 0 {
+		logScoreID = sql.NullInt64{Int64: lastID, Valid: true}
+	}
+
+	seconds := int64(backdate.Seconds())
+
+	_, err := db.Pool.Exec(ctx,
+		`update log_scores_archive_status
+			set log_score_id=?, modified_on=NOW() - INTERVAL ? SECOND where id=?`,
+		logScoreID, seconds, status.ID,
+	)
+	if err != nil {
+		return err
+	}
+	status.ModifiedOn = time.Now().Add(-time.Duration(seconds) * time.Second)
+	status.LogScoreID = logScoreID
+	return nil
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.ntppool.org/archiver/db/dbtest"
+)
+
+func expectTableNameColumn(mock sqlmock.Sqlmock, count int) {
+	mock.ExpectQuery("select count\\(\\*\\) from information_schema.columns").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func TestGetArchiveStatusScoped(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	expectTableNameColumn(mock, 1)
+	mock.ExpectQuery("from log_scores_archive_status where coalesce\\(table_name, \\?\\) = \\?").
+		WithArgs("log_scores", "log_scores_test").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "archiver", "log_score_id", "modified_on"}).
+			AddRow(3, "clickhouse", 100, time.Unix(1640995200, 0)))
+
+	status, err := GetArchiveStatus(context.Background(), "log_scores_test")
+	require.NoError(t, err)
+	require.Len(t, status, 1)
+	assert.Equal(t, 3, status[0].ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStatusScope(t *testing.T) {
+	t.Run("without table_name column", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+
+		expectTableNameColumn(mock, 0)
+		where, args, err := StatusScope(context.Background(), "log_scores")
+		require.NoError(t, err)
+		assert.Empty(t, where)
+		assert.Empty(t, args)
+
+		// other tables don't share the status rows
+		expectTableNameColumn(mock, 0)
+		where, _, err = StatusScope(context.Background(), "log_scores_test")
+		require.NoError(t, err)
+		assert.Equal(t, " where 1=0", where)
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("with table_name column", func(t *testing.T) {
+		mock := dbtest.MockPool(t)
+
+		expectTableNameColumn(mock, 1)
+		where, args, err := StatusScope(context.Background(), "log_scores_archive")
+		require.NoError(t, err)
+		assert.Equal(t, " where coalesce(table_name, ?) = ?", where)
+		assert.Equal(t, []any{"log_scores", "log_scores_archive"}, args)
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestSetStatus(t *testing.T) {
+	mock := dbtest.MockPool(t)
+
+	mock.ExpectExec("update log_scores_archive_status\\s+set log_score_id=\\?, modified_on=NOW\\(\\) where id=\\?").
+		WithArgs(int64(500), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	status := &ArchiveStatus{ID: 3, Archiver: "clickhouse:primary"}
+	require.NoError(t, status.SetStatus(context.Background(), 500))
+	assert.Equal(t, int64(500), status.LogScoreID.Int64)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,22 +1,63 @@
 package storage
 
 import (
+	"context"
 	"io"
 	"time"
 
 	"go.ntppool.org/archiver/logscore"
 )
 
-// Archiver is the interface definition for storing data points externally
+// Archiver is the interface definition for storing data points externally.
+// When the context is cancelled the archiver should abort the batch
+// in progress and return an error.
 type Archiver interface {
 	BatchSizeMinMaxTime() (int, int, time.Duration)
-	Store(ls []*logscore.LogScore) (int, error)
+	Store(ctx context.Context, ls []*logscore.LogScore) (int, error)
 	Close() error
 	// Get(ServerID int) ([]LogScore, error)
 }
 
-// FileArchiver is like Archiver, but with an extra method to save data to a ReadWriter
-type FileArchiver interface {
+// StreamArchiver is an Archiver that can store log scores as they are
+// read from the source instead of getting the whole batch at once.
+type StreamArchiver interface {
 	Archiver
-	StoreWriter(io.ReadWriter, []*logscore.LogScore) (int, error)
+
+	// StoreStream stores log scores from the channel until it's closed.
+	// It may return early on errors; the caller drains the channel.
+	// If the context is cancelled the batch must be discarded rather
+	// than partially stored. The exception is an archiver where
+	// storing rows again is idempotent: it may keep the rows it already
+	// stored, as the batch isn't recorded and the next run stores it
+	// again without duplicating them.
+	StoreStream(context.Context, <-chan *logscore.LogScore) (int, error)
+}
+
+// FileArchiver is like Archiver, but with extra methods to save data to a writer
+type FileArchiver interface {
+	StreamArchiver
+	StoreWriter(context.Context, io.ReadWriter, []*logscore.LogScore) (int, error)
+	StoreStreamWriter(context.Context, io.Writer, <-chan *logscore.LogScore) (BatchInfo, error)
+
+	// FileName returns the file name for a batch starting with the
+	// first log score
+	FileName([]*logscore.LogScore) string
+}
+
+// BatchInfo describes a batch of log scores written by a FileArchiver
+type BatchInfo struct {
+	Count int
+	First *logscore.LogScore
+	Last  *logscore.LogScore
+}
+
+// Stream returns a closed channel with the log scores, to pass a batch
+// already in memory to StoreStream.
+func Stream(logscores []*logscore.LogScore) <-chan *logscore.LogScore {
+	ch := make(chan *logscore.LogScore, len(logscores))
+	for _, ls := range logscores {
+		ch <- ls
+	}
+	close(ch)
+	return ch
 }
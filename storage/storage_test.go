@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"testing"
@@ -8,30 +9,24 @@ import (
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
 	"go.ntppool.org/archiver/db"
+	"go.ntppool.org/archiver/db/dbtest"
 )
 
 // TestDatabaseConnectionFailures tests various database connection failure scenarios
 func TestDatabaseConnectionFailures(t *testing.T) {
 	t.Run("GetArchiveStatus database error", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// Mock database error
+		expectTableNameColumn(mock, 0)
 		mock.ExpectQuery("select id, archiver, log_score_id, modified_on").
 			WillReturnError(sql.ErrConnDone)
 
-		statuses, err := GetArchiveStatus()
+		statuses, err := GetArchiveStatus(context.Background(), DefaultTable)
 		assert.Error(t, err)
 		assert.Nil(t, statuses)
 		assert.Equal(t, sql.ErrConnDone, err)
@@ -40,25 +35,18 @@ func TestDatabaseConnectionFailures(t *testing.T) {
 	})
 
 	t.Run("GetArchiveStatus successful", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// Mock successful response
 		rows := sqlmock.NewRows([]string{"id", "archiver", "log_score_id", "modified_on"}).
 			AddRow(1, "fileavro", 12345, time.Now()).
 			AddRow(2, "clickhouse", nil, time.Now())
 
+		expectTableNameColumn(mock, 0)
 		mock.ExpectQuery("select id, archiver, log_score_id, modified_on").
 			WillReturnRows(rows)
 
-		statuses, err := GetArchiveStatus()
+		statuses, err := GetArchiveStatus(context.Background(), DefaultTable)
 		assert.NoError(t, err)
 		assert.Len(t, statuses, 2)
 		assert.Equal(t, "fileavro", statuses[0].Archiver)
@@ -70,15 +58,7 @@ func TestDatabaseConnectionFailures(t *testing.T) {
 	})
 
 	t.Run("SetStatus database error", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		status := &ArchiveStatus{
 			ID:         1,
@@ -89,10 +69,10 @@ func TestDatabaseConnectionFailures(t *testing.T) {
 
 		// Mock database error
 		mock.ExpectExec("update log_scores_archive_status").
-			WithArgs(sql.NullInt64{Int64: 200, Valid: true}, "test").
+			WithArgs(sql.NullInt64{Int64: 200, Valid: true}, 1).
 			WillReturnError(sql.ErrConnDone)
 
-		err = status.SetStatus(200)
+		err := status.SetStatus(context.Background(), 200)
 		assert.Error(t, err)
 		assert.Equal(t, sql.ErrConnDone, err)
 
@@ -100,15 +80,7 @@ func TestDatabaseConnectionFailures(t *testing.T) {
 	})
 
 	t.Run("SetStatus successful", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		status := &ArchiveStatus{
 			ID:         1,
@@ -119,10 +91,10 @@ func TestDatabaseConnectionFailures(t *testing.T) {
 
 		// Mock successful update
 		mock.ExpectExec("update log_scores_archive_status").
-			WithArgs(sql.NullInt64{Int64: 200, Valid: true}, "test").
+			WithArgs(sql.NullInt64{Int64: 200, Valid: true}, 1).
 			WillReturnResult(sqlmock.NewResult(1, 1))
 
-		err = status.SetStatus(200)
+		err := status.SetStatus(context.Background(), 200)
 		assert.NoError(t, err)
 		assert.Equal(t, int64(200), status.LogScoreID.Int64)
 		assert.True(t, status.LogScoreID.Valid)
@@ -131,15 +103,7 @@ func TestDatabaseConnectionFailures(t *testing.T) {
 	})
 
 	t.Run("SetStatus with zero lastID", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		status := &ArchiveStatus{
 			ID:         1,
@@ -150,10 +114,10 @@ func TestDatabaseConnectionFailures(t *testing.T) {
 
 		// Mock successful update with null value
 		mock.ExpectExec("update log_scores_archive_status").
-			WithArgs(sql.NullInt64{Valid: false}, "test").
+			WithArgs(sql.NullInt64{Valid: false}, 1).
 			WillReturnResult(sqlmock.NewResult(1, 1))
 
-		err = status.SetStatus(0)
+		err := status.SetStatus(context.Background(), 0)
 		assert.NoError(t, err)
 		assert.False(t, status.LogScoreID.Valid)
 
@@ -164,15 +128,7 @@ func TestDatabaseConnectionFailures(t *testing.T) {
 // TestLockAcquisitionFailures tests MySQL GET_LOCK failure scenarios
 func TestLockAcquisitionFailures(t *testing.T) {
 	t.Run("GET_LOCK database error", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// Mock database error for GET_LOCK
 		mock.ExpectQuery("SELECT GET_LOCK\\(\\?, 0\\)").
@@ -181,7 +137,7 @@ func TestLockAcquisitionFailures(t *testing.T) {
 
 		// Test the lock acquisition
 		var lock int
-		err = db.DB.Get(&lock, `SELECT GET_LOCK(?, 0)`, "test-lock")
+		err := db.Pool.Get(context.Background(), &lock, `SELECT GET_LOCK(?, 0)`, "test-lock")
 		assert.Error(t, err)
 		assert.Equal(t, sql.ErrConnDone, err)
 
@@ -189,15 +145,7 @@ func TestLockAcquisitionFailures(t *testing.T) {
 	})
 
 	t.Run("GET_LOCK returns 0 (lock not acquired)", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// Mock lock not acquired (returns 0)
 		rows := sqlmock.NewRows([]string{"GET_LOCK(?, 0)"}).AddRow(0)
@@ -207,7 +155,7 @@ func TestLockAcquisitionFailures(t *testing.T) {
 
 		// Test the lock acquisition
 		var lock int
-		err = db.DB.Get(&lock, `SELECT GET_LOCK(?, 0)`, "test-lock")
+		err := db.Pool.Get(context.Background(), &lock, `SELECT GET_LOCK(?, 0)`, "test-lock")
 		assert.NoError(t, err)
 		assert.Equal(t, 0, lock)
 
@@ -215,15 +163,7 @@ func TestLockAcquisitionFailures(t *testing.T) {
 	})
 
 	t.Run("GET_LOCK returns 1 (lock acquired)", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// Mock lock acquired (returns 1)
 		rows := sqlmock.NewRows([]string{"GET_LOCK(?, 0)"}).AddRow(1)
@@ -233,7 +173,7 @@ func TestLockAcquisitionFailures(t *testing.T) {
 
 		// Test the lock acquisition
 		var lock int
-		err = db.DB.Get(&lock, `SELECT GET_LOCK(?, 0)`, "test-lock")
+		err := db.Pool.Get(context.Background(), &lock, `SELECT GET_LOCK(?, 0)`, "test-lock")
 		assert.NoError(t, err)
 		assert.Equal(t, 1, lock)
 
@@ -241,15 +181,7 @@ func TestLockAcquisitionFailures(t *testing.T) {
 	})
 
 	t.Run("GET_LOCK returns NULL (error)", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// Mock lock error (returns NULL)
 		rows := sqlmock.NewRows([]string{"GET_LOCK(?, 0)"}).AddRow(nil)
@@ -259,7 +191,7 @@ func TestLockAcquisitionFailures(t *testing.T) {
 
 		// Test the lock acquisition
 		var lock sql.NullInt64
-		err = db.DB.Get(&lock, `SELECT GET_LOCK(?, 0)`, "test-lock")
+		err := db.Pool.Get(context.Background(), &lock, `SELECT GET_LOCK(?, 0)`, "test-lock")
 		assert.NoError(t, err)
 		assert.False(t, lock.Valid) // NULL value
 
@@ -270,22 +202,14 @@ func TestLockAcquisitionFailures(t *testing.T) {
 // TestNetworkFailures tests network-related failure scenarios
 func TestNetworkFailures(t *testing.T) {
 	t.Run("connection timeout", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// Mock connection timeout
 		mock.ExpectQuery("select count\\(\\*\\) from log_scores").
 			WillReturnError(sql.ErrConnDone)
 
 		var count int
-		err = db.DB.Get(&count, "select count(*) from log_scores")
+		err := db.Pool.Get(context.Background(), &count, "select count(*) from log_scores")
 		assert.Error(t, err)
 		assert.Equal(t, sql.ErrConnDone, err)
 
@@ -293,15 +217,7 @@ func TestNetworkFailures(t *testing.T) {
 	})
 
 	t.Run("transaction rollback on connection failure", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// Mock transaction begin, then connection failure
 		mock.ExpectBegin()
@@ -309,7 +225,7 @@ func TestNetworkFailures(t *testing.T) {
 		mock.ExpectRollback()
 
 		// Simulate transaction usage
-		tx, err := db.DB.Begin()
+		tx, err := db.Pool.Begin(context.Background())
 		assert.NoError(t, err)
 
 		_, err = tx.Prepare("INSERT INTO log_scores VALUES (?)")
@@ -326,15 +242,7 @@ func TestNetworkFailures(t *testing.T) {
 // TestDataIntegrityFailures tests data integrity and validation failure scenarios
 func TestDataIntegrityFailures(t *testing.T) {
 	t.Run("malformed JSON in attributes field", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// Mock data with invalid JSON
 		rows := sqlmock.NewRows([]string{
@@ -346,7 +254,7 @@ func TestDataIntegrityFailures(t *testing.T) {
 			WithArgs(int64(0), 100).
 			WillReturnRows(rows)
 
-		rows_result, err := db.DB.Query(
+		rows_result, err := db.Pool.Query(context.Background(),
 			"select id,monitor_id,server_id,UNIX_TIMESTAMP(ts),score,step,offset,attributes from log_scores where id > ? order by id limit ?",
 			int64(0), 100,
 		)
@@ -373,19 +281,11 @@ func TestDataIntegrityFailures(t *testing.T) {
 	})
 
 	t.Run("database constraint violation", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// Mock constraint violation error
 		mock.ExpectExec("update log_scores_archive_status").
-			WithArgs(sql.NullInt64{Int64: 200, Valid: true}, "test").
+			WithArgs(sql.NullInt64{Int64: 200, Valid: true}, 1).
 			WillReturnError(&mysql.MySQLError{
 				Number:  1062,
 				Message: "Duplicate entry",
@@ -398,7 +298,7 @@ func TestDataIntegrityFailures(t *testing.T) {
 			ModifiedOn: time.Now(),
 		}
 
-		err = status.SetStatus(200)
+		err := status.SetStatus(context.Background(), 200)
 		assert.Error(t, err)
 		// In a real scenario, we'd check for specific MySQL error types
 
@@ -409,15 +309,7 @@ func TestDataIntegrityFailures(t *testing.T) {
 // TestRecoveryScenarios tests how the system handles and recovers from various error conditions
 func TestRecoveryScenarios(t *testing.T) {
 	t.Run("retry after temporary database failure", func(t *testing.T) {
-		// Create a mock database
-		mockDB, mock, err := sqlmock.New()
-		require.NoError(t, err)
-		defer mockDB.Close()
-
-		// Replace the global db with our mock
-		originalDB := db.DB
-		db.DB = sqlx.NewDb(mockDB, "mysql")
-		defer func() { db.DB = originalDB }()
+		mock := dbtest.MockPool(t)
 
 		// First call fails, second succeeds
 		mock.ExpectQuery("select count\\(\\*\\) from log_scores").
@@ -430,11 +322,11 @@ func TestRecoveryScenarios(t *testing.T) {
 
 		// First attempt fails
 		var count int
-		err = db.DB.Get(&count, "select count(*) from log_scores")
+		err := db.Pool.Get(context.Background(), &count, "select count(*) from log_scores")
 		assert.Error(t, err)
 
 		// Second attempt succeeds
-		err = db.DB.Get(&count, "select count(*) from log_scores")
+		err = db.Pool.Get(context.Background(), &count, "select count(*) from log_scores")
 		assert.NoError(t, err)
 		assert.Equal(t, 100, count)
 
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.ntppool.org/archiver/logscore"
+)
+
+// Verifier is implemented by archivers that can check that they have
+// stored a range of rows, so the cleanup can refuse to delete rows
+// that might not have been archived.
+type Verifier interface {
+	// VerifyRange returns an error if the archiver doesn't have the
+	// count rows with ids from firstID to lastID (inclusive).
+	VerifyRange(ctx context.Context, firstID, lastID, count int64) error
+}
+
+// VerifyError is returned by VerifyRange when the archiver has fewer
+// rows in the range than expected
+type VerifyError struct {
+	FirstID  int64
+	LastID   int64
+	Expected int64
+	Found    int64
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("ids %d to %d: expected %d rows, found %d",
+		e.FirstID, e.LastID, e.Expected, e.Found)
+}
+
+// VerifyCount returns a VerifyError if found is less than expected
+func VerifyCount(firstID, lastID, expected, found int64) error {
+	if found < expected {
+		return &VerifyError{
+			FirstID:  firstID,
+			LastID:   lastID,
+			Expected: expected,
+			Found:    found,
+		}
+	}
+	return nil
+}
+
+// ManifestEntry describes the rows stored in an archive file
+type ManifestEntry struct {
+	File    string `json:"file"`
+	FirstID int64  `json:"first_id"`
+	LastID  int64  `json:"last_id"`
+	Count   int64  `json:"count"`
+}
+
+// IDCounter returns the number of rows in an archive file with ids from
+// firstID to lastID (inclusive)
+type IDCounter func(ctx context.Context, file string, firstID, lastID int64) (int64, error)
+
+// VerifyManifest checks the range against the archive files. The files
+// only record their first and last id and the number of rows, so this
+// checks that the files overlapping the range cover the first and last
+// id, don't overlap each other and have at least count rows. The rows
+// of files that are entirely in the range are counted from the
+// manifest; files that are only partly in the range are read with
+// countIDs, so their rows outside the range can't make up for rows
+// missing inside it. If a file is listed more than once (because it
+// was written again) the last entry is used.
+func VerifyManifest(ctx context.Context, entries []ManifestEntry, firstID, lastID, count int64, countIDs IDCounter) error {
+	files := map[string]ManifestEntry{}
+	for _, e := range entries {
+		files[e.File] = e
+	}
+
+	overlap := []ManifestEntry{}
+	for _, e := range files {
+		if e.LastID >= firstID && e.FirstID <= lastID {
+			overlap = append(overlap, e)
+		}
+	}
+	if len(overlap) == 0 {
+		return VerifyCount(firstID, lastID, count, 0)
+	}
+
+	sort.Slice(overlap, func(i, j int) bool {
+		return overlap[i].FirstID < overlap[j].FirstID
+	})
+
+	if overlap[0].FirstID > firstID {
+		return fmt.Errorf("ids %d to %d: no archive file has id %d (first file %s starts at %d)",
+			firstID, lastID, firstID, overlap[0].File, overlap[0].FirstID)
+	}
+
+	var found int64
+	covered := overlap[0].FirstID - 1
+	for _, e := range overlap {
+		if e.FirstID <= covered {
+			return fmt.Errorf("ids %d to %d: archive file %s overlaps the previous file",
+				firstID, lastID, e.File)
+		}
+		covered = e.LastID
+
+		if e.FirstID >= firstID && e.LastID <= lastID {
+			found += e.Count
+			continue
+		}
+		n, err := countIDs(ctx, e.File, max(e.FirstID, firstID), min(e.LastID, lastID))
+		if err != nil {
+			return fmt.Errorf("ids %d to %d: count rows in %s: %w", firstID, lastID, e.File, err)
+		}
+		found += n
+	}
+
+	if covered < lastID {
+		return fmt.Errorf("ids %d to %d: archive files only go to id %d", firstID, lastID, covered)
+	}
+
+	return VerifyCount(firstID, lastID, count, found)
+}
+
+// ReaderIDCounter returns an IDCounter that reads the files with the
+// Reader
+func ReaderIDCounter(r Reader) IDCounter {
+	return func(ctx context.Context, file string, firstID, lastID int64) (int64, error) {
+		var n int64
+		err := r.ReadFile(ctx, file, func(ls *logscore.LogScore) error {
+			if ls.ID >= firstID && ls.ID <= lastID {
+				n++
+			}
+			return nil
+		})
+		return n, err
+	}
+}
+
+// ScanFile reads an archive file to make its manifest entry, for files
+// written before the archiver recorded them. ok is false if the file
+// doesn't have any rows.
+func ScanFile(ctx context.Context, r Reader, file string) (entry ManifestEntry, ok bool, err error) {
+	entry.File = file
+	err = r.ReadFile(ctx, file, func(ls *logscore.LogScore) error {
+		if entry.Count == 0 || ls.ID < entry.FirstID {
+			entry.FirstID = ls.ID
+		}
+		if entry.Count == 0 || ls.ID > entry.LastID {
+			entry.LastID = ls.ID
+		}
+		entry.Count++
+		return nil
+	})
+	if err != nil {
+		return entry, false, fmt.Errorf("scan %s: %w", file, err)
+	}
+	return entry, entry.Count > 0, nil
+}
+
+// OverlappingFiles returns the archive files that can have ids from
+// firstID to lastID, going by the first id in their names (see
+// FileStart); a file can have the ids until the next file starts.
+// Names that aren't archive file names are skipped.
+func OverlappingFiles(names []string, firstID, lastID int64) []string {
+	type file struct {
+		name string
+		id   int64
+	}
+
+	files := []file{}
+	for _, name := range names {
+		if _, id, ok := FileStart(name); ok {
+			files = append(files, file{name, id})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].id < files[j].id
+	})
+
+	selected := []string{}
+	for i, f := range files {
+		if f.id > lastID {
+			break
+		}
+		if i+1 < len(files) && files[i+1].id <= firstID {
+			continue
+		}
+		selected = append(selected, f.name)
+	}
+
+	return selected
+}
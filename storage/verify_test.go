@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.ntppool.org/archiver/logscore"
+)
+
+func TestVerifyCount(t *testing.T) {
+	assert.NoError(t, VerifyCount(1, 10, 10, 10))
+	assert.NoError(t, VerifyCount(1, 10, 10, 12))
+
+	err := VerifyCount(1, 10, 10, 9)
+	var verr *VerifyError
+	assert.True(t, errors.As(err, &verr))
+	assert.Equal(t, int64(9), verr.Found)
+	assert.Equal(t, "ids 1 to 10: expected 10 rows, found 9", err.Error())
+}
+
+func TestVerifyManifest(t *testing.T) {
+	// the ids 96 to 100 are missing from the first file; it can't be
+	// read for ranges ending at 99
+	countIDs := func(ctx context.Context, file string, firstID, lastID int64) (int64, error) {
+		if lastID == 99 {
+			return 0, errors.New("gone")
+		}
+		n := lastID - firstID + 1
+		if file == "100-1.avro" && lastID > 95 {
+			n -= lastID - max(firstID, 96) + 1
+		}
+		return n, nil
+	}
+
+	entries := []ManifestEntry{
+		{File: "100-1.avro", FirstID: 1, LastID: 100, Count: 95},
+		{File: "200-101.avro", FirstID: 101, LastID: 200, Count: 50},
+		{File: "200-101.avro", FirstID: 101, LastID: 200, Count: 100},
+		{File: "300-205.avro", FirstID: 205, LastID: 300, Count: 96},
+	}
+
+	tests := []struct {
+		name    string
+		entries []ManifestEntry
+		first   int64
+		last    int64
+		count   int64
+		errMsg  string
+	}{
+		{"inside one file", entries, 10, 50, 41, ""},
+		{"rows outside the range don't count", entries, 90, 150, 61, "expected 61 rows, found 56"},
+		{"file can't be read", entries, 1, 99, 10, "count rows in 100-1.avro: gone"},
+		{"across files", entries, 50, 250, 150, ""},
+		{"rewritten file uses the last entry", entries, 101, 200, 100, ""},
+		{"too few rows", entries, 1, 300, 300, "expected 300 rows, found 291"},
+		{"before the first file", entries[1:], 50, 150, 10, "no archive file has id 50"},
+		{"after the last file", entries, 250, 400, 10, "archive files only go to id 300"},
+		{"no files", nil, 1, 10, 10, "expected 10 rows, found 0"},
+		{
+			"overlapping files",
+			append([]ManifestEntry{{File: "150-90.avro", FirstID: 90, LastID: 150, Count: 61}}, entries...),
+			1, 200, 10, "overlaps the previous file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyManifest(context.Background(), tt.entries, tt.first, tt.last, tt.count, countIDs)
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.errMsg)
+			}
+		})
+	}
+}
+
+type testReader map[string][]int64
+
+func (r testReader) Files(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (r testReader) ReadFile(ctx context.Context, name string, fn func(*logscore.LogScore) error) error {
+	ids, ok := r[name]
+	if !ok {
+		return fmt.Errorf("%s: not found", name)
+	}
+	for _, id := range ids {
+		if err := fn(&logscore.LogScore{ID: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestScanFile(t *testing.T) {
+	r := testReader{"a.avro": {5, 3, 9}, "empty.avro": {}}
+	ctx := context.Background()
+
+	entry, ok, err := ScanFile(ctx, r, "a.avro")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, ManifestEntry{File: "a.avro", FirstID: 3, LastID: 9, Count: 3}, entry)
+
+	_, ok, err = ScanFile(ctx, r, "empty.avro")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = ScanFile(ctx, r, "b.avro")
+	assert.Error(t, err)
+
+	n, err := ReaderIDCounter(r)(ctx, "a.avro", 4, 9)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestOverlappingFiles(t *testing.T) {
+	names := []string{
+		"2022/300-205.avro",
+		"2021/100-1.avro",
+		"manifest.jsonl",
+		"2022/200-101.avro",
+	}
+
+	assert.Equal(t, []string{"2021/100-1.avro"}, OverlappingFiles(names, 10, 50))
+	assert.Equal(t, []string{"2022/200-101.avro", "2022/300-205.avro"}, OverlappingFiles(names, 150, 205))
+	assert.Equal(t, []string{"2022/300-205.avro"}, OverlappingFiles(names, 400, 500))
+	assert.Empty(t, OverlappingFiles(names, -10, 0))
+}